@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"edusoho_search/analysis"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+)
+
+var (
+	//中文分词, 拼音和同义词配置, 也是mapping模板的数据; 修改同义词时整个替换
+	currentAnalysis atomic.Value // analysis.Config
+	synonymFile     string
+	//修改同义词的请求一个一个执行
+	synonymMu sync.Mutex
+)
+
+func analysisConfig() analysis.Config {
+	return currentAnalysis.Load().(analysis.Config)
+}
+
+//读取 [analysis] 段和同义词文件, 要在加载mapping之前调用
+func loadAnalysis() error {
+	cfg := appConfig().Analysis
+	conf := analysis.Config{
+		Analyzer: cfg.Analyzer,
+		Pinyin:   cfg.Pinyin,
+	}
+	synonymFile = cfg.Synonyms
+	synonyms, err := analysis.LoadSynonyms(synonymFile)
+	if err != nil {
+		return err
+	}
+	conf.Synonyms = synonyms
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	currentAnalysis.Store(conf)
+	return nil
+}
+
+//文本字段的查询: 分词后所有词都要命中; 有拼音子字段时拼音命中也算, 比如 linxuan 能搜到 遴选
+func textQuery(field, text string) elastic.Query {
+	query := elastic.NewMatchQuery(field, text).Operator("and")
+	if !hasPinyin(field) {
+		return query
+	}
+	//拼音的权重低一些, 中文原文命中的排在前面
+	pinyin := elastic.NewMatchQuery(field+".pinyin", text).Boost(0.5)
+	return elastic.NewBoolQuery().Should(query, pinyin).MinimumNumberShouldMatch(1)
+}
+
+func hasPinyin(field string) bool {
+	if !analysisConfig().Pinyin {
+		return false
+	}
+	for _, f := range analysis.PinyinFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+type synonymsRequest struct {
+	Synonyms []string `json:"synonyms"`
+	Index    string   `json:"index"` //要更新的线上索引或别名, 默认 course
+}
+
+type synonymsResponse struct {
+	Synonyms []string `json:"synonyms"`
+	Index    string   `json:"index,omitempty"`
+	Applied  bool     `json:"applied"` //索引不存在时只保存文件, 下次建索引时生效
+}
+
+//GET /api/v1/admin/synonyms
+func getSynonyms(c *gin.Context) {
+	c.JSON(http.StatusOK, synonymsResponse{Synonyms: analysisConfig().Synonyms})
+}
+
+//PUT /api/v1/admin/synonyms, 整体替换同义词: 保存文件, 重新渲染mapping, 再更新线上索引
+//更新索引时会短暂关闭索引, 期间的搜索会失败
+func putSynonyms(c *gin.Context) {
+	var req synonymsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	if req.Synonyms == nil {
+		req.Synonyms = []string{}
+	}
+	if req.Index == "" {
+		req.Index = appConfig().Indices.Course
+	}
+	if err := analysis.ValidateSynonyms(req.Synonyms); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+
+	synonymMu.Lock()
+	defer synonymMu.Unlock()
+	if err := analysis.SaveSynonyms(synonymFile, req.Synonyms); err != nil {
+		abortWithError(c, errInternal(err))
+		return
+	}
+	conf := analysisConfig()
+	conf.Synonyms = req.Synonyms
+	if err := registry.Render(conf); err != nil {
+		abortWithError(c, errInternal(err))
+		return
+	}
+	currentAnalysis.Store(conf)
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	resp := synonymsResponse{Synonyms: req.Synonyms, Index: req.Index}
+	exists, err := repo.IndexExists(ctx, req.Index)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if exists {
+		if err := analysis.ApplySynonyms(repo, req.Index, req.Synonyms, appConfig().Server.RequestTimeout); err != nil {
+			abortWithError(c, err)
+			return
+		}
+		resp.Applied = true
+	}
+	c.JSON(http.StatusOK, resp)
+}
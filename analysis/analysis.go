@@ -0,0 +1,85 @@
+//analysis 课程索引的中文分词配置: 分词插件(IK/smartcn), 拼音子字段和同义词
+package analysis
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	AnalyzerIK       = "ik"
+	AnalyzerSmartcn  = "smartcn"
+	AnalyzerStandard = "standard"
+)
+
+//mapping 文件里用到的分析器和过滤器名字
+const (
+	IndexAnalyzer  = "course_index"
+	SearchAnalyzer = "course_search"
+	PinyinAnalyzer = "course_pinyin"
+	SynonymFilter  = "course_synonym"
+)
+
+//有 .pinyin 子字段的字段
+var PinyinFields = []string{"title"}
+
+//来自 conf/app.ini 的 [analysis] 段, 同时作为 mapping 模板的数据
+type Config struct {
+	Analyzer string   //ik, smartcn 或 standard, es上要装对应的插件
+	Pinyin   bool     //需要 elasticsearch-analysis-pinyin 插件
+	Synonyms []string //同义词, solr格式, 每行一组
+}
+
+//建索引时用的分词器, ik_max_word 切得更细, 召回更多
+func (c Config) IndexTokenizer() string {
+	switch c.Analyzer {
+	case AnalyzerIK:
+		return "ik_max_word"
+	case AnalyzerSmartcn:
+		return "smartcn_tokenizer"
+	}
+	return "standard"
+}
+
+//搜索时用的分词器, ik_smart 切得粗, 结果更准
+func (c Config) SearchTokenizer() string {
+	if c.Analyzer == AnalyzerIK {
+		return "ik_smart"
+	}
+	return c.IndexTokenizer()
+}
+
+func (c Config) Validate() error {
+	switch c.Analyzer {
+	case AnalyzerIK, AnalyzerSmartcn, AnalyzerStandard:
+	default:
+		return fmt.Errorf("analysis: unknown analyzer %q, want ik, smartcn or standard", c.Analyzer)
+	}
+	return ValidateSynonyms(c.Synonyms)
+}
+
+//检查solr格式的同义词: "a, b, c" 或者 "a, b => c"
+func ValidateSynonyms(synonyms []string) error {
+	for i, line := range synonyms {
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("analysis: synonym %d contains a line break", i+1)
+		}
+		sides := strings.Split(line, "=>")
+		if len(sides) > 2 {
+			return fmt.Errorf("analysis: synonym %q has more than one =>", line)
+		}
+		terms := 0
+		for _, side := range sides {
+			for _, term := range strings.Split(side, ",") {
+				if strings.TrimSpace(term) == "" {
+					return fmt.Errorf("analysis: synonym %q has an empty term", line)
+				}
+				terms++
+			}
+		}
+		if terms < 2 {
+			return fmt.Errorf("analysis: synonym %q needs at least two terms", line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+)
+
+func TestValidateSynonyms(t *testing.T) {
+	valid := []string{"公务员, 公考", "事业编, 事业单位 => 事业单位", "a,b,c"}
+	if err := ValidateSynonyms(valid); err != nil {
+		t.Error(err)
+	}
+	for _, line := range []string{"公考", "a, , b", "a => b => c", "=> b", "a\nb"} {
+		if err := ValidateSynonyms([]string{line}); err == nil {
+			t.Errorf("%q should be invalid", line)
+		}
+	}
+	if err := (Config{Analyzer: "jieba"}).Validate(); err == nil {
+		t.Error("unknown analyzer should be invalid")
+	}
+	if c := (Config{Analyzer: AnalyzerIK}); c.IndexTokenizer() != "ik_max_word" || c.SearchTokenizer() != "ik_smart" {
+		t.Errorf("ik tokenizers = %s, %s", c.IndexTokenizer(), c.SearchTokenizer())
+	}
+}
+
+func TestSaveSynonyms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "synonyms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "synonyms", "course.txt")
+
+	if synonyms, err := LoadSynonyms(path); err != nil || len(synonyms) != 0 {
+		t.Errorf("missing file = %v, %v", synonyms, err)
+	}
+	want := []string{"公务员, 公考", "遴选, 公开遴选"}
+	if err := SaveSynonyms(path, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadSynonyms(path)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded %v, %v", got, err)
+	}
+	if err := SaveSynonyms(path, []string{"公考"}); err == nil {
+		t.Error("invalid synonyms were saved")
+	}
+}
+
+func TestApplySynonyms(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	repo, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	body := `{"settings":{"analysis":{"filter":{"course_synonym":{"type":"synonym_graph","synonyms":[]}}}}}`
+	if _, err := repo.CreateIndex(ctx, "course_v4", body); err != nil {
+		t.Fatal(err)
+	}
+
+	//索引打开时不能直接改分析器
+	settings := map[string]interface{}{"analysis": map[string]interface{}{"filter": map[string]interface{}{}}}
+	if err := repo.PutSettings(ctx, "course_v4", settings); err == nil {
+		t.Error("analysis settings were updated on an open index")
+	}
+
+	if err := ApplySynonyms(repo, "course_v4", []string{"公务员, 公考"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	live, err := repo.GetSettings(ctx, "course_v4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(live)
+	if !strings.Contains(string(data), `"synonyms":["公务员, 公考"]`) {
+		t.Errorf("settings = %s", data)
+	}
+	if _, err := repo.Count(ctx, "course_v4"); err != nil {
+		t.Errorf("index was not reopened: %v", err)
+	}
+}
+
+//修改设置失败
+type failingSettings struct {
+	backend.SearchBackend
+}
+
+func (b failingSettings) PutSettings(ctx context.Context, index string, settings map[string]interface{}) error {
+	return errors.New("settings rejected")
+}
+
+//修改设置失败时索引也要重新打开
+func TestApplySynonymsReopens(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	repo, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := repo.CreateIndex(ctx, "course_v4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplySynonyms(failingSettings{repo}, "course_v4", []string{"公务员, 公考"}, time.Second); err == nil || err.Error() != "settings rejected" {
+		t.Errorf("err = %v", err)
+	}
+	if _, err := repo.Count(ctx, "course_v4"); err != nil {
+		t.Errorf("index was not reopened: %v", err)
+	}
+}
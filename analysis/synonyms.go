@@ -0,0 +1,87 @@
+package analysis
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"edusoho_search/backend"
+)
+
+//读取同义词文件, 空行和 # 开头的注释跳过, 文件不存在时返回空
+func LoadSynonyms(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	synonyms := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		synonyms = append(synonyms, line)
+	}
+	return synonyms, scanner.Err()
+}
+
+//先写临时文件再rename
+func SaveSynonyms(path string, synonyms []string) error {
+	if err := ValidateSynonyms(synonyms); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content := "#课程同义词, 由 PUT /api/v1/admin/synonyms 维护\n" + strings.Join(synonyms, "\n") + "\n"
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//更新线上索引的同义词: 分析器设置只能在索引关闭时修改, 所以先close再open,
+//期间搜索会失败. 同义词只用在搜索分析器上, 已有的文档不需要重建
+//不用请求的 ctx, 调用方断开或者超时后索引也一定会重新打开; close 和修改设置共用 timeout, 重新打开另算
+func ApplySynonyms(repo backend.SearchBackend, index string, synonyms []string, timeout time.Duration) error {
+	settings := map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"filter": map[string]interface{}{
+				SynonymFilter: SynonymFilterSettings(synonyms),
+			},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := repo.CloseIndex(ctx, index); err != nil {
+		return err
+	}
+	err := repo.PutSettings(ctx, index, settings)
+	//设置失败或者超时也要重新打开索引
+	openCtx, openCancel := context.WithTimeout(context.Background(), timeout)
+	defer openCancel()
+	if openErr := repo.OpenIndex(openCtx, index); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+//synonym_graph 只能用在搜索分析器上, 能正确处理多个词的同义词
+func SynonymFilterSettings(synonyms []string) map[string]interface{} {
+	if synonyms == nil {
+		synonyms = []string{}
+	}
+	return map[string]interface{}{
+		"type":     "synonym_graph",
+		"synonyms": synonyms,
+	}
+}
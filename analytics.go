@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+)
+
+//按时间统计的请求, 比如每月新建的课程数和学员数之和
+type DateHistogramRequest struct {
+	Index     string `json:"index" validate:"required"`
+	TimeField string `json:"time_field" validate:"required"` // date类型的字段, 比如 createdTime.date
+	//日历间隔 minute/hour/day/week/month/quarter/year, 或者固定间隔 30m, 12h, 7d
+	Interval string `json:"interval" validate:"required"`
+	TimeZone string `json:"time_zone"` // 默认 +08:00
+	//时间范围, 和时间字段的格式一致(createdTime.date 是秒), 同时作为没有数据时补齐的首尾桶
+	Start interface{} `json:"start"`
+	End   interface{} `json:"end"`
+	//term过滤, 字段 => 取值, 多个取值时匹配任意一个
+	Terms   map[string][]interface{} `json:"terms"`
+	Metrics []*Metric                `json:"metrics" validate:"dive,required"` // 不能有 null
+}
+
+//每个桶里的指标
+type Metric struct {
+	Name  string `json:"name" validate:"required"`
+	Type  string `json:"type" validate:"required,oneof=sum avg max cardinality"`
+	Field string `json:"field" validate:"required"`
+}
+
+type TimeBucket struct {
+	Key     int64               `json:"key"`  // 桶的开始时间, 毫秒时间戳
+	Time    string              `json:"time"` // 按时区格式化的开始时间
+	Count   int64               `json:"count"`
+	Metrics map[string]*float64 `json:"metrics,omitempty"` // 桶里没有数据时 avg/max 为 null
+}
+
+type DateHistogramResponse struct {
+	Total    int64         `json:"total"`
+	Interval string        `json:"interval"`
+	TimeZone string        `json:"time_zone"`
+	Buckets  []*TimeBucket `json:"buckets"`
+}
+
+const defaultTimeZone = "+08:00"
+
+var intervalPattern = regexp.MustCompile(`^(minute|hour|day|week|month|quarter|year|\d+(ms|s|m|h|d))$`)
+
+func (r *DateHistogramRequest) source() *elastic.SearchSource {
+	agg := elastic.NewDateHistogramAggregation().
+		Field(r.TimeField).
+		Interval(r.Interval).
+		TimeZone(r.TimeZone).
+		MinDocCount(0)
+	if r.Start != nil || r.End != nil {
+		agg.ExtendedBounds(r.Start, r.End)
+	}
+	for _, m := range r.Metrics {
+		switch m.Type {
+		case "sum":
+			agg.SubAggregation(m.Name, elastic.NewSumAggregation().Field(m.Field))
+		case "avg":
+			agg.SubAggregation(m.Name, elastic.NewAvgAggregation().Field(m.Field))
+		case "max":
+			agg.SubAggregation(m.Name, elastic.NewMaxAggregation().Field(m.Field))
+		case "cardinality":
+			agg.SubAggregation(m.Name, elastic.NewCardinalityAggregation().Field(m.Field))
+		}
+	}
+
+	query := elastic.NewBoolQuery()
+	if r.Start != nil || r.End != nil {
+		timeRange := elastic.NewRangeQuery(r.TimeField)
+		if r.Start != nil {
+			timeRange.Gte(r.Start)
+		}
+		if r.End != nil {
+			timeRange.Lte(r.End)
+		}
+		query.Filter(timeRange)
+	}
+	for field, values := range r.Terms {
+		query.Filter(elastic.NewTermsQuery(field, values...))
+	}
+	return elastic.NewSearchSource().Query(query).Size(0).Aggregation("histogram", agg)
+}
+
+func (r *DateHistogramRequest) response(res *elastic.SearchResult) *DateHistogramResponse {
+	resp := &DateHistogramResponse{Interval: r.Interval, TimeZone: r.TimeZone, Buckets: make([]*TimeBucket, 0)}
+	if res.Hits != nil {
+		resp.Total = res.Hits.TotalHits
+	}
+	histogram, ok := res.Aggregations.DateHistogram("histogram")
+	if !ok {
+		return resp
+	}
+	for _, b := range histogram.Buckets {
+		bucket := &TimeBucket{Key: int64(b.Key), Count: b.DocCount}
+		if b.KeyAsString != nil {
+			bucket.Time = *b.KeyAsString
+		}
+		if len(r.Metrics) > 0 {
+			bucket.Metrics = make(map[string]*float64, len(r.Metrics))
+		}
+		for _, m := range r.Metrics {
+			//各种单值指标的结果结构相同
+			if v, ok := b.Aggregations.Sum(m.Name); ok {
+				bucket.Metrics[m.Name] = v.Value
+			}
+		}
+		resp.Buckets = append(resp.Buckets, bucket)
+	}
+	return resp
+}
+
+//POST /api/v1/analytics/date_histogram
+func dateHistogram(c *gin.Context) {
+	var req DateHistogramRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if !intervalPattern.MatchString(req.Interval) {
+		abortWithError(c, errBadRequest(fmt.Errorf("invalid interval %q", req.Interval)))
+		return
+	}
+	if req.TimeZone == "" {
+		req.TimeZone = defaultTimeZone
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, req.Index, req.source())
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, req.response(res))
+}
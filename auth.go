@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"edusoho_search/auth"
+	"edusoho_search/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	//[clients] 里的调用方, SIGHUP 时重新加载
+	authenticator atomic.Value // *auth.Authenticator
+	auditLog      *auth.AuditLog
+)
+
+//认证通过后调用方放在 gin.Context 里的 key
+const clientKey = "auth.client"
+
+//签过名的请求体和 _bulk 一样受 max_body_bytes 限制
+func loadAuth(cfg *config.Config) (*auth.Authenticator, error) {
+	a, err := auth.New(cfg.Clients, cfg.Auth.MaxClockSkew, cfg.Bulk.MaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if old, ok := authenticator.Load().(*auth.Authenticator); ok {
+		a.KeepUsedSignatures(old)
+	}
+	return a, nil
+}
+
+func setupAuth() error {
+	cfg := appConfig()
+	a, err := loadAuth(cfg)
+	if err != nil {
+		return err
+	}
+	authenticator.Store(a)
+
+	var w io.Writer = os.Stdout
+	if cfg.Auth.AuditLog != "" {
+		f, err := os.OpenFile(cfg.Auth.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	auditLog = auth.NewAuditLog(w)
+	return nil
+}
+
+//要求调用方至少有 role 角色; public_search 打开时搜索接口不带认证信息也可以调用
+func requireRole(role string) gin.HandlerFunc {
+	return authorize(role, role == auth.RoleSearch)
+}
+
+//导出, 按id读文档这类能取出整个索引的接口, public_search 打开时也要带认证信息
+func requireClient(role string) gin.HandlerFunc {
+	return authorize(role, false)
+}
+
+func authorize(role string, public bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, err := authenticator.Load().(*auth.Authenticator).Authenticate(c.Request)
+		if err == auth.ErrNoCredentials && public && appConfig().Auth.PublicSearch {
+			c.Next()
+			return
+		}
+		if err == auth.ErrBodyTooLarge {
+			abortWithError(c, errTooLarge(err))
+			return
+		}
+		if err != nil {
+			abortWithError(c, errUnauthorized(err))
+			return
+		}
+		c.Set(clientKey, client)
+		if !client.Can(role) {
+			abortWithError(c, errForbidden(fmt.Errorf("client %s has role %s, %s required", client.Name, client.Role, role)))
+			return
+		}
+		c.Next()
+	}
+}
+
+//写操作记审计日志, 要放在 requireRole 前面, 认证失败的请求也要记录;
+//all 为 false 时只记录 GET 以外的请求
+func audit(all bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !all && c.Request.Method == http.MethodGet {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		entry := &auth.AuditEntry{
+			Time:     start,
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.Path,
+			Query:    c.Request.URL.RawQuery,
+			Status:   c.Writer.Status(),
+			RemoteIP: c.ClientIP(),
+			Duration: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if v, ok := c.Get(clientKey); ok {
+			client := v.(*auth.Client)
+			entry.Client, entry.Role = client.Name, client.Role
+		}
+		if err := auditLog.Record(entry); err != nil {
+			log.Printf("audit log: %v", err)
+		}
+	}
+}
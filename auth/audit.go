@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+//一次写操作的审计记录, 认证失败的请求 Client 为空
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Status   int       `json:"status"`
+	RemoteIP string    `json:"remote_ip"`
+	Duration float64   `json:"duration_ms"`
+}
+
+//每条记录一行json, 多个请求同时写时不会交错
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+func (l *AuditLog) Record(e *AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,229 @@
+//auth 是接口的认证和授权: 静态令牌或者 HMAC 签名的请求, 按角色区分只读的搜索客户端和索引管理员
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//角色, admin 可以调用 search 的所有接口
+const (
+	RoleSearch = "search"
+	RoleAdmin  = "admin"
+)
+
+var roleLevel = map[string]int{RoleSearch: 1, RoleAdmin: 2}
+
+//HMAC 签名用的请求头
+const (
+	HeaderClient    = "X-Auth-Client"
+	HeaderTimestamp = "X-Auth-Timestamp"
+	HeaderSignature = "X-Auth-Signature"
+)
+
+//令牌太短容易被猜到
+const minSecretLength = 16
+
+var (
+	ErrNoCredentials    = errors.New("missing credentials")
+	ErrInvalidToken     = errors.New("invalid token")
+	ErrUnknownClient    = errors.New("unknown client")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrClockSkew        = errors.New("request timestamp is too far from server time")
+	ErrReplayed         = errors.New("signature has already been used")
+	ErrBodyTooLarge     = errors.New("request body is too large")
+)
+
+//调用方, secret 既是 Bearer 令牌也是 HMAC 的密钥
+type Client struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	secret string
+}
+
+func (c *Client) Can(role string) bool {
+	return roleLevel[c.Role] >= roleLevel[role]
+}
+
+//配置里的一项, "角色:令牌"; 错误信息里不带令牌
+func ParseClient(name, value string) (*Client, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("client %s: want role:token", name)
+	}
+	role, secret := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if _, ok := roleLevel[role]; !ok {
+		return nil, fmt.Errorf("client %s: unknown role %q, want %s or %s", name, role, RoleSearch, RoleAdmin)
+	}
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("client %s: token must be at least %d characters", name, minSecretLength)
+	}
+	return &Client{Name: name, Role: role, secret: secret}, nil
+}
+
+type Authenticator struct {
+	clients map[string]*Client
+	//HMAC 请求的时间戳和服务器时间最多相差多少
+	maxSkew time.Duration
+	//签名时读取的请求体最多多少字节
+	maxBody int64
+	now     func() time.Time
+	used    *usedSignatures
+}
+
+//时间窗口内用过的签名, 同一个签名不能用两次; 只记在进程内, 多个实例之间不共享
+type usedSignatures struct {
+	mu sync.Mutex
+	//签名 => 过期时间, 过期后时间戳检查就会拒绝
+	seen map[string]time.Time
+	//上次清理过期签名的时间
+	pruned time.Time
+}
+
+//第一次使用时返回 true
+func (u *usedSignatures) use(signature string, now, expires time.Time, window time.Duration) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Sub(u.pruned) > window {
+		for s, t := range u.seen {
+			if !now.Before(t) {
+				delete(u.seen, s)
+			}
+		}
+		u.pruned = now
+	}
+	if t, ok := u.seen[signature]; ok && now.Before(t) {
+		return false
+	}
+	u.seen[signature] = expires
+	return true
+}
+
+//clients 是 名字 => "角色:令牌", maxBody 和 _bulk 的请求体上限一致
+func New(clients map[string]string, maxSkew time.Duration, maxBody int64) (*Authenticator, error) {
+	a := &Authenticator{
+		clients: make(map[string]*Client, len(clients)),
+		maxSkew: maxSkew,
+		maxBody: maxBody,
+		now:     time.Now,
+		used:    &usedSignatures{seen: make(map[string]time.Time)},
+	}
+	secrets := make(map[string]string, len(clients))
+	//按名字排序, 错误信息稳定
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, err := ParseClient(name, clients[name])
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := secrets[c.secret]; ok {
+			return nil, fmt.Errorf("client %s: same token as %s", name, other)
+		}
+		secrets[c.secret] = name
+		a.clients[name] = c
+	}
+	return a, nil
+}
+
+//重新加载配置后, 之前用过的签名仍然不能再用
+func (a *Authenticator) KeepUsedSignatures(old *Authenticator) {
+	if old != nil {
+		a.used = old.used
+	}
+}
+
+//从请求里取出调用方, 请求头是 Authorization: Bearer <令牌>,
+//或者 X-Auth-Client, X-Auth-Timestamp(unix 秒), X-Auth-Signature 三个头, 签名见 Sign;
+//签名在时间戳的有效期内只能用一次, 重放的请求返回 ErrReplayed
+//没有任何认证信息时返回 ErrNoCredentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Client, error) {
+	if name := r.Header.Get(HeaderClient); name != "" {
+		return a.verifySignature(r, name)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, ErrNoCredentials
+	}
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, ErrInvalidToken
+	}
+	token := []byte(strings.TrimSpace(header[len(prefix):]))
+	var found *Client
+	//逐个比较所有令牌, 耗时和令牌是否匹配无关
+	for _, c := range a.clients {
+		if subtle.ConstantTimeCompare(token, []byte(c.secret)) == 1 {
+			found = c
+		}
+	}
+	if found == nil {
+		return nil, ErrInvalidToken
+	}
+	return found, nil
+}
+
+func (a *Authenticator) verifySignature(r *http.Request, name string) (*Client, error) {
+	c, ok := a.clients[name]
+	if !ok {
+		return nil, ErrUnknownClient
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	now := a.now()
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, ErrClockSkew
+	}
+	signature := r.Header.Get(HeaderSignature)
+	if len(signature) != hex.EncodedLen(sha256.Size) {
+		return nil, ErrInvalidSignature
+	}
+	//头都检查过了才读请求体, 签名包含请求体, 读完后放回去给 handler 用
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, a.maxBody))
+		r.Body.Close()
+		if err != nil {
+			if int64(len(body)) >= a.maxBody {
+				return nil, ErrBodyTooLarge
+			}
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := Sign(c.secret, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrInvalidSignature
+	}
+	//时间戳过了有效期之后这个签名也会被时间检查拒绝
+	if !a.used.use(signature, now, time.Unix(timestamp, 0).Add(a.maxSkew+time.Second), a.maxSkew) {
+		return nil, ErrReplayed
+	}
+	return c, nil
+}
+
+//hex(hmac_sha256(令牌, 方法 + "\n" + 路径和查询参数 + "\n" + 时间戳 + "\n" + hex(sha256(请求体))))
+func Sign(secret, method, requestURI string, timestamp int64, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", strings.ToUpper(method), requestURI, timestamp, hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//es6 一个索引只有一个type, 不指定时统一用 doc
+const DefaultType = "doc"
+
+//连接配置, 来自 conf/app.ini
+type Config struct {
+	Addresses []string //es节点地址
+	DocType   string   //文档的type, 默认 doc
+	Username  string   //basic auth
+	Password  string
+	APIKey    string //"id:api_key" 或者 base64 编码后的值, 设置了 Username 时不要再设置
+	//https 的证书, 为空时用系统的 CA
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+	Timeout            time.Duration //单次http请求的超时
+	//连接失败和 RetryOnStatus 里的状态码(比如 429, 503)按指数退避重试 MaxRetries 次, 0 表示不重试;
+	//POST 这类不幂等的请求只在 429 时重试
+	RetryOnStatus   []int
+	MaxRetries      int
+	RetryBackoff    time.Duration //第一次重试前的等待, 之后每次翻倍, 默认 100ms
+	RetryMaxBackoff time.Duration //默认 5s
+	Sniff           bool          //从集群获取所有节点
+	SnifferInterval time.Duration
+	//定时检查节点是否可用, 不可用的节点暂时不发请求
+	DisableHealthcheck  bool
+	HealthcheckInterval time.Duration
+	//为空时用 NewTransport 创建, 监控连接池时替换; 替换时 https 的配置要自己设置
+	Transport http.RoundTripper
+}
+
+//handler和goes共用的es访问接口, 测试时可以替换成fake
+type SearchBackend interface {
+	//集群
+	Ping(ctx context.Context) (*elastic.PingResult, error)
+	Version(ctx context.Context) (string, error)
+	ClusterHealth(ctx context.Context) (*elastic.ClusterHealthResponse, error)
+
+	//索引管理
+	IndexExists(ctx context.Context, index ...string) (bool, error)
+	CreateIndex(ctx context.Context, index string, body interface{}) (*elastic.IndicesCreateResult, error)
+	DeleteIndex(ctx context.Context, index ...string) (*elastic.IndicesDeleteResponse, error)
+	GetMapping(ctx context.Context, index string) (map[string]interface{}, error)
+	GetSettings(ctx context.Context, index string) (map[string]interface{}, error)
+	PutSettings(ctx context.Context, index string, settings map[string]interface{}) error
+	//analysis 这类静态设置要先关闭索引才能修改
+	CloseIndex(ctx context.Context, index string) error
+	OpenIndex(ctx context.Context, index string) error
+	Refresh(ctx context.Context, index ...string) error
+	Count(ctx context.Context, index string) (int64, error)
+
+	//别名, AliasIndices 返回别名指向的索引, 别名不存在时返回空
+	AliasIndices(ctx context.Context, alias string) ([]string, error)
+	//别名, 通配符和逗号分隔的多个名字对应的实际索引, 按名字排序; 都不存在时返回空
+	ResolveIndices(ctx context.Context, expr string) ([]string, error)
+	UpdateAliases(ctx context.Context, actions ...elastic.AliasAction) error
+	Reindex(ctx context.Context, source, dest string) (*elastic.BulkIndexByScrollResponse, error)
+
+	//单文档操作, id为空时由es生成
+	Index(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.IndexResponse, error)
+	Create(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.IndexResponse, error)
+	Get(ctx context.Context, index, id string, opts ...DocOption) (*elastic.GetResult, error)
+	Update(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.UpdateResponse, error)
+	Delete(ctx context.Context, index, id string, opts ...DocOption) (*elastic.DeleteResponse, error)
+	Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error)
+
+	//查询, source 可以是 *elastic.SearchSource 或者能序列化成json的请求体
+	Search(ctx context.Context, index string, source interface{}) (*elastic.SearchResult, error)
+	//滚动查询所有结果, 每批调用一次 fn, fn 返回错误时停止; 结束后清理 scroll 上下文
+	Scroll(ctx context.Context, index string, source *elastic.SearchSource, keepAlive string, fn func(*elastic.SearchResult) error) error
+	//opts 里只有 refresh, routing 和 conflicts 生效
+	UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script, opts ...DocOption) (*elastic.BulkIndexByScrollResponse, error)
+	DeleteByQuery(ctx context.Context, index string, query elastic.Query, opts ...DocOption) (*elastic.BulkIndexByScrollResponse, error)
+}
+
+//单文档操作的可选参数
+type DocOption func(*docOptions)
+
+type docOptions struct {
+	typ         string
+	version     *int64
+	versionType string
+	//乐观锁, 和 version 二选一
+	ifSeqNo       *int64
+	ifPrimaryTerm *int64
+	refresh       string
+	routing       string
+	conflicts     string
+}
+
+//指定文档的type, 兼容老索引(test_type, course_type)
+func WithType(typ string) DocOption {
+	return func(o *docOptions) {
+		o.typ = typ
+	}
+}
+
+//文档当前的版本号是 version 时才写入; versionType 为 external 时要求 version 比当前的大
+func WithVersion(version int64, versionType string) DocOption {
+	return func(o *docOptions) {
+		o.version = &version
+		o.versionType = versionType
+	}
+}
+
+//文档最后一次修改的 _seq_no 和 _primary_term 一致时才写入, 不一致时 es 返回 409
+func WithSeqNo(seqNo, primaryTerm int64) DocOption {
+	return func(o *docOptions) {
+		o.ifSeqNo = &seqNo
+		o.ifPrimaryTerm = &primaryTerm
+	}
+}
+
+//写入后是否刷新: true, false 或者 wait_for
+func WithRefresh(refresh string) DocOption {
+	return func(o *docOptions) {
+		o.refresh = refresh
+	}
+}
+
+func WithRouting(routing string) DocOption {
+	return func(o *docOptions) {
+		o.routing = routing
+	}
+}
+
+//by query 遇到版本冲突时: abort(默认) 或者 proceed
+func WithConflicts(conflicts string) DocOption {
+	return func(o *docOptions) {
+		o.conflicts = conflicts
+	}
+}
+
+func newDocOptions(defaultType string, opts []DocOption) *docOptions {
+	o := &docOptions{typ: defaultType}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+//单文档写请求的 url 参数
+func (o *docOptions) params() url.Values {
+	params := url.Values{}
+	if o.version != nil {
+		params.Set("version", strconv.FormatInt(*o.version, 10))
+		if o.versionType != "" {
+			params.Set("version_type", o.versionType)
+		}
+	}
+	if o.ifSeqNo != nil {
+		params.Set("if_seq_no", strconv.FormatInt(*o.ifSeqNo, 10))
+		params.Set("if_primary_term", strconv.FormatInt(*o.ifPrimaryTerm, 10))
+	}
+	if o.refresh != "" {
+		params.Set("refresh", o.refresh)
+	}
+	if o.routing != "" {
+		params.Set("routing", o.routing)
+	}
+	return params
+}
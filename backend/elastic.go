@@ -0,0 +1,328 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//基于olivere/elastic的实现, 整个进程共用一个连接池
+type Elastic struct {
+	client *elastic.Client
+	cfg    Config
+}
+
+func New(cfg Config) (*Elastic, error) {
+	if len(cfg.Addresses) == 0 {
+		return nil, errors.New("backend: no elasticsearch address configured")
+	}
+	if cfg.DocType == "" {
+		cfg.DocType = DefaultType
+	}
+	if cfg.Transport == nil {
+		t, err := NewTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Transport = t
+	}
+	errorlog := log.New(os.Stdout, "APP", log.LstdFlags)
+	options := []elastic.ClientOptionFunc{
+		elastic.SetErrorLog(errorlog),
+		elastic.SetURL(cfg.Addresses...),
+		elastic.SetHttpClient(&http.Client{Transport: wrapTransport(cfg, cfg.Transport), Timeout: cfg.Timeout}),
+		elastic.SetHealthcheck(!cfg.DisableHealthcheck),
+	}
+	if cfg.Username != "" {
+		options = append(options, elastic.SetBasicAuth(cfg.Username, cfg.Password))
+	}
+	if cfg.MaxRetries > 0 {
+		options = append(options, elastic.SetRetrier(cfg.retrier()))
+	}
+	if cfg.HealthcheckInterval > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(cfg.HealthcheckInterval))
+	}
+	if cfg.Sniff {
+		//sniff 到的节点地址不带协议, 和配置的第一个地址保持一致
+		if u, err := url.Parse(cfg.Addresses[0]); err == nil && u.Scheme == "https" {
+			options = append(options, elastic.SetScheme("https"))
+		}
+		if cfg.SnifferInterval > 0 {
+			options = append(options, elastic.SetSnifferInterval(cfg.SnifferInterval))
+		}
+	}
+	client, err := elastic.NewClient(append(options, elastic.SetSniff(cfg.Sniff))...)
+	if elastic.IsConnErr(err) {
+		//es 还没启动时不退出, 关掉启动时的健康检查和sniff先创建client, 请求时再连接; 服务是否可用看 /readyz
+		errorlog.Printf("elasticsearch is not available yet: %v", err)
+		client, err = elastic.NewClient(append(options, elastic.SetSniff(false), elastic.SetHealthcheck(false))...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Elastic{client: client, cfg: cfg}, nil
+}
+
+//底层client, 只给还没有抽象到接口里的功能使用
+func (b *Elastic) Client() *elastic.Client {
+	return b.client
+}
+
+func (b *Elastic) DocType() string {
+	return b.cfg.DocType
+}
+
+//GET / 经过 client 的连接池, 发给健康检查认为可用的节点, 第一个节点挂了也能通
+func (b *Elastic) Ping(ctx context.Context) (*elastic.PingResult, error) {
+	info := new(elastic.PingResult)
+	if err := b.perform(ctx, http.MethodGet, "/", nil, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (b *Elastic) Version(ctx context.Context) (string, error) {
+	info, err := b.Ping(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.Version.Number, nil
+}
+
+func (b *Elastic) ClusterHealth(ctx context.Context) (*elastic.ClusterHealthResponse, error) {
+	return b.client.ClusterHealth().Do(ctx)
+}
+
+func (b *Elastic) IndexExists(ctx context.Context, index ...string) (bool, error) {
+	return b.client.IndexExists(index...).Do(ctx)
+}
+
+func (b *Elastic) CreateIndex(ctx context.Context, index string, body interface{}) (*elastic.IndicesCreateResult, error) {
+	service := b.client.CreateIndex(index)
+	switch v := body.(type) {
+	case nil:
+	case string:
+		service.BodyString(v)
+	default:
+		service.BodyJson(v)
+	}
+	return service.Do(ctx)
+}
+
+func (b *Elastic) DeleteIndex(ctx context.Context, index ...string) (*elastic.IndicesDeleteResponse, error) {
+	return b.client.DeleteIndex(index...).Do(ctx)
+}
+
+func (b *Elastic) GetMapping(ctx context.Context, index string) (map[string]interface{}, error) {
+	return b.client.GetMapping().Index(index).Do(ctx)
+}
+
+//和 GetMapping 一样按实际索引名返回
+func (b *Elastic) GetSettings(ctx context.Context, index string) (map[string]interface{}, error) {
+	res, err := b.client.IndexGetSettings(index).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]interface{}, len(res))
+	for name, r := range res {
+		settings[name] = r.Settings
+	}
+	return settings, nil
+}
+
+func (b *Elastic) PutSettings(ctx context.Context, index string, settings map[string]interface{}) error {
+	_, err := b.client.IndexPutSettings(index).BodyJson(settings).Do(ctx)
+	return err
+}
+
+func (b *Elastic) CloseIndex(ctx context.Context, index string) error {
+	_, err := b.client.CloseIndex(index).Do(ctx)
+	return err
+}
+
+func (b *Elastic) OpenIndex(ctx context.Context, index string) error {
+	_, err := b.client.OpenIndex(index).Do(ctx)
+	return err
+}
+
+func (b *Elastic) Refresh(ctx context.Context, index ...string) error {
+	_, err := b.client.Refresh(index...).Do(ctx)
+	return err
+}
+
+func (b *Elastic) Count(ctx context.Context, index string) (int64, error) {
+	return b.client.Count(index).Do(ctx)
+}
+
+func (b *Elastic) AliasIndices(ctx context.Context, alias string) ([]string, error) {
+	res, err := b.client.Aliases().Alias(alias).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	indices := res.IndicesByAlias(alias)
+	sort.Strings(indices)
+	return indices, nil
+}
+
+//GET /{expr}/_alias 返回的key就是展开之后的索引
+func (b *Elastic) ResolveIndices(ctx context.Context, expr string) ([]string, error) {
+	var res map[string]json.RawMessage
+	err := b.perform(ctx, http.MethodGet, "/"+expr+"/_alias", url.Values{"ignore_unavailable": {"true"}}, nil, &res)
+	if elastic.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	indices := make([]string, 0, len(res))
+	for name := range res {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+//所有action在一个请求里执行, es保证原子性
+func (b *Elastic) UpdateAliases(ctx context.Context, actions ...elastic.AliasAction) error {
+	_, err := b.client.Alias().Action(actions...).Do(ctx)
+	return err
+}
+
+func (b *Elastic) Reindex(ctx context.Context, source, dest string) (*elastic.BulkIndexByScrollResponse, error) {
+	return b.client.Reindex().SourceIndex(source).DestinationIndex(dest).Refresh("true").Do(ctx)
+}
+
+func (b *Elastic) Index(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.IndexResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	method, path := http.MethodPut, docPath(index, o.typ, id)
+	if id == "" {
+		method, path = http.MethodPost, docPath(index, o.typ, "")
+	}
+	res := new(elastic.IndexResponse)
+	return res, b.perform(ctx, method, path, o.params(), doc, res)
+}
+
+func (b *Elastic) Create(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.IndexResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	params := o.params()
+	params.Set("op_type", "create")
+	res := new(elastic.IndexResponse)
+	return res, b.perform(ctx, http.MethodPut, docPath(index, o.typ, id), params, doc, res)
+}
+
+func (b *Elastic) Get(ctx context.Context, index, id string, opts ...DocOption) (*elastic.GetResult, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	service := b.client.Get().Index(index).Type(o.typ).Id(id)
+	if o.routing != "" {
+		service.Routing(o.routing)
+	}
+	if o.version != nil {
+		service.Version(*o.version).VersionType(o.versionType)
+	}
+	return service.Do(ctx)
+}
+
+func (b *Elastic) Update(ctx context.Context, index, id string, doc interface{}, opts ...DocOption) (*elastic.UpdateResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	res := new(elastic.UpdateResponse)
+	return res, b.perform(ctx, http.MethodPost, docPath(index, o.typ, id, "_update"), o.params(), map[string]interface{}{"doc": doc}, res)
+}
+
+func (b *Elastic) Delete(ctx context.Context, index, id string, opts ...DocOption) (*elastic.DeleteResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	res := new(elastic.DeleteResponse)
+	return res, b.perform(ctx, http.MethodDelete, docPath(index, o.typ, id), o.params(), nil, res)
+}
+
+//olivere/elastic v6.2 的单文档写接口不支持 if_seq_no, 自己拼请求
+func (b *Elastic) perform(ctx context.Context, method, path string, params url.Values, body interface{}, v interface{}) error {
+	res, err := b.client.PerformRequest(ctx, elastic.PerformRequestOptions{Method: method, Path: path, Params: params, Body: body})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(res.Body, v)
+}
+
+//索引, type 和 id 都要转义, id 可以是 _update/../x 这样的任意字符串; endpoint 是代码里写死的 _update 这类名字
+func docPath(index, typ, id string, endpoint ...string) string {
+	parts := []string{url.PathEscape(index), url.PathEscape(typ)}
+	if id != "" {
+		parts = append(parts, url.PathEscape(id))
+	}
+	return "/" + strings.Join(append(parts, endpoint...), "/")
+}
+
+func (b *Elastic) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	return b.client.Bulk().Add(requests...).Do(ctx)
+}
+
+func (b *Elastic) Search(ctx context.Context, index string, source interface{}) (*elastic.SearchResult, error) {
+	service := b.client.Search(index)
+	if ss, ok := source.(*elastic.SearchSource); ok {
+		service.SearchSource(ss)
+	} else if source != nil {
+		service.Source(source)
+	}
+	return service.Do(ctx)
+}
+
+func (b *Elastic) Scroll(ctx context.Context, index string, source *elastic.SearchSource, keepAlive string, fn func(*elastic.SearchResult) error) error {
+	scroll := b.client.Scroll(index).SearchSource(source).KeepAlive(keepAlive)
+	//请求被取消时也要清理, 所以不用ctx
+	defer scroll.Clear(context.Background())
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Elastic) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script, opts ...DocOption) (*elastic.BulkIndexByScrollResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	service := b.client.UpdateByQuery(index).Query(query)
+	if script != nil {
+		service.Script(script)
+	}
+	if o.refresh != "" {
+		service.Refresh(o.refresh)
+	}
+	if o.routing != "" {
+		service.Routing(o.routing)
+	}
+	if o.conflicts != "" {
+		service.Conflicts(o.conflicts)
+	}
+	return service.Do(ctx)
+}
+
+func (b *Elastic) DeleteByQuery(ctx context.Context, index string, query elastic.Query, opts ...DocOption) (*elastic.BulkIndexByScrollResponse, error) {
+	o := newDocOptions(b.cfg.DocType, opts)
+	service := b.client.DeleteByQuery(index).Query(query)
+	if o.refresh != "" {
+		service.Refresh(o.refresh)
+	}
+	if o.routing != "" {
+		service.Routing(o.routing)
+	}
+	if o.conflicts != "" {
+		service.Conflicts(o.conflicts)
+	}
+	return service.Do(ctx)
+}
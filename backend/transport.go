@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//按 https 的配置创建连接池, 其他参数和 http.DefaultTransport 一样
+func NewTransport(cfg Config) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := tlsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+func tlsConfig(cfg Config) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend: no certificate found in %s", cfg.CAFile)
+		}
+	}
+	//双向认证
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+//olivere/elastic v6 没有 api key 的选项, 只在连接失败时重试, 这两项在 http 层做
+func wrapTransport(cfg Config, rt http.RoundTripper) http.RoundTripper {
+	if cfg.MaxRetries > 0 && len(cfg.RetryOnStatus) > 0 {
+		statuses := make(map[int]bool, len(cfg.RetryOnStatus))
+		for _, code := range cfg.RetryOnStatus {
+			statuses[code] = true
+		}
+		rt = &retryTransport{next: rt, statuses: statuses, cfg: cfg}
+	}
+	if cfg.APIKey != "" {
+		rt = &apiKeyTransport{next: rt, key: encodeAPIKey(cfg.APIKey)}
+	}
+	return rt
+}
+
+//es 要求 base64(id:api_key), 配置里两种写法都可以
+func encodeAPIKey(key string) string {
+	if strings.Contains(key, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
+
+type apiKeyTransport struct {
+	next http.RoundTripper
+	key  string
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "ApiKey "+t.key)
+	return t.next.RoundTrip(req)
+}
+
+type retryTransport struct {
+	next     http.RoundTripper
+	statuses map[int]bool
+	cfg      Config
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//请求体要发多次, 先读出来
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	for retry := 0; ; retry++ {
+		attempt := req.Clone(req.Context())
+		if body != nil {
+			attempt.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		res, err := t.next.RoundTrip(attempt)
+		if err != nil || !t.retryable(req.Method, res.StatusCode) || retry >= t.cfg.MaxRetries {
+			return res, err
+		}
+		wait := t.cfg.backoff(retry + 1)
+		//429 时按 es 给的 Retry-After 等待, 也不超过 RetryMaxBackoff
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && time.Duration(seconds)*time.Second > wait {
+			wait = time.Duration(seconds) * time.Second
+			if max := t.cfg.maxBackoff(); wait > max {
+				wait = max
+			}
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+//429 是 es 拒绝执行, 任何请求都可以重发; 502/503 这些可能已经执行过, 只重试幂等的请求,
+//POST 的 _bulk, _update 和不带 id 的写入重发会重复写
+func (t *retryTransport) retryable(method string, status int) bool {
+	if !t.statuses[status] {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return status == http.StatusTooManyRequests
+}
+
+//第 retry 次重试前的等待时间, 从 RetryBackoff 开始翻倍, 不超过 RetryMaxBackoff
+func (cfg Config) backoff(retry int) time.Duration {
+	wait, max := cfg.RetryBackoff, cfg.maxBackoff()
+	if wait <= 0 {
+		wait = 100 * time.Millisecond
+	}
+	for i := 1; i < retry && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (cfg Config) maxBackoff() time.Duration {
+	if cfg.RetryMaxBackoff <= 0 {
+		return 5 * time.Second
+	}
+	return cfg.RetryMaxBackoff
+}
+
+//连接失败(包括所有节点都不可用)时的重试, 由 elastic 调用
+func (cfg Config) retrier() elastic.Retrier {
+	return elastic.RetrierFunc(func(ctx context.Context, retry int, req *http.Request, res *http.Response, err error) (time.Duration, bool, error) {
+		if retry > cfg.MaxRetries {
+			return 0, false, nil
+		}
+		return cfg.backoff(retry), true, nil
+	})
+}
@@ -0,0 +1,241 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edusoho_search/estest"
+)
+
+//es 前面加一层检查认证信息的 https 代理
+func secureServer(es *estest.Server, authorization string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		es.Config.Handler.ServeHTTP(w, r)
+	}))
+}
+
+//测试服务的自签名证书写到临时文件里当 CA
+func writeCA(t *testing.T, servers ...*httptest.Server) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ca*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, s := range servers {
+		if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f.Name()
+}
+
+func TestTLSBasicAuth(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("elastic:changeme"))
+	node1, node2 := secureServer(es, auth), secureServer(es, auth)
+	defer node1.Close()
+	defer node2.Close()
+	ca := writeCA(t, node1, node2)
+	defer os.Remove(ca)
+
+	ctx := context.Background()
+	b, err := New(Config{Addresses: []string{node1.URL, node2.URL}, Username: "elastic", Password: "changeme", CAFile: ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Index(ctx, "course", "1", map[string]string{"title": "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, "course", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	//不信任服务端证书时连不上
+	b, err = New(Config{Addresses: []string{node1.URL}, Username: "elastic", Password: "changeme", DisableHealthcheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Ping(ctx); err == nil {
+		t.Error("expected certificate error without ca_file")
+	}
+	b, err = New(Config{Addresses: []string{node1.URL}, Username: "elastic", Password: "wrong", CAFile: ca, DisableHealthcheck: true})
+	if err == nil {
+		_, err = b.Get(ctx, "course", "1")
+	}
+	if err == nil {
+		t.Error("expected 401 with a wrong password")
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	key := base64.StdEncoding.EncodeToString([]byte("id:secret"))
+	node := secureServer(es, "ApiKey "+key)
+	defer node.Close()
+
+	ctx := context.Background()
+	//两种写法都可以
+	for _, apiKey := range []string{"id:secret", key} {
+		b, err := New(Config{Addresses: []string{node.URL}, APIKey: apiKey, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Ping(ctx); err != nil {
+			t.Errorf("api key %q: %v", apiKey, err)
+		}
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	var failures int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//节点忙, 写入前几次返回 429
+		if r.Method == http.MethodPut && atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		es.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer node.Close()
+
+	cfg := Config{Addresses: []string{node.URL}, RetryOnStatus: []int{429}, MaxRetries: 2, RetryBackoff: time.Millisecond}
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	atomic.StoreInt32(&failures, 2)
+	if _, err := b.Index(ctx, "course", "1", map[string]string{"title": "go"}); err != nil {
+		t.Fatalf("index after 2 retries: %v", err)
+	}
+	//重试时请求体要重新发送
+	res, err := b.Get(ctx, "course", "1")
+	if err != nil || string(*res.Source) != `{"title":"go"}` {
+		t.Errorf("get = %v, %v", res, err)
+	}
+
+	atomic.StoreInt32(&failures, 3)
+	if _, err := b.Index(ctx, "course", "2", map[string]string{"title": "go"}); err == nil {
+		t.Error("expected 429 after max retries")
+	}
+}
+
+//503 时 POST 可能已经执行过, 不重发; Retry-After 不超过 RetryMaxBackoff
+func TestRetryIdempotent(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	var requests, failures int32
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			atomic.AddInt32(&requests, 1)
+		}
+		if r.Method != http.MethodHead && atomic.AddInt32(&failures, -1) >= 0 {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		es.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer node.Close()
+
+	cfg := Config{Addresses: []string{node.URL}, RetryOnStatus: []int{503}, MaxRetries: 2, RetryBackoff: time.Millisecond, RetryMaxBackoff: 10 * time.Millisecond}
+	b, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Now()
+	atomic.StoreInt32(&failures, 1)
+	if _, err := b.Index(ctx, "course", "1", map[string]string{"title": "go"}); err != nil {
+		t.Fatalf("put after retry: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry waited %s, want at most retry_max_backoff", elapsed)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, 1)
+	if _, err := b.Update(ctx, "course", "1", map[string]string{"title": "es"}); err == nil {
+		t.Error("expected 503 for a POST without retries")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("update sent %d times, want 1", n)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := Config{RetryBackoff: 100 * time.Millisecond, RetryMaxBackoff: time.Second}
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := cfg.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+//第一个节点挂了时 ping 发给其他可用的节点, /readyz 和启动检查不会误报
+func TestPingFirstNodeDown(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	b, err := New(Config{Addresses: []string{down.URL, es.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if info, err := b.Ping(context.Background()); err != nil || info.Version.Number == "" {
+			t.Fatalf("ping %d = %+v, %v", i, info, err)
+		}
+	}
+}
+
+//id 里的 / 和 _ 开头的段都要转义, 不能变成别的接口
+func TestDocPathEscapesId(t *testing.T) {
+	es := estest.NewServer()
+	defer es.Close()
+	var paths []string
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		es.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer node.Close()
+	b, err := New(Config{Addresses: []string{node.URL}, DisableHealthcheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id := "_update/../x"
+	if _, err := b.Index(ctx, "course", id, map[string]string{"title": "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Update(ctx, "course", id, map[string]string{"title": "es"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := b.Get(ctx, "course", id)
+	if err != nil || res.Id != id || string(*res.Source) != `{"title":"es"}` {
+		t.Errorf("get = %+v, %v", res, err)
+	}
+	want := []string{"/course/doc/_update%2F..%2Fx", "/course/doc/_update%2F..%2Fx/_update"}
+	if len(paths) < 2 || paths[0] != want[0] || paths[1] != want[1] {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net/http"
+
+	"edusoho_search/bulk"
+
+	"github.com/gin-gonic/gin"
+)
+
+//后台批量写入, _bulk 接口和课程导入共用, main 里启动, 退出时提交完排队的条目
+var bulkProcessor *bulk.Processor
+
+func bulkConfig() bulk.Config {
+	cfg := appConfig()
+	return bulk.Config{
+		DocType:       cfg.ES.DocType,
+		MaxActions:    cfg.Bulk.Actions,
+		MaxBytes:      cfg.Bulk.Bytes,
+		MaxRetries:    cfg.Bulk.MaxRetries,
+		Backoff:       cfg.ES.RetryBackoff,
+		MaxBackoff:    cfg.ES.RetryMaxBackoff,
+		Timeout:       cfg.Server.RequestTimeout,
+		Workers:       cfg.Bulk.Workers,
+		FlushInterval: cfg.Bulk.FlushInterval,
+		QueueSize:     cfg.Bulk.QueueSize,
+	}
+}
+
+func setupBulk() {
+	bulkProcessor = bulk.NewProcessor(repo, bulkConfig())
+}
+
+//提交完排队的条目, 超时后没写完的条目算失败
+func closeBulk(ctx context.Context) {
+	if err := bulkProcessor.Close(ctx); err != nil {
+		log.Printf("bulk: close: %v", err)
+	}
+	stats := bulkProcessor.Stats()
+	log.Printf("bulk: %d actions succeeded, %d failed", stats.Succeeded, stats.Failed)
+}
+
+//POST /api/v1/_bulk, 请求体是 es 的 bulk 格式(NDJSON), 或者以 [ 开头的json数组:
+//[{"action": "index", "_index": "course", "_id": "1", "doc": {...}}, ...]
+//每一条都必须带 _id, 返回每一条的结果, 顺序和请求一致; 有条目失败时仍然返回 200, errors 为 true
+func bulkDocuments(c *gin.Context) {
+	cfg := appConfig().Bulk
+	body := bufio.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxBodyBytes))
+	var r bulk.Reader
+	if isJSONArray(body) {
+		r = bulk.NewArrayReader(body)
+	} else {
+		r = bulk.NewNDJSONReader(body, cfg.Bytes)
+	}
+	//每一批有自己的超时, 队列满时等到客户端断开为止
+	res, err := bulk.Run(c.Request.Context(), bulkProcessor, r)
+	if err != nil {
+		if e, ok := err.(*bulk.PartialError); ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errBadRequest(e.Err), "items": e.Response.Items})
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//GET /api/v1/admin/bulk, 排队, 正在写和已经写完的条目数
+func bulkStats(c *gin.Context) {
+	c.JSON(http.StatusOK, bulkProcessor.Stats())
+}
+
+//跳过开头的空白, 看第一个字符是不是 [
+func isJSONArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		r.UnreadByte()
+		return b == '['
+	}
+}
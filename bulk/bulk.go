@@ -0,0 +1,201 @@
+package bulk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
+)
+
+type Config struct {
+	DocType string
+	//攒够多少条或者多少字节发一次 bulk
+	MaxActions int
+	MaxBytes   int
+	//NDJSON 一行最长多少字节
+	MaxLine int
+	//条目返回 429 时按指数退避重试; 整个请求的 429 由 backend 的传输层重试
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	//单次 bulk 请求的超时, 0 表示不限制
+	Timeout time.Duration
+	//同时发出的 bulk 请求数
+	Workers int
+	//没攒够一批时最多等多久
+	FlushInterval time.Duration
+	//最多排队多少条, 满了以后 Add 阻塞
+	QueueSize int
+}
+
+func (c *Config) setDefaults() {
+	if c.DocType == "" {
+		c.DocType = backend.DefaultType
+	}
+	if c.MaxActions <= 0 {
+		c.MaxActions = 500
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 5 << 20
+	}
+	if c.MaxLine <= 0 {
+		c.MaxLine = c.MaxBytes
+	}
+	if c.MaxRetries < 0 {
+		c.MaxRetries = 0
+	}
+	if c.Backoff <= 0 {
+		c.Backoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff < c.Backoff {
+		c.MaxBackoff = 5 * time.Second
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = c.MaxActions * c.Workers
+	}
+}
+
+//第 retry 次重试前等待的时间, 从 Backoff 开始翻倍, 不超过 MaxBackoff
+func (c *Config) backoff(retry int) time.Duration {
+	d := c.Backoff
+	for i := 0; i < retry && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+//一条操作的结果, 顺序和请求里一致; 调用方只需要重新提交 Status 不是 2xx 的条目
+type Result struct {
+	Op          string `json:"op"`
+	Index       string `json:"_index,omitempty"`
+	Id          string `json:"_id,omitempty"`
+	Status      int    `json:"status"`
+	Result      string `json:"result,omitempty"`
+	Version     int64  `json:"_version,omitempty"`
+	SeqNo       *int64 `json:"_seq_no,omitempty"`
+	PrimaryTerm *int64 `json:"_primary_term,omitempty"`
+	Error       *Error `json:"error,omitempty"`
+	//429 后重试了几次
+	Retries int `json:"retries,omitempty"`
+}
+
+func (r *Result) Succeeded() bool {
+	return r.Status >= 200 && r.Status < 300
+}
+
+type Error struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+type Response struct {
+	Took      int64     `json:"took"`
+	Errors    bool      `json:"errors"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	Items     []*Result `json:"items"`
+}
+
+//请求体格式错误时, 前面已经写入的条目的结果也会返回
+type PartialError struct {
+	Err      *SyntaxError
+	Response *Response
+}
+
+func (e *PartialError) Error() string {
+	return e.Err.Error()
+}
+
+//从 r 读取所有操作放进 p 的队列, 等到每一条都有结果
+//格式不对的条目(缺少 _id, 索引名不合法等)不发给 es, 结果里是 400
+//请求体格式错误时停止读取, 返回 *PartialError, 前面的条目照常写入
+func Run(ctx context.Context, p *Processor, r Reader) (*Response, error) {
+	start := time.Now()
+	group := p.NewGroup()
+	results := make([]*Result, 0)
+	var syntaxErr *SyntaxError
+	var err error
+	for {
+		var it *Item
+		it, err = r.Next()
+		if err != nil {
+			break
+		}
+		result := &Result{Op: it.Op, Index: it.Index(), Id: it.Id()}
+		results = append(results, result)
+		if err := it.validate(); err != nil {
+			fail(result, http.StatusBadRequest, "illegal_argument_exception", err.Error())
+			continue
+		}
+		req, err := newRequest(it, p.cfg.DocType)
+		if err != nil {
+			fail(result, http.StatusBadRequest, "illegal_argument_exception", err.Error())
+			continue
+		}
+		pending := &pendingItem{req: req, size: len(req.action) + len(it.Source) + 2, result: result}
+		if err := group.add(ctx, pending); err != nil {
+			fail(result, http.StatusServiceUnavailable, "bulk_rejected", err.Error())
+		}
+	}
+	group.Wait()
+	if e, ok := err.(*SyntaxError); ok {
+		syntaxErr = e
+	} else if err != io.EOF {
+		return nil, err
+	}
+	res := &Response{Took: int64(time.Since(start) / time.Millisecond), Items: results}
+	for _, r := range res.Items {
+		if r.Succeeded() {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+	res.Errors = res.Failed > 0
+	if syntaxErr != nil {
+		return nil, &PartialError{Err: syntaxErr, Response: res}
+	}
+	return res, nil
+}
+
+func setResult(result *Result, r *elastic.BulkResponseItem) {
+	result.Status, result.Result, result.Version = r.Status, r.Result, r.Version
+	if r.Index != "" {
+		result.Index = r.Index
+	}
+	if r.Error != nil {
+		result.Error = &Error{Type: r.Error.Type, Reason: r.Error.Reason}
+		return
+	}
+	seqNo, primaryTerm := r.SeqNo, r.PrimaryTerm
+	result.SeqNo, result.PrimaryTerm = &seqNo, &primaryTerm
+}
+
+func fail(result *Result, status int, typ, reason string) {
+	result.Status = status
+	result.Error = &Error{Type: typ, Reason: reason}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,375 @@
+package bulk
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//记录每次bulk的条数
+type countingBackend struct {
+	backend.SearchBackend
+	sizes []int
+}
+
+func (b *countingBackend) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	b.sizes = append(b.sizes, len(requests))
+	return b.SearchBackend.Bulk(ctx, requests...)
+}
+
+func newBackend(t *testing.T) (*countingBackend, *estest.Server) {
+	server := estest.NewServer()
+	b, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingBackend{SearchBackend: b}, server
+}
+
+//用单独的 processor 执行 Run, 间隔足够长, 只按条数和字节数分批
+func run(t *testing.T, repo backend.SearchBackend, r Reader, cfg Config) (*Response, error) {
+	t.Helper()
+	cfg.FlushInterval = time.Hour
+	p := NewProcessor(repo, cfg)
+	defer p.Close(context.Background())
+	return Run(context.Background(), p, r)
+}
+
+func readAll(t *testing.T, r Reader) ([]*Item, error) {
+	t.Helper()
+	items := make([]*Item, 0)
+	for {
+		it, err := r.Next()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return items, err
+		}
+		items = append(items, it)
+	}
+}
+
+func TestReaders(t *testing.T) {
+	ndjson := `{"index": {"_index": "course", "_id": "1"}}
+{"title": "申论"}
+
+{"delete": {"_index": "course", "_id": 2}}
+{"update": {"_index": "course", "_id": "3", "routing": "r1"}}
+{"doc": {"title": "面试"}}
+`
+	array := `[
+		{"action": "index", "_index": "course", "_id": "1", "doc": {"title": "申论"}},
+		{"action": "delete", "_index": "course", "_id": 2},
+		{"action": "update", "_index": "course", "_id": "3", "routing": "r1", "doc": {"title": "面试"}}
+	]`
+	for name, r := range map[string]Reader{"ndjson": NewNDJSONReader(strings.NewReader(ndjson), 1024), "array": NewArrayReader(strings.NewReader(array))} {
+		items, err := readAll(t, r)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(items) != 3 {
+			t.Fatalf("%s: %d items", name, len(items))
+		}
+		if items[0].Op != OpIndex || items[0].Id() != "1" || string(items[0].Source) != `{"title":"申论"}` && string(items[0].Source) != `{"title": "申论"}` {
+			t.Errorf("%s: item 0 = %+v", name, items[0])
+		}
+		if items[1].Op != OpDelete || items[1].Id() != "2" || items[1].Source != nil {
+			t.Errorf("%s: item 1 = %+v", name, items[1])
+		}
+		if items[2].Op != OpUpdate || items[2].Meta["routing"] != "r1" || !strings.Contains(string(items[2].Source), `"doc"`) || items[2].Pos != 2 {
+			t.Errorf("%s: item 2 = %+v", name, items[2])
+		}
+	}
+
+	bad := map[string]Reader{
+		"missing source": NewNDJSONReader(strings.NewReader(`{"index": {"_index": "course", "_id": "1"}}`), 1024),
+		"bad action":     NewNDJSONReader(strings.NewReader(`{"index": {}, "delete": {}}`), 1024),
+		"bad source":     NewNDJSONReader(strings.NewReader("{\"index\": {\"_id\": \"1\"}}\n{\"title\": "), 1024),
+		"line too long":  NewNDJSONReader(strings.NewReader(`{"index": {"_index": "`+strings.Repeat("a", 2048)+`"}}`), 1024),
+		"not an array":   NewArrayReader(strings.NewReader(`{"action": "index"}`)),
+		"truncated":      NewArrayReader(strings.NewReader(`[{"action": "delete", "_index": "course", "_id": "1"}, {"action": `)),
+	}
+	for name, r := range bad {
+		if _, err := readAll(t, r); err == nil {
+			t.Errorf("%s: expected error", name)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: err = %T %v", name, err, err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	ctx := context.Background()
+	if _, err := repo.CreateIndex(ctx, "course", ""); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"index": {"_index": "course", "_id": "1"}}
+{"title": "申论"}
+{"index": {"_index": "course"}}
+{"title": "没有id"}
+{"create": {"_index": "course", "_id": "2"}}
+{"title": "面试"}
+{"create": {"_index": "course", "_id": "2"}}
+{"title": "重复"}
+{"update": {"_index": "course", "_id": "1"}}
+{"doc": {"price": 10}}
+{"index": {"_index": "_all", "_id": "3"}}
+{"title": "非法索引"}
+{"index": {"_index": "course", "_id": "4", "version": 5, "version_type": "external"}}
+{"title": "外部版本"}
+{"delete": {"_index": "course", "_id": "9"}}
+`
+	res, err := run(t, repo, NewNDJSONReader(strings.NewReader(body), 1024), Config{MaxActions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{201, 400, 201, 409, 200, 400, 201, 404}
+	if len(res.Items) != len(want) {
+		t.Fatalf("%d items, want %d", len(res.Items), len(want))
+	}
+	for i, r := range res.Items {
+		if r.Status != want[i] {
+			t.Errorf("item %d: status = %d, want %d, error = %+v", i, r.Status, want[i], r.Error)
+		}
+	}
+	if res.Items[0].Id != "1" || res.Items[0].SeqNo == nil || res.Items[6].Version != 5 {
+		t.Errorf("results = %+v, %+v", res.Items[0], res.Items[6])
+	}
+	if !res.Errors || res.Succeeded != 4 || res.Failed != 4 {
+		t.Errorf("errors = %v, succeeded = %d, failed = %d", res.Errors, res.Succeeded, res.Failed)
+	}
+	//格式不对的条目不发给es, 其余的每批最多2条
+	if len(repo.sizes) != 3 || repo.sizes[0] != 2 || repo.sizes[2] != 2 {
+		t.Errorf("bulk sizes = %v", repo.sizes)
+	}
+}
+
+func TestRunMaxBytes(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	var body strings.Builder
+	for i := 0; i < 5; i++ {
+		body.WriteString(`{"index": {"_index": "course", "_id": "` + string(rune('a'+i)) + `"}}` + "\n")
+		body.WriteString(`{"title": "` + strings.Repeat("x", 100) + `"}` + "\n")
+	}
+	res, err := run(t, repo, NewNDJSONReader(strings.NewReader(body.String()), 1024), Config{MaxBytes: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed != 0 || len(repo.sizes) != 3 {
+		t.Errorf("failed = %d, bulk sizes = %v", res.Failed, repo.sizes)
+	}
+}
+
+func TestRetryRejected(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	body := `[
+		{"action": "index", "_index": "course", "_id": "1", "doc": {"title": "申论"}},
+		{"action": "index", "_index": "course", "_id": "2", "doc": {"title": "面试"}},
+		{"action": "index", "_index": "course", "_id": "3", "doc": {"title": "遴选"}}
+	]`
+	cfg := Config{MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	//前两条被拒绝, 重试一次后成功
+	server.RejectBulkItems(2)
+	res, err := run(t, repo, NewArrayReader(strings.NewReader(body)), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed != 0 || res.Items[0].Retries != 1 || res.Items[1].Retries != 1 || res.Items[2].Retries != 0 {
+		t.Errorf("results = %+v %+v %+v", res.Items[0], res.Items[1], res.Items[2])
+	}
+	if len(repo.sizes) != 2 || repo.sizes[1] != 2 {
+		t.Errorf("bulk sizes = %v", repo.sizes)
+	}
+
+	//重试次数用完后返回 429, 调用方自己重试
+	repo.sizes = nil
+	server.RejectBulkItems(100)
+	res, err = run(t, repo, NewArrayReader(strings.NewReader(body)), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed != 3 || res.Items[0].Status != 429 || res.Items[0].Retries != 2 || len(repo.sizes) != 3 {
+		t.Errorf("result = %+v, bulk sizes = %v", res.Items[0], repo.sizes)
+	}
+}
+
+func TestPartialError(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	body := "{\"delete\": {\"_index\": \"course\", \"_id\": \"1\"}}\n{\"index\": {\"_index\": \"course\", \"_id\": \"2\"}}\n"
+	_, err := run(t, repo, NewNDJSONReader(strings.NewReader(body), 1024), Config{})
+	e, ok := err.(*PartialError)
+	if !ok {
+		t.Fatalf("err = %v", err)
+	}
+	//语法错误之前的条目已经写入
+	if e.Err.Pos != 1 || len(e.Response.Items) != 1 || e.Response.Items[0].Status != 404 {
+		t.Errorf("err = %v, items = %+v", e, e.Response.Items)
+	}
+}
+
+func indexRequest(id string) elastic.BulkableRequest {
+	return elastic.NewBulkIndexRequest().Index("course").Type("doc").Id(id).Doc(map[string]interface{}{"title": id})
+}
+
+func TestProcessor(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	p := NewProcessor(repo, Config{MaxActions: 2, FlushInterval: 10 * time.Millisecond})
+	//没攒够一批时按间隔提交
+	done := make(chan *Result, 1)
+	if err := p.Add(context.Background(), indexRequest("1"), func(r *Result) { done <- r }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-done:
+		if r.Status != 201 || r.Op != "index" || r.Index != "course" || r.Id != "1" {
+			t.Errorf("result = %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not flushed after the interval")
+	}
+
+	group := p.NewGroup()
+	var statuses []int
+	for _, id := range []string{"2", "3", "4"} {
+		if err := group.Add(context.Background(), indexRequest(id), func(r *Result) { statuses = append(statuses, r.Status) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group.Wait()
+	if len(statuses) != 3 {
+		t.Errorf("statuses = %v", statuses)
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Succeeded != 4 || stats.Queued != 0 || stats.InFlight != 0 || stats.Batches != 3 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if err := p.Add(context.Background(), indexRequest("5"), nil); err != ErrClosed {
+		t.Errorf("add after close: err = %v", err)
+	}
+}
+
+//bulk 一直等到 release 或者 ctx 取消
+type blockingBackend struct {
+	backend.SearchBackend
+	release chan struct{}
+}
+
+func (b *blockingBackend) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	select {
+	case <-b.release:
+		return b.SearchBackend.Bulk(ctx, requests...)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestProcessorBackpressure(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	blocking := &blockingBackend{SearchBackend: repo, release: make(chan struct{})}
+	p := NewProcessor(blocking, Config{MaxActions: 1, QueueSize: 1, FlushInterval: time.Hour})
+	//第一条在写, 第二条等 worker, 第三条在队列里, 第四条放不进去
+	for _, id := range []string{"1", "2", "3"} {
+		if err := p.Add(context.Background(), indexRequest(id), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Add(ctx, indexRequest("4"), nil); err != context.DeadlineExceeded {
+		t.Errorf("add to a full queue: err = %v", err)
+	}
+	//交给 worker 之前就算在写
+	if stats := p.Stats(); stats.InFlight != 2 || stats.Queued != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	close(blocking.release)
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := p.Stats(); stats.Succeeded != 3 || stats.Queued != 0 || stats.InFlight != 0 {
+		t.Errorf("stats after flush = %+v", stats)
+	}
+	p.Close(context.Background())
+}
+
+func TestProcessorCloseTimeout(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	blocking := &blockingBackend{SearchBackend: repo, release: make(chan struct{})}
+	p := NewProcessor(blocking, Config{FlushInterval: time.Hour})
+	var results []*Result
+	for _, id := range []string{"1", "2"} {
+		if err := p.Add(context.Background(), indexRequest(id), func(r *Result) { results = append(results, r) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//关闭时提交排队的条目, 超时后取消
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("close: err = %v", err)
+	}
+	if len(results) != 2 || results[0].Status != 504 || results[1].Status != 504 {
+		t.Errorf("results = %+v", results)
+	}
+	if stats := p.Stats(); stats.Failed != 2 || stats.InFlight != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+//Add 在队列满时阻塞, Close 也要在 ctx 到期时返回
+func TestProcessorCloseBlockedAdd(t *testing.T) {
+	repo, server := newBackend(t)
+	defer server.Close()
+	blocking := &blockingBackend{SearchBackend: repo, release: make(chan struct{})}
+	p := NewProcessor(blocking, Config{MaxActions: 1, QueueSize: 1, FlushInterval: time.Hour})
+	for _, id := range []string{"1", "2", "3"} {
+		if err := p.Add(context.Background(), indexRequest(id), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	added := make(chan error, 1)
+	go func() {
+		added <- p.Add(context.Background(), indexRequest("4"), nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- p.Close(ctx)
+	}()
+	select {
+	case err := <-closed:
+		if err != context.DeadlineExceeded {
+			t.Errorf("close: err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close blocked behind a full queue")
+	}
+	//被阻塞的 Add 要么放进去以后失败, 要么在关闭后返回 ErrClosed
+	if err := <-added; err != nil && err != ErrClosed {
+		t.Errorf("blocked add: err = %v", err)
+	}
+	if stats := p.Stats(); stats.Queued != 0 || stats.InFlight != 0 || stats.Succeeded != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
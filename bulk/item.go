@@ -0,0 +1,239 @@
+//bulk 是后台的批量写入: 按条数, 字节数和时间攒批, 多个 worker 并发提交, 429 的条目退避后重试, 返回每一条的结果
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//支持的操作, 和 es 的 bulk 一致
+const (
+	OpIndex  = "index"
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+//一条写操作; Meta 是 es bulk 的 action 行里的参数(_index, _id, routing, version, if_seq_no 等),
+//Source 是 index/create 的文档或者 update 的请求体({"doc": ...}), delete 没有
+type Item struct {
+	Op     string
+	Meta   map[string]interface{}
+	Source json.RawMessage
+	//请求体里的第几条, 从0开始
+	Pos int
+}
+
+func (it *Item) Index() string {
+	s, _ := it.Meta["_index"].(string)
+	return s
+}
+
+func (it *Item) Id() string {
+	switch v := it.Meta["_id"].(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+//id 必须由调用方指定, 重试时不会重复写入
+func (it *Item) validate() error {
+	switch it.Op {
+	case OpIndex, OpCreate, OpUpdate, OpDelete:
+	default:
+		return fmt.Errorf("unknown action %q", it.Op)
+	}
+	index := it.Index()
+	if index == "" || strings.HasPrefix(index, "_") || strings.HasPrefix(index, "-") || strings.ContainsAny(index, "*,") {
+		return fmt.Errorf("invalid _index %q", index)
+	}
+	if it.Id() == "" {
+		return errors.New("_id is required")
+	}
+	if it.Op != OpDelete && len(it.Source) == 0 {
+		return fmt.Errorf("%s requires a document", it.Op)
+	}
+	return nil
+}
+
+//es bulk 的两行, 实现 elastic.BulkableRequest
+type request struct {
+	item   *Item
+	action string
+}
+
+func newRequest(it *Item, docType string) (*request, error) {
+	meta := make(map[string]interface{}, len(it.Meta)+1)
+	for k, v := range it.Meta {
+		meta[k] = v
+	}
+	if _, ok := meta["_type"]; !ok {
+		meta["_type"] = docType
+	}
+	action, err := json.Marshal(map[string]interface{}{it.Op: meta})
+	if err != nil {
+		return nil, err
+	}
+	return &request{item: it, action: string(action)}, nil
+}
+
+func (r *request) Source() ([]string, error) {
+	if r.item.Op == OpDelete {
+		return []string{r.action}, nil
+	}
+	return []string{r.action, string(r.item.Source)}, nil
+}
+
+func (r *request) String() string {
+	lines, _ := r.Source()
+	return strings.Join(lines, "\n")
+}
+
+//请求体的格式错误, 后面的条目都没法解析
+type SyntaxError struct {
+	Pos int
+	Err error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Pos, e.Err)
+}
+
+//逐条读取请求体, 读完时返回 io.EOF
+type Reader interface {
+	Next() (*Item, error)
+}
+
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+//es bulk 格式: 一行 action, index/create/update 再跟一行文档
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	pos     int
+}
+
+func NewNDJSONReader(r io.Reader, maxLine int) Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (r *ndjsonReader) line() ([]byte, error) {
+	for r.scanner.Scan() {
+		if line := bytes.TrimSpace(r.scanner.Bytes()); len(line) > 0 {
+			return line, nil
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (r *ndjsonReader) Next() (*Item, error) {
+	line, err := r.line()
+	if err != nil {
+		if err != io.EOF {
+			err = &SyntaxError{Pos: r.pos, Err: err}
+		}
+		return nil, err
+	}
+	var action map[string]map[string]interface{}
+	if err := decodeJSON(line, &action); err != nil || len(action) != 1 {
+		return nil, &SyntaxError{Pos: r.pos, Err: errors.New("malformed action line, want {\"index\": {...}}")}
+	}
+	it := &Item{Pos: r.pos}
+	for op, meta := range action {
+		it.Op, it.Meta = op, meta
+	}
+	if it.Meta == nil {
+		it.Meta = make(map[string]interface{})
+	}
+	r.pos++
+	if it.Op == OpDelete {
+		return it, nil
+	}
+	source, err := r.line()
+	if err == io.EOF {
+		return nil, &SyntaxError{Pos: it.Pos, Err: fmt.Errorf("%s is missing its document line", it.Op)}
+	} else if err != nil {
+		return nil, &SyntaxError{Pos: it.Pos, Err: err}
+	}
+	if !json.Valid(source) {
+		return nil, &SyntaxError{Pos: it.Pos, Err: errors.New("document is not valid json")}
+	}
+	it.Source = append(json.RawMessage(nil), source...)
+	return it, nil
+}
+
+//json 数组, 每一项的 action 之外的参数和 NDJSON 的 action 行一样, 比如
+//{"action": "index", "_index": "course", "_id": "1", "doc": {...}}
+//update 的 doc 是要修改的字段, 可以带 doc_as_upsert
+type arrayReader struct {
+	decoder *json.Decoder
+	pos     int
+	started bool
+}
+
+func NewArrayReader(r io.Reader) Reader {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	return &arrayReader{decoder: d}
+}
+
+func (r *arrayReader) Next() (*Item, error) {
+	if !r.started {
+		r.started = true
+		if t, err := r.decoder.Token(); err != nil || t != json.Delim('[') {
+			return nil, &SyntaxError{Pos: 0, Err: errors.New("want a json array")}
+		}
+	}
+	if !r.decoder.More() {
+		if _, err := r.decoder.Token(); err != nil {
+			return nil, &SyntaxError{Pos: r.pos, Err: err}
+		}
+		return nil, io.EOF
+	}
+	var fields map[string]interface{}
+	if err := r.decoder.Decode(&fields); err != nil {
+		return nil, &SyntaxError{Pos: r.pos, Err: err}
+	}
+	it := &Item{Pos: r.pos, Meta: make(map[string]interface{})}
+	r.pos++
+	for k, v := range fields {
+		switch k {
+		case "action":
+			it.Op, _ = v.(string)
+		case "doc", "doc_as_upsert":
+		default:
+			it.Meta[k] = v
+		}
+	}
+	if doc, ok := fields["doc"]; ok {
+		if it.Op == OpUpdate {
+			body := map[string]interface{}{"doc": doc}
+			if upsert, _ := fields["doc_as_upsert"].(bool); upsert {
+				body["doc_as_upsert"] = true
+			}
+			doc = body
+		}
+		source, err := json.Marshal(doc)
+		if err != nil {
+			return nil, &SyntaxError{Pos: it.Pos, Err: err}
+		}
+		it.Source = source
+	}
+	return it, nil
+}
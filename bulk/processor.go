@@ -0,0 +1,408 @@
+package bulk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
+)
+
+var ErrClosed = errors.New("bulk: processor is closed")
+
+//写入计数, Queued 包括还没攒够一批的条目
+type Stats struct {
+	Queued    int64 `json:"queued"`
+	InFlight  int64 `json:"in_flight"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	//429 后重新提交的条目次数
+	Retried int64 `json:"retried"`
+	//发出的 bulk 请求数
+	Batches int64 `json:"batches"`
+}
+
+//后台批量写入: 调用方把写操作放进队列, 攒够 MaxActions 条, MaxBytes 字节或者每隔 FlushInterval
+//提交一批, 由 Workers 个 goroutine 并发写入; 队列满时 Add 阻塞, 调用方的速度不会超过 es
+type Processor struct {
+	repo backend.SearchBackend
+	cfg  Config
+
+	queue   chan *pendingItem
+	batches chan []*pendingItem
+	//立即提交已经排队的条目
+	kick chan struct{}
+	//关闭超时后取消还在写的请求
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	//Add 持有读锁放进队列, Close 拿到写锁后不会再有新的条目
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	done    chan struct{}
+
+	statsMu sync.Mutex
+	stats   Stats
+	//等待队列清空的 Flush
+	idle []chan struct{}
+}
+
+type pendingItem struct {
+	req    elastic.BulkableRequest
+	size   int
+	result *Result
+	done   func(*Result)
+}
+
+//启动后台的 goroutine, 用完要调用 Close
+func NewProcessor(repo backend.SearchBackend, cfg Config) *Processor {
+	cfg.setDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Processor{
+		repo:    repo,
+		cfg:     cfg,
+		queue:   make(chan *pendingItem, cfg.QueueSize),
+		batches: make(chan []*pendingItem),
+		kick:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	wg.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range p.batches {
+				p.send(batch)
+			}
+		}()
+	}
+	go p.dispatch()
+	go func() {
+		wg.Wait()
+		cancel()
+		close(p.done)
+	}()
+	return p
+}
+
+//放进队列, 有结果后在写入的 goroutine 里调用 done(可以为nil)
+//队列满时阻塞到有空位或者 ctx 取消; 关闭后返回 ErrClosed
+func (p *Processor) Add(ctx context.Context, req elastic.BulkableRequest, done func(*Result)) error {
+	lines, err := req.Source()
+	if err != nil {
+		return err
+	}
+	it := &pendingItem{req: req, result: describe(lines), done: done}
+	for _, line := range lines {
+		it.size += len(line) + 1
+	}
+	return p.add(ctx, it)
+}
+
+func (p *Processor) add(ctx context.Context, it *pendingItem) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.updateStats(func(s *Stats) { s.Queued++ })
+	select {
+	case p.queue <- it:
+		return nil
+	case <-ctx.Done():
+		p.updateStats(func(s *Stats) { s.Queued-- })
+		return ctx.Err()
+	}
+}
+
+//立即提交已经排队的条目, 等到所有条目(包括等待期间新加入的)都有结果
+func (p *Processor) Flush(ctx context.Context) error {
+	p.statsMu.Lock()
+	if p.stats.Queued+p.stats.InFlight == 0 {
+		p.statsMu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	p.idle = append(p.idle, idle)
+	p.statsMu.Unlock()
+	p.flushNow()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Processor) flushNow() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+//不再接收新的条目, 写完已经排队的条目后返回; ctx 到期时取消还没完成的请求, 这些条目都算失败
+func (p *Processor) Close(ctx context.Context) error {
+	//队列满时 Add 拿着读锁阻塞, 等写锁也不能超过 ctx; 取消请求后队列会清空, 写锁总能拿到
+	closed := make(chan struct{})
+	go func() {
+		p.mu.Lock()
+		if !p.closed {
+			p.closed = true
+			close(p.closing)
+		}
+		p.mu.Unlock()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		select {
+		case <-p.done:
+			return nil
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+	p.cancel()
+	<-p.done
+	return ctx.Err()
+}
+
+//还没启动时都是0
+func (p *Processor) Stats() Stats {
+	if p == nil {
+		return Stats{}
+	}
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.stats
+}
+
+func (p *Processor) updateStats(fn func(*Stats)) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	fn(&p.stats)
+	if p.stats.Queued+p.stats.InFlight == 0 {
+		for _, idle := range p.idle {
+			close(idle)
+		}
+		p.idle = nil
+	}
+}
+
+//按条数, 字节数和时间攒批, 交给空闲的 worker; worker 都在忙时这里阻塞, 队列满后 Add 也阻塞
+func (p *Processor) dispatch() {
+	defer close(p.batches)
+	ticker := time.NewTicker(p.cfg.FlushInterval)
+	defer ticker.Stop()
+	var batch []*pendingItem
+	bytes := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		//先计数再交给 worker, 否则 worker 写完减掉的 InFlight 可能还没加上
+		n := int64(len(batch))
+		p.updateStats(func(s *Stats) {
+			s.Queued -= n
+			s.InFlight += n
+			s.Batches++
+		})
+		p.batches <- batch
+		batch, bytes = nil, 0
+	}
+	add := func(it *pendingItem) {
+		//单条超过 MaxBytes 时单独发一批
+		if len(batch) > 0 && bytes+it.size > p.cfg.MaxBytes {
+			flush()
+		}
+		batch = append(batch, it)
+		bytes += it.size
+		if len(batch) >= p.cfg.MaxActions || bytes >= p.cfg.MaxBytes {
+			flush()
+		}
+	}
+	//先取完队列里已有的条目再提交
+	drain := func() {
+		for {
+			select {
+			case it := <-p.queue:
+				add(it)
+			default:
+				flush()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case it := <-p.queue:
+			add(it)
+		case <-p.kick:
+			drain()
+		case <-ticker.C:
+			flush()
+		case <-p.closing:
+			drain()
+			return
+		}
+	}
+}
+
+func (p *Processor) send(items []*pendingItem) {
+	for retry := 0; len(items) > 0; retry++ {
+		if retry > 0 {
+			if err := sleep(p.ctx, p.cfg.backoff(retry-1)); err != nil {
+				p.failAll(items, err)
+				return
+			}
+		}
+		requests := make([]elastic.BulkableRequest, len(items))
+		for i, it := range items {
+			requests[i] = it.req
+		}
+		res, err := p.bulk(requests)
+		if err != nil {
+			p.failAll(items, err)
+			return
+		}
+		if len(res.Items) != len(items) {
+			p.failAll(items, fmt.Errorf("es returned %d results for %d actions", len(res.Items), len(items)))
+			return
+		}
+		rejected := items[:0:0]
+		for i, it := range items {
+			for _, r := range res.Items[i] {
+				if r.Status == http.StatusTooManyRequests && retry < p.cfg.MaxRetries {
+					it.result.Retries++
+					rejected = append(rejected, it)
+					continue
+				}
+				setResult(it.result, r)
+				p.complete(it)
+			}
+		}
+		if n := int64(len(rejected)); n > 0 {
+			p.updateStats(func(s *Stats) { s.Retried += n })
+		}
+		items = rejected
+	}
+}
+
+func (p *Processor) bulk(requests []elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	ctx := p.ctx
+	if p.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.cfg.Timeout)
+		defer cancel()
+	}
+	return p.repo.Bulk(ctx, requests...)
+}
+
+//先回调再计数, Flush 返回时所有回调都已经执行
+func (p *Processor) complete(it *pendingItem) {
+	if it.done != nil {
+		it.done(it.result)
+	}
+	p.updateStats(func(s *Stats) {
+		s.InFlight--
+		if it.result.Succeeded() {
+			s.Succeeded++
+		} else {
+			s.Failed++
+		}
+	})
+}
+
+//整个 bulk 请求失败, 这一批的条目都算失败, 状态码尽量用 es 返回的
+func (p *Processor) failAll(items []*pendingItem, err error) {
+	status, typ := http.StatusBadGateway, "bulk_request_failed"
+	if e, ok := err.(*elastic.Error); ok {
+		status = e.Status
+		if e.Details != nil {
+			typ = e.Details.Type
+		}
+	} else if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		status, typ = http.StatusGatewayTimeout, "timeout"
+	}
+	for _, it := range items {
+		fail(it.result, status, typ, err.Error())
+		p.complete(it)
+	}
+}
+
+//从 action 行里取出操作, 索引和 id
+func describe(lines []string) *Result {
+	result := &Result{}
+	if len(lines) == 0 {
+		return result
+	}
+	var action map[string]struct {
+		Index string      `json:"_index"`
+		Id    interface{} `json:"_id"`
+	}
+	json.Unmarshal([]byte(lines[0]), &action)
+	for op, meta := range action {
+		result.Op, result.Index = op, meta.Index
+		if meta.Id != nil {
+			result.Id = fmt.Sprint(meta.Id)
+		}
+	}
+	return result
+}
+
+//一组写入, 比如一次导入任务或者一个 _bulk 请求, 只等待自己的条目
+type Group struct {
+	p  *Processor
+	wg sync.WaitGroup
+}
+
+func (p *Processor) NewGroup() *Group {
+	return &Group{p: p}
+}
+
+func (g *Group) Add(ctx context.Context, req elastic.BulkableRequest, done func(*Result)) error {
+	g.wg.Add(1)
+	err := g.p.Add(ctx, req, func(r *Result) {
+		defer g.wg.Done()
+		if done != nil {
+			done(r)
+		}
+	})
+	if err != nil {
+		g.wg.Done()
+	}
+	return err
+}
+
+func (g *Group) add(ctx context.Context, it *pendingItem) error {
+	g.wg.Add(1)
+	done := it.done
+	it.done = func(r *Result) {
+		defer g.wg.Done()
+		if done != nil {
+			done(r)
+		}
+	}
+	err := g.p.add(ctx, it)
+	if err != nil {
+		g.wg.Done()
+	}
+	return err
+}
+
+//立即提交已经排队的条目, 等这一组的条目都有结果
+func (g *Group) Wait() {
+	g.p.flushNow()
+	g.wg.Wait()
+}
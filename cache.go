@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"edusoho_search/cache"
+
+	"github.com/gin-gonic/gin"
+)
+
+//搜索结果缓存, 为 nil 时不缓存
+var searchCache *cache.Cache
+
+func loadCache() error {
+	cfg := appConfig().Cache
+	switch cfg.Backend {
+	case "off":
+		searchCache = nil
+	case "memory":
+		searchCache = cache.New(cache.NewLRU(cfg.Size), cfg.TTL, cfg.Prefix)
+	case "redis":
+		searchCache = cache.New(cache.NewRedis(cache.RedisConfig{
+			Addr:     cfg.RedisAddr,
+			Password: cfg.RedisPassword,
+			DB:       cfg.RedisDB,
+			Prefix:   cfg.Prefix,
+		}), cfg.TTL, cfg.Prefix)
+	default:
+		return fmt.Errorf("unknown cache backend %q", cfg.Backend)
+	}
+	return nil
+}
+
+//写索引的操作都经过 repo, 包一层之后导入, 修改和删除都会让对应索引的缓存失效
+func setupCache() {
+	repo = cache.InvalidateOnWrite(repo, searchCache)
+}
+
+//GET /api/v1/admin/cache, 命中统计
+func cacheStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"enabled": searchCache != nil, "stats": searchCache.Stats()})
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//包一层 backend, 写入索引之后让这个索引的缓存失效; 导入, river同步, 重建索引和各个写接口都经过这里
+type invalidating struct {
+	backend.SearchBackend
+	cache *Cache
+}
+
+//c 之后通过 b 把别名和通配符解析成实际的索引
+func InvalidateOnWrite(b backend.SearchBackend, c *Cache) backend.SearchBackend {
+	if c == nil {
+		return b
+	}
+	c.SetResolver(b.ResolveIndices)
+	return &invalidating{SearchBackend: b, cache: c}
+}
+
+//新建的索引可能匹配已有的通配符
+func (b *invalidating) CreateIndex(ctx context.Context, index string, body interface{}) (*elastic.IndicesCreateResult, error) {
+	defer b.cache.Invalidate(index)
+	defer b.cache.forget()
+	return b.SearchBackend.CreateIndex(ctx, index, body)
+}
+
+//先按删除前的解析结果失效, 再重新解析
+func (b *invalidating) DeleteIndex(ctx context.Context, index ...string) (*elastic.IndicesDeleteResponse, error) {
+	b.cache.Invalidate(index...)
+	defer b.cache.Invalidate(index...)
+	defer b.cache.forget()
+	return b.SearchBackend.DeleteIndex(ctx, index...)
+}
+
+//同义词这类设置会改变搜索结果
+func (b *invalidating) PutSettings(ctx context.Context, index string, settings map[string]interface{}) error {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.PutSettings(ctx, index, settings)
+}
+
+func (b *invalidating) CloseIndex(ctx context.Context, index string) error {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.CloseIndex(ctx, index)
+}
+
+func (b *invalidating) OpenIndex(ctx context.Context, index string) error {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.OpenIndex(ctx, index)
+}
+
+//别名切换后通过别名搜索的结果也变了
+func (b *invalidating) UpdateAliases(ctx context.Context, actions ...elastic.AliasAction) error {
+	defer func() {
+		b.cache.forget()
+		for _, a := range actions {
+			src, err := a.Source()
+			if err != nil {
+				continue
+			}
+			b.cache.Invalidate(actionIndices(src)...)
+		}
+	}()
+	return b.SearchBackend.UpdateAliases(ctx, actions...)
+}
+
+func (b *invalidating) Reindex(ctx context.Context, source, dest string) (*elastic.BulkIndexByScrollResponse, error) {
+	defer b.cache.Invalidate(dest)
+	return b.SearchBackend.Reindex(ctx, source, dest)
+}
+
+func (b *invalidating) Index(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (*elastic.IndexResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.Index(ctx, index, id, doc, opts...)
+}
+
+func (b *invalidating) Create(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (*elastic.IndexResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.Create(ctx, index, id, doc, opts...)
+}
+
+func (b *invalidating) Update(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (*elastic.UpdateResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.Update(ctx, index, id, doc, opts...)
+}
+
+func (b *invalidating) Delete(ctx context.Context, index, id string, opts ...backend.DocOption) (*elastic.DeleteResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.Delete(ctx, index, id, opts...)
+}
+
+func (b *invalidating) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	defer func() {
+		b.cache.Invalidate(bulkIndices(requests)...)
+	}()
+	return b.SearchBackend.Bulk(ctx, requests...)
+}
+
+func (b *invalidating) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script, opts ...backend.DocOption) (*elastic.BulkIndexByScrollResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.UpdateByQuery(ctx, index, query, script, opts...)
+}
+
+func (b *invalidating) DeleteByQuery(ctx context.Context, index string, query elastic.Query, opts ...backend.DocOption) (*elastic.BulkIndexByScrollResponse, error) {
+	defer b.cache.Invalidate(index)
+	return b.SearchBackend.DeleteByQuery(ctx, index, query, opts...)
+}
+
+//bulk 请求第一行 {"index": {"_index": "course", ...}} 里的索引, 去重
+func bulkIndices(requests []elastic.BulkableRequest) []string {
+	seen := make(map[string]bool)
+	indices := make([]string, 0)
+	for _, r := range requests {
+		lines, err := r.Source()
+		if err != nil || len(lines) == 0 {
+			continue
+		}
+		var action map[string]struct {
+			Index string `json:"_index"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &action); err != nil {
+			continue
+		}
+		for _, meta := range action {
+			if meta.Index != "" && !seen[meta.Index] {
+				seen[meta.Index] = true
+				indices = append(indices, meta.Index)
+			}
+		}
+	}
+	return indices
+}
+
+//别名操作 {"add": {"index": "course_v2", "alias": "course"}} 里的索引和别名
+func actionIndices(src interface{}) []string {
+	b, err := json.Marshal(src)
+	if err != nil {
+		return nil
+	}
+	var action map[string]struct {
+		Index   string   `json:"index"`
+		Indices []string `json:"indices"`
+		Alias   string   `json:"alias"`
+		Aliases []string `json:"aliases"`
+	}
+	if err := json.Unmarshal(b, &action); err != nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, a := range action {
+		for _, name := range append(append(a.Indices, a.Aliases...), a.Index, a.Alias) {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,219 @@
+//cache 缓存搜索结果, 存储可以是进程内的LRU或者redis(兼容redis协议的都可以),
+//缓存的key里带着索引的版本号, 写入索引时版本号加一, 旧的缓存就不会再命中;
+//别名和通配符按实际的索引计算版本号, 写入 course_v1 之后通过别名 course 的搜索也会失效
+package cache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//别名解析的结果在进程内保留多久; 本进程切换别名, 建删索引时立即失效,
+//其他进程切换别名后最多这么久还按旧的索引计算版本号
+const resolveTTL = 5 * time.Second
+
+const resolveTimeout = 2 * time.Second
+
+//把别名, 通配符和逗号分隔的多个名字解析成实际的索引
+type Resolver func(ctx context.Context, expr string) ([]string, error)
+
+type resolution struct {
+	indices []string
+	at      time.Time
+}
+
+//缓存的存储
+type Store interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	//索引的版本号, 没有写入过时是0
+	Generation(index string) (int64, error)
+	//写入索引后把版本号加一
+	Bump(index string) error
+}
+
+//命中统计
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Errors        uint64 `json:"errors"` // 存储出错的次数, 出错时当作没有命中
+	Invalidations uint64 `json:"invalidations"`
+}
+
+type Cache struct {
+	store  Store
+	ttl    time.Duration
+	prefix string
+
+	resolve  Resolver
+	mu       sync.Mutex
+	resolved map[string]resolution
+
+	hits, misses, errors, invalidations uint64
+}
+
+func New(store Store, ttl time.Duration, prefix string) *Cache {
+	return &Cache{store: store, ttl: ttl, prefix: prefix}
+}
+
+//没有设置时只按请求里的名字计算版本号
+func (c *Cache) SetResolver(r Resolver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolve = r
+	c.resolved = make(map[string]resolution)
+}
+
+//别名或者索引有变化, 下次重新解析
+func (c *Cache) forget() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resolved != nil {
+		c.resolved = make(map[string]resolution)
+	}
+}
+
+//名字本身加上解析出来的实际索引, 去重排序
+func (c *Cache) concrete(expr string) ([]string, error) {
+	c.mu.Lock()
+	resolve := c.resolve
+	r, ok := c.resolved[expr]
+	c.mu.Unlock()
+	if resolve != nil && (!ok || time.Since(r.at) >= resolveTTL) {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		indices, err := resolve(ctx, expr)
+		if err != nil {
+			return nil, err
+		}
+		r = resolution{indices: indices, at: time.Now()}
+		c.mu.Lock()
+		c.resolved[expr] = r
+		c.mu.Unlock()
+	}
+	names := []string{expr}
+	for _, name := range r.indices {
+		if name != expr {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+//请求序列化成json后取sha1, 结构体字段顺序固定, map 按key排序, 所以相同的请求得到相同的key
+//版本号是名字本身和每个实际索引的版本号, 其中任何一个有写入key都会变
+func (c *Cache) key(index string, req interface{}) (string, error) {
+	names, err := c.concrete(index)
+	if err != nil {
+		return "", err
+	}
+	gens := make([]string, len(names))
+	for i, name := range names {
+		gen, err := c.store.Generation(name)
+		if err != nil {
+			return "", err
+		}
+		gens[i] = fmt.Sprint(gen)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(b)
+	return fmt.Sprintf("%s:%s:%s:%s", c.prefix, index, strings.Join(gens, "."), hex.EncodeToString(sum[:])), nil
+}
+
+//取出缓存的结果解析到 v 里, 没有命中时返回的 key 用来在查询之后 Set,
+//这样查询期间索引有写入时, 结果会存到旧版本的key下面, 不会被读到
+func (c *Cache) Get(index string, req interface{}, v interface{}) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	key, err := c.key(index, req)
+	if err != nil {
+		c.fail(err)
+		return "", false
+	}
+	data, ok, err := c.store.Get(key)
+	if err != nil {
+		c.fail(err)
+		return key, false
+	}
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return key, false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		c.fail(err)
+		return key, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return key, true
+}
+
+func (c *Cache) Set(key string, v interface{}) {
+	if c == nil || key == "" {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		c.fail(err)
+		return
+	}
+	if err := c.store.Set(key, data, c.ttl); err != nil {
+		c.fail(err)
+	}
+}
+
+//索引有写入, 之前缓存的结果都不再使用; 写入别名时别名指向的索引也失效
+func (c *Cache) Invalidate(indices ...string) {
+	if c == nil {
+		return
+	}
+	seen := make(map[string]bool)
+	for _, index := range indices {
+		names, err := c.concrete(index)
+		if err != nil {
+			c.fail(err)
+			names = []string{index}
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			if err := c.store.Bump(name); err != nil {
+				c.fail(err)
+				continue
+			}
+			atomic.AddUint64(&c.invalidations, 1)
+		}
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	return Stats{
+		Hits:          atomic.LoadUint64(&c.hits),
+		Misses:        atomic.LoadUint64(&c.misses),
+		Errors:        atomic.LoadUint64(&c.errors),
+		Invalidations: atomic.LoadUint64(&c.invalidations),
+	}
+}
+
+func (c *Cache) fail(err error) {
+	atomic.AddUint64(&c.errors, 1)
+	log.Printf("cache: %v", err)
+}
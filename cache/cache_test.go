@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+
+	"github.com/olivere/elastic/v6"
+)
+
+type request struct {
+	Index string
+	Key   string
+}
+
+func TestLRUEviction(t *testing.T) {
+	l := NewLRU(2)
+	l.Set("a", []byte("1"), 0)
+	l.Set("b", []byte("2"), 0)
+	//a 最近用过, 淘汰的是 b
+	if _, ok, _ := l.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	l.Set("c", []byte("3"), 0)
+	if _, ok, _ := l.Get("b"); ok {
+		t.Error("b should be evicted")
+	}
+	if v, ok, _ := l.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("a = %q, %v", v, ok)
+	}
+	if l.Len() != 2 {
+		t.Errorf("len = %d", l.Len())
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	l := NewLRU(10)
+	l.Set("a", []byte("1"), 10*time.Millisecond)
+	if _, ok, _ := l.Get("a"); !ok {
+		t.Fatal("a should be cached")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := l.Get("a"); ok {
+		t.Error("a should be expired")
+	}
+	if l.Len() != 0 {
+		t.Errorf("len = %d", l.Len())
+	}
+}
+
+func testCache(t *testing.T, c *Cache) {
+	t.Helper()
+	req := request{"course", "遴选"}
+	var v []string
+	key, ok := c.Get("course", req, &v)
+	if ok {
+		t.Fatal("empty cache should miss")
+	}
+	c.Set(key, []string{"1", "2"})
+	if _, ok := c.Get("course", req, &v); !ok || strings.Join(v, ",") != "1,2" {
+		t.Fatalf("hit = %v, %v", ok, v)
+	}
+	//别的索引写入不影响
+	c.Invalidate("course_all")
+	if _, ok := c.Get("course", req, &v); !ok {
+		t.Fatal("write to another index should not invalidate")
+	}
+	c.Invalidate("course")
+	if _, ok := c.Get("course", req, &v); ok {
+		t.Fatal("write to the index should invalidate")
+	}
+	stats := c.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Invalidations != 2 || stats.Errors != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	testCache(t, New(NewLRU(10), time.Minute, "test"))
+}
+
+//只实现 AUTH, GET, SET, INCR 的假 redis
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, password: password, data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		s.mu.Lock()
+		switch cmd {
+		case "AUTH":
+			if args[1] == s.password {
+				authed = true
+				io.WriteString(conn, "+OK\r\n")
+			} else {
+				io.WriteString(conn, "-ERR invalid password\r\n")
+			}
+		case "GET":
+			if v, ok := s.data[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				io.WriteString(conn, "$-1\r\n")
+			}
+		case "SET":
+			//和 redis 一样不接受 0 和负数的过期时间
+			if len(args) == 5 && (args[4] == "0" || strings.HasPrefix(args[4], "-")) {
+				io.WriteString(conn, "-ERR invalid expire time in 'set' command\r\n")
+				break
+			}
+			s.data[args[1]] = args[2]
+			io.WriteString(conn, "+OK\r\n")
+		case "INCR":
+			n, _ := strconv.ParseInt(s.data[args[1]], 10, 64)
+			s.data[args[1]] = strconv.FormatInt(n+1, 10)
+			fmt.Fprintf(conn, ":%d\r\n", n+1)
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestCacheRedis(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.ln.Close()
+	store := NewRedis(RedisConfig{Addr: server.ln.Addr().String(), Password: "secret", Prefix: "test"})
+	defer store.Close()
+	testCache(t, New(store, time.Minute, "test"))
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.data["test:generation:course"] != "1" {
+		t.Errorf("generations = %v", server.data)
+	}
+}
+
+//不足 1ms 的 ttl 不能发成 PX 0
+func TestRedisShortTTL(t *testing.T) {
+	server := newFakeRedis(t, "")
+	defer server.ln.Close()
+	store := NewRedis(RedisConfig{Addr: server.ln.Addr().String()})
+	defer store.Close()
+	if err := store.Set("k", []byte("v"), 500*time.Microsecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheRedisErrors(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.ln.Close()
+	store := NewRedis(RedisConfig{Addr: server.ln.Addr().String(), Password: "wrong"})
+	c := New(store, time.Minute, "test")
+	//redis 不可用时当作没有缓存
+	var v []string
+	if _, ok := c.Get("course", request{"course", "遴选"}, &v); ok {
+		t.Fatal("should miss")
+	}
+	if c.Stats().Errors != 1 {
+		t.Errorf("stats = %+v", c.Stats())
+	}
+}
+
+func TestNilCache(t *testing.T) {
+	var c *Cache
+	var v []string
+	if key, ok := c.Get("course", request{}, &v); ok || key != "" {
+		t.Error("nil cache should miss")
+	}
+	c.Set("key", v)
+	c.Invalidate("course")
+	if c.Stats() != (Stats{}) {
+		t.Error("nil cache should have no stats")
+	}
+}
+
+func TestInvalidateOnWrite(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	es, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(NewLRU(10), time.Minute, "test")
+	b := InvalidateOnWrite(es, c)
+	ctx := context.Background()
+
+	generation := func(index string) int64 {
+		gen, _ := c.store.Generation(index)
+		return gen
+	}
+	if _, err := b.CreateIndex(ctx, "course_v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Index(ctx, "course_v1", "1", map[string]interface{}{"title": "遴选"}); err != nil {
+		t.Fatal(err)
+	}
+	if generation("course_v1") != 2 {
+		t.Errorf("course_v1 generation = %d", generation("course_v1"))
+	}
+	if err := b.UpdateAliases(ctx, elastic.NewAliasAddAction("course").Index("course_v1")); err != nil {
+		t.Fatal(err)
+	}
+	//别名和索引都失效
+	if generation("course") != 1 || generation("course_v1") != 3 {
+		t.Errorf("generations after alias = %d, %d", generation("course"), generation("course_v1"))
+	}
+	_, err = b.Bulk(ctx,
+		elastic.NewBulkIndexRequest().Index("course_v1").Type("doc").Id("2").Doc(map[string]interface{}{"title": "申论"}),
+		elastic.NewBulkDeleteRequest().Index("course_all").Type("doc").Id("2"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generation("course_v1") != 4 || generation("course_all") != 1 {
+		t.Errorf("generations after bulk = %d, %d", generation("course_v1"), generation("course_all"))
+	}
+	//读操作不会让缓存失效
+	if _, err := b.Search(ctx, "course", elastic.NewSearchSource()); err != nil {
+		t.Fatal(err)
+	}
+	if generation("course") != 1 {
+		t.Errorf("search bumped generation to %d", generation("course"))
+	}
+}
+
+//写入实际的索引时, 通过别名, 通配符和多个索引的搜索都要失效
+func TestInvalidateThroughAlias(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	es, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(NewLRU(10), time.Minute, "test")
+	b := InvalidateOnWrite(es, c)
+	ctx := context.Background()
+	for _, index := range []string{"course_v1", "course_all"} {
+		if _, err := b.CreateIndex(ctx, index, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.UpdateAliases(ctx, elastic.NewAliasAddAction("course").Index("course_v1")); err != nil {
+		t.Fatal(err)
+	}
+	searches := []string{"course", "course*", "course,course_all", "course_v1"}
+	cached := func() {
+		t.Helper()
+		for _, index := range searches {
+			var v []string
+			key, _ := c.Get(index, request{index, "遴选"}, &v)
+			c.Set(key, []string{"1"})
+			if _, ok := c.Get(index, request{index, "遴选"}, &v); !ok {
+				t.Fatalf("%s should hit after set", index)
+			}
+		}
+	}
+	missed := func(write string) {
+		t.Helper()
+		for _, index := range searches {
+			var v []string
+			if _, ok := c.Get(index, request{index, "遴选"}, &v); ok {
+				t.Errorf("write to %s should invalidate %s", write, index)
+			}
+		}
+	}
+
+	cached()
+	if _, err := b.Index(ctx, "course_v1", "1", map[string]interface{}{"title": "遴选"}); err != nil {
+		t.Fatal(err)
+	}
+	missed("course_v1")
+
+	//写入别名时别名指向的索引也失效
+	cached()
+	if _, err := b.Delete(ctx, "course", "1"); err != nil {
+		t.Fatal(err)
+	}
+	missed("course")
+
+	//切换别名后按新的索引计算
+	if _, err := b.CreateIndex(ctx, "course_v2", nil); err != nil {
+		t.Fatal(err)
+	}
+	err = b.UpdateAliases(ctx,
+		elastic.NewAliasRemoveAction("course").Index("course_v1"),
+		elastic.NewAliasAddAction("course").Index("course_v2"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached()
+	_, err = b.Bulk(ctx, elastic.NewBulkIndexRequest().Index("course_v2").Type("doc").Id("2").Doc(map[string]interface{}{"title": "申论"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []string
+	if _, ok := c.Get("course", request{"course", "遴选"}, &v); ok {
+		t.Error("write to course_v2 should invalidate course after the swap")
+	}
+	if _, ok := c.Get("course_v1", request{"course_v1", "遴选"}, &v); !ok {
+		t.Error("write to course_v2 should not invalidate course_v1")
+	}
+}
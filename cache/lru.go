@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//进程内的LRU, 超过容量时淘汰最久没有用过的
+type LRU struct {
+	size int
+
+	mu          sync.Mutex
+	ll          *list.List
+	items       map[string]*list.Element
+	generations map[string]int64
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLRU(size int) *LRU {
+	if size <= 0 {
+		size = 1
+	}
+	return &LRU{size: size, ll: list.New(), items: make(map[string]*list.Element), generations: make(map[string]int64)}
+}
+
+func (l *LRU) Get(key string) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		l.ll.Remove(el)
+		delete(l.items, key)
+		return nil, false, nil
+	}
+	l.ll.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+//ttl 为0时不过期
+func (l *LRU) Set(key string, value []byte, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if el, ok := l.items[key]; ok {
+		el.Value = &lruEntry{key: key, value: value, expires: expires}
+		l.ll.MoveToFront(el)
+		return nil
+	}
+	l.items[key] = l.ll.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for l.ll.Len() > l.size {
+		oldest := l.ll.Back()
+		l.ll.Remove(oldest)
+		delete(l.items, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+func (l *LRU) Generation(index string) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.generations[index], nil
+}
+
+//旧版本的缓存不会再被读到, 由LRU慢慢淘汰
+func (l *LRU) Bump(index string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generations[index]++
+	return nil
+}
+
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ll.Len()
+}
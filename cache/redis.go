@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+//redis 连接配置, 只用到 GET/SET/INCR, 所以兼容redis协议的服务(codis, kvrocks 等)都可以
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	Timeout  time.Duration // 连接和单个命令的超时, 默认 1s
+	PoolSize int           // 空闲连接数, 默认 8
+	Prefix   string        // 版本号的key前缀
+}
+
+//redis 存储, 多个进程共用缓存和索引版本号
+type Redis struct {
+	cfg  RedisConfig
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+var errNil = errors.New("redis: nil")
+
+func NewRedis(cfg RedisConfig) *Redis {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 8
+	}
+	return &Redis{cfg: cfg, pool: make(chan *redisConn, cfg.PoolSize)}
+}
+
+func (r *Redis) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.cfg.Addr, r.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if r.cfg.Password != "" {
+		if _, err := c.do(r.cfg.Timeout, "AUTH", r.cfg.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.cfg.DB != 0 {
+		if _, err := c.do(r.cfg.Timeout, "SELECT", strconv.Itoa(r.cfg.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//从连接池取一个连接执行命令, 网络出错的连接直接关掉
+func (r *Redis) do(args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-r.pool:
+	default:
+		var err error
+		if c, err = r.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(r.cfg.Timeout, args...)
+	if err != nil && err != errNil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	select {
+	case r.pool <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+//redis 返回的 -ERR
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(arg))...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+func (c *redisConn) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+//只解析用到的几种回复: 状态, 错误, 整数, 字符串
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
+
+func (r *Redis) Get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", key)
+	if err == errNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	data, _ := reply.([]byte)
+	return data, true, nil
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		//不足 1ms 向上取整, redis 不接受 PX 0
+		px := (ttl + time.Millisecond - 1) / time.Millisecond
+		args = append(args, "PX", strconv.FormatInt(int64(px), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *Redis) generationKey(index string) string {
+	return r.cfg.Prefix + ":generation:" + index
+}
+
+func (r *Redis) Generation(index string) (int64, error) {
+	data, ok, err := r.Get(r.generationKey(index))
+	if err != nil || !ok {
+		return 0, err
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+func (r *Redis) Bump(index string) error {
+	_, err := r.do("INCR", r.generationKey(index))
+	return err
+}
+
+func (r *Redis) Close() error {
+	for {
+		select {
+		case c := <-r.pool:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
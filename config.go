@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"edusoho_search/config"
+	"edusoho_search/mappings"
+)
+
+//配置信息, SIGHUP 时整个替换, 用 appConfig() 读取
+var currentConfig atomic.Value
+
+func appConfig() *config.Config {
+	return currentConfig.Load().(*config.Config)
+}
+
+//加载配置文件和它引用的同义词, 排序方案, mapping 文件, 任何一项不合法都不能启动
+func setupConfig(path string) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	currentConfig.Store(cfg)
+	fmt.Printf("配置 %s, app_mode=%s, es=%v\n", path, cfg.AppMode, cfg.ES.RedactedHosts())
+
+	if err := loadAnalysis(); err != nil {
+		return err
+	}
+	if err := loadDefaultSorts(); err != nil {
+		return err
+	}
+	if err := loadRanking(); err != nil {
+		return err
+	}
+	if err := loadCache(); err != nil {
+		return err
+	}
+	if err := setupAuth(); err != nil {
+		return err
+	}
+	registry, err = mappings.Load(cfg.MappingDir, analysisConfig())
+	return err
+}
+
+//收到 SIGHUP 时重新读取配置文件
+func watchConfig() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reloadConfig()
+		}
+	}()
+}
+
+//只有标记了 reload 的项(默认排序, 健康检查, 请求超时, 调用方)立即生效, 其他项改了要重启;
+//新配置不合法时继续用原来的
+func reloadConfig() error {
+	cfg, restart, err := config.Reload(appConfig())
+	if err != nil {
+		log.Printf("reload config: %v, keep the current config", err)
+		return err
+	}
+	sorts, err := parseDefaultSorts(cfg.Sort)
+	if err != nil {
+		log.Printf("reload config: %v, keep the current config", err)
+		return err
+	}
+	a, err := loadAuth(cfg)
+	if err != nil {
+		log.Printf("reload config: %v, keep the current config", err)
+		return err
+	}
+	currentConfig.Store(cfg)
+	defaultSorts.Store(sorts)
+	authenticator.Store(a)
+	if len(restart) > 0 {
+		log.Printf("reload config: %v changed, restart to apply", restart)
+	}
+	log.Printf("config %s reloaded", cfg.Path)
+	return nil
+}
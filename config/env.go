@@ -0,0 +1,38 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+//环境变量的前缀, 比如 SEARCH_ES_HOST 覆盖 es 的地址, SEARCH_SERVER_ADDR 覆盖监听地址
+const EnvPrefix = "SEARCH_"
+
+//环境变量名: 前缀 + 段名(或者段的 env 标签) + key, 字段的 env 标签可以换掉 key 的部分
+func envName(group, key string) string {
+	name := EnvPrefix
+	if group != "" {
+		name += group + "_"
+	}
+	return strings.ToUpper(name + key)
+}
+
+//有对应环境变量的项写回 ini 里, 再和文件里的值一起解析和校验
+func applyEnv(section *ini.Section, group string, t reflect.Type, lookupEnv func(string) (string, bool)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.SplitN(field.Tag.Get("ini"), ",", 2)[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := field.Tag.Get("env")
+		if name == "" {
+			name = key
+		}
+		if value, ok := lookupEnv(envName(group, name)); ok {
+			section.Key(key).SetValue(value)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"reflect"
+)
+
+//重新读取配置文件, 只有带 reload 标签的项(超时, 就绪检查, 默认排序, 调用方)在线生效,
+//其他项变了要重启才生效, 返回这些项的名字用来打日志; 新的配置不合法时保留原来的
+func Reload(current *Config) (*Config, []string, error) {
+	fresh, err := Load(current.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged, restart := merge(current, fresh)
+	return merged, restart, nil
+}
+
+func merge(current, fresh *Config) (*Config, []string) {
+	merged := *current
+	restart := make([]string, 0)
+	mergeStruct(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(fresh).Elem(), "", &restart)
+	return &merged, restart
+}
+
+//整段带 reload 标签时整段替换, 否则逐项比较
+func mergeStruct(dst, src reflect.Value, prefix string, restart *[]string) {
+	t := dst.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + fieldName(field)
+		switch {
+		case field.Tag.Get("reload") == "true":
+			dst.Field(i).Set(src.Field(i))
+		case field.Type.Kind() == reflect.Struct:
+			mergeStruct(dst.Field(i), src.Field(i), name+".", restart)
+		case !reflect.DeepEqual(dst.Field(i).Interface(), src.Field(i).Interface()):
+			*restart = append(*restart, name)
+		}
+	}
+}
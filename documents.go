@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"edusoho_search/backend"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+)
+
+//文档接口操作的索引, 不能是 _all 和通配符, 免得一次改到所有索引
+func documentIndex(c *gin.Context) (string, error) {
+	index := c.Param("index")
+	if index == "" || strings.HasPrefix(index, "_") || strings.HasPrefix(index, "-") || strings.ContainsAny(index, "*,") {
+		return "", fmt.Errorf("invalid index %q", index)
+	}
+	return index, nil
+}
+
+//url 参数和 es 的同名: version, version_type, if_seq_no, if_primary_term, refresh, routing
+func documentOptions(c *gin.Context) ([]backend.DocOption, error) {
+	opts := make([]backend.DocOption, 0)
+	if v := c.Query("version"); v != "" {
+		version, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		versionType := c.Query("version_type")
+		switch versionType {
+		case "", "internal", "external", "external_gte":
+		default:
+			return nil, fmt.Errorf("invalid version_type %q", versionType)
+		}
+		opts = append(opts, backend.WithVersion(version, versionType))
+	}
+	seqNo, primaryTerm := c.Query("if_seq_no"), c.Query("if_primary_term")
+	if seqNo != "" || primaryTerm != "" {
+		if c.Query("version") != "" {
+			return nil, errors.New("version and if_seq_no cannot be used together")
+		}
+		s, err1 := strconv.ParseInt(seqNo, 10, 64)
+		p, err2 := strconv.ParseInt(primaryTerm, 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("if_seq_no and if_primary_term must both be integers")
+		}
+		opts = append(opts, backend.WithSeqNo(s, p))
+	}
+	if refresh := c.Query("refresh"); refresh != "" {
+		switch refresh {
+		case "true", "false", "wait_for":
+		default:
+			return nil, fmt.Errorf("invalid refresh %q, want true, false or wait_for", refresh)
+		}
+		opts = append(opts, backend.WithRefresh(refresh))
+	}
+	if routing := c.Query("routing"); routing != "" {
+		opts = append(opts, backend.WithRouting(routing))
+	}
+	return opts, nil
+}
+
+//解析文档接口的索引, url 参数和json请求体, 有错误时已经返回给调用方
+func documentRequest(c *gin.Context, body interface{}) (string, []backend.DocOption, bool) {
+	index, err := documentIndex(c)
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, false
+	}
+	opts, err := documentOptions(c)
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, false
+	}
+	if body != nil {
+		if err := c.ShouldBindJSON(body); err != nil {
+			abortWithError(c, errBadRequest(err))
+			return "", nil, false
+		}
+	}
+	return index, opts, true
+}
+
+//PUT /api/v1/indexes/:index/docs/:id, 写入整个文档, op_type=create 时文档已存在返回409
+func putDocument(c *gin.Context) {
+	var doc map[string]interface{}
+	index, opts, ok := documentRequest(c, &doc)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	var res *elastic.IndexResponse
+	var err error
+	switch opType := c.Query("op_type"); opType {
+	case "create":
+		res, err = repo.Create(ctx, index, c.Param("id"), doc, opts...)
+	case "", "index":
+		res, err = repo.Index(ctx, index, c.Param("id"), doc, opts...)
+	default:
+		abortWithError(c, errBadRequest(fmt.Errorf("invalid op_type %q, want index or create", opType)))
+		return
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	status := http.StatusOK
+	if res.Result == "created" {
+		status = http.StatusCreated
+	}
+	c.JSON(status, res)
+}
+
+//GET /api/v1/indexes/:index/docs/:id
+func getDocument(c *gin.Context) {
+	index, opts, ok := documentRequest(c, nil)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Get(ctx, index, c.Param("id"), opts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//PATCH /api/v1/indexes/:index/docs/:id, 请求体是要修改的字段, 文档不存在时返回404
+func patchDocument(c *gin.Context) {
+	var doc map[string]interface{}
+	index, opts, ok := documentRequest(c, &doc)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Update(ctx, index, c.Param("id"), doc, opts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//DELETE /api/v1/indexes/:index/docs/:id
+func deleteDocument(c *gin.Context) {
+	index, opts, ok := documentRequest(c, nil)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Delete(ctx, index, c.Param("id"), opts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//_update_by_query 和 _delete_by_query 的请求体, query 必须写, 要改所有文档时用 match_all
+type ByQueryRequest struct {
+	Query json.RawMessage `json:"query"`
+	//painless 脚本, 可以是字符串或者 {"source": "...", "lang": "painless", "params": {...}}
+	Script json.RawMessage `json:"script"`
+}
+
+type scriptBody struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func (r *ByQueryRequest) query() (elastic.Query, error) {
+	if len(r.Query) == 0 || string(r.Query) == "null" {
+		return nil, errors.New("query is required, use match_all to change every document")
+	}
+	return elastic.NewRawStringQuery(string(r.Query)), nil
+}
+
+func (r *ByQueryRequest) script() (*elastic.Script, error) {
+	if len(r.Script) == 0 || string(r.Script) == "null" {
+		return nil, nil
+	}
+	var source string
+	if err := json.Unmarshal(r.Script, &source); err == nil {
+		return elastic.NewScript(source), nil
+	}
+	var body scriptBody
+	if err := json.Unmarshal(r.Script, &body); err != nil || body.Source == "" {
+		return nil, errors.New("script must be a string or an object with source")
+	}
+	script := elastic.NewScript(body.Source)
+	if body.Lang != "" {
+		script.Lang(body.Lang)
+	}
+	if len(body.Params) > 0 {
+		script.Params(body.Params)
+	}
+	return script, nil
+}
+
+//by query 只支持 refresh, routing 和 conflicts 参数
+func byQueryOptions(c *gin.Context) ([]backend.DocOption, error) {
+	opts := make([]backend.DocOption, 0)
+	if refresh := c.Query("refresh"); refresh != "" {
+		if refresh != "true" && refresh != "false" {
+			return nil, fmt.Errorf("invalid refresh %q, want true or false", refresh)
+		}
+		opts = append(opts, backend.WithRefresh(refresh))
+	}
+	if routing := c.Query("routing"); routing != "" {
+		opts = append(opts, backend.WithRouting(routing))
+	}
+	if conflicts := c.Query("conflicts"); conflicts != "" {
+		if conflicts != "abort" && conflicts != "proceed" {
+			return nil, fmt.Errorf("invalid conflicts %q, want abort or proceed", conflicts)
+		}
+		opts = append(opts, backend.WithConflicts(conflicts))
+	}
+	return opts, nil
+}
+
+func byQueryRequest(c *gin.Context) (string, elastic.Query, *elastic.Script, []backend.DocOption, bool) {
+	index, err := documentIndex(c)
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, nil, nil, false
+	}
+	opts, err := byQueryOptions(c)
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, nil, nil, false
+	}
+	var req ByQueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, nil, nil, false
+	}
+	query, err := req.query()
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, nil, nil, false
+	}
+	script, err := req.script()
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return "", nil, nil, nil, false
+	}
+	return index, query, script, opts, true
+}
+
+//POST /api/v1/indexes/:index/_update_by_query
+func updateDocumentsByQuery(c *gin.Context) {
+	index, query, script, opts, ok := byQueryRequest(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.UpdateByQuery(ctx, index, query, script, opts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//POST /api/v1/indexes/:index/_delete_by_query, 不能带 script
+func deleteDocumentsByQuery(c *gin.Context) {
+	index, query, script, opts, ok := byQueryRequest(c)
+	if !ok {
+		return
+	}
+	if script != nil {
+		abortWithError(c, errBadRequest(errors.New("script is not supported by _delete_by_query")))
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.DeleteByQuery(ctx, index, query, opts...)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
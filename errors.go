@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+	"gopkg.in/go-playground/validator.v9"
+)
+
+//错误码
+const (
+	ERR_BAD_REQUEST  = "bad_request"
+	ERR_UNAUTHORIZED = "unauthorized"
+	ERR_FORBIDDEN    = "forbidden"
+	ERR_NOT_FOUND    = "not_found"
+	ERR_TOO_LARGE    = "request_too_large"
+	ERR_CONFLICT     = "conflict"
+	ERR_UPSTREAM     = "upstream_error"
+	ERR_TIMEOUT      = "timeout"
+	ERR_INTERNAL     = "internal_error"
+)
+
+//接口错误, Status 为返回的http状态码, Code/Message 以json返回给调用方
+type ApiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Err     error  `json:"-"`
+}
+
+func (e *ApiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ApiError) Unwrap() error {
+	return e.Err
+}
+
+func errBadRequest(err error) *ApiError {
+	return &ApiError{Status: http.StatusBadRequest, Code: ERR_BAD_REQUEST, Message: err.Error(), Err: err}
+}
+
+func errUnauthorized(err error) *ApiError {
+	return &ApiError{Status: http.StatusUnauthorized, Code: ERR_UNAUTHORIZED, Message: err.Error(), Err: err}
+}
+
+func errForbidden(err error) *ApiError {
+	return &ApiError{Status: http.StatusForbidden, Code: ERR_FORBIDDEN, Message: err.Error(), Err: err}
+}
+
+func errNotFound(message string) *ApiError {
+	return &ApiError{Status: http.StatusNotFound, Code: ERR_NOT_FOUND, Message: message}
+}
+
+func errTooLarge(err error) *ApiError {
+	return &ApiError{Status: http.StatusRequestEntityTooLarge, Code: ERR_TOO_LARGE, Message: err.Error(), Err: err}
+}
+
+func errConflict(err error) *ApiError {
+	return &ApiError{Status: http.StatusConflict, Code: ERR_CONFLICT, Message: err.Error(), Err: err}
+}
+
+func errUpstream(err error) *ApiError {
+	return &ApiError{Status: http.StatusBadGateway, Code: ERR_UPSTREAM, Message: err.Error(), Err: err}
+}
+
+func errTimeout(err error) *ApiError {
+	return &ApiError{Status: http.StatusGatewayTimeout, Code: ERR_TIMEOUT, Message: "request timed out", Err: err}
+}
+
+func errInternal(err error) *ApiError {
+	return &ApiError{Status: http.StatusInternalServerError, Code: ERR_INTERNAL, Message: "internal server error", Err: err}
+}
+
+//把handler里遇到的各种错误统一转换成ApiError
+func toApiError(err error) *ApiError {
+	switch e := err.(type) {
+	case *ApiError:
+		return e
+	case validator.ValidationErrors:
+		return errBadRequest(e)
+	case *elastic.Error:
+		return esStatusError(e.Status, e)
+	}
+	if errors.Is(err, context.DeadlineExceeded) || elastic.IsTimeout(err) {
+		return errTimeout(err)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errTimeout(err)
+	}
+	return errUpstream(err)
+}
+
+//根据es返回的状态码区分错误类型
+func esStatusError(status int, err error) *ApiError {
+	switch status {
+	case http.StatusBadRequest:
+		return errBadRequest(err)
+	case http.StatusNotFound:
+		e := errNotFound(err.Error())
+		e.Err = err
+		return e
+	case http.StatusConflict:
+		//版本冲突, 文档已存在
+		return errConflict(err)
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return errTimeout(err)
+	}
+	return errUpstream(err)
+}
+
+//返回错误并终止后续handler
+func abortWithError(c *gin.Context, err error) {
+	e := toApiError(err)
+	if e.Status >= http.StatusInternalServerError {
+		log.Printf("[%s %s] %v", c.Request.Method, c.Request.URL.Path, e)
+	}
+	c.AbortWithStatusJSON(e.Status, gin.H{"error": e})
+}
+
+//带超时的请求上下文, 客户端断开时也会取消对es的请求
+func requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), appConfig().Server.RequestTimeout)
+}
+
+//捕获handler中的panic, 返回json错误而不是让整个服务挂掉;
+//http.ErrAbortHandler 继续往上抛, 由 net/http 断开连接
+func recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					c.Abort()
+					panic(r)
+				}
+				log.Printf("panic recovered: %v\n%s", r, debug.Stack())
+				abortWithError(c, errInternal(fmt.Errorf("%v", r)))
+			}
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,272 @@
+package estest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+func aggsParam(req map[string]interface{}) map[string]interface{} {
+	if aggs, ok := req["aggs"].(map[string]interface{}); ok {
+		return aggs
+	}
+	if aggs, ok := req["aggregations"].(map[string]interface{}); ok {
+		return aggs
+	}
+	return nil
+}
+
+//对命中的文档做聚合, 支持常用的指标聚合和 terms/range/histogram/filter 桶聚合
+func (s *Server) aggregate(hits []*hit, aggs map[string]interface{}) (map[string]interface{}, *esError) {
+	result := make(map[string]interface{})
+	for name, def := range aggs {
+		d, ok := def.(map[string]interface{})
+		if !ok {
+			return nil, badRequest("aggregation [%s] must be an object", name)
+		}
+		sub := aggsParam(d)
+		for kind, body := range d {
+			if kind == "aggs" || kind == "aggregations" || kind == "meta" {
+				continue
+			}
+			params, _ := body.(map[string]interface{})
+			r, e := s.aggregateOne(hits, kind, params, sub)
+			if e != nil {
+				return nil, e
+			}
+			result[name] = r
+		}
+	}
+	return result, nil
+}
+
+func (s *Server) bucket(hits []*hit, sub map[string]interface{}, bucket map[string]interface{}) (map[string]interface{}, *esError) {
+	bucket["doc_count"] = len(hits)
+	if sub == nil {
+		return bucket, nil
+	}
+	subResult, e := s.aggregate(hits, sub)
+	if e != nil {
+		return nil, e
+	}
+	for k, v := range subResult {
+		bucket[k] = v
+	}
+	return bucket, nil
+}
+
+func numericValues(hits []*hit, field string) []float64 {
+	values := make([]float64, 0)
+	for _, h := range hits {
+		for _, v := range docValues(h.doc, field) {
+			if f, ok := toFloat(v); ok {
+				values = append(values, f)
+			} else if t, ok := toTime(v); ok {
+				values = append(values, float64(t.UnixNano()/1e6))
+			}
+		}
+	}
+	return values
+}
+
+//es里 1.0 这种整数值的key以 "1.0" 输出
+func formatDouble(f float64) string {
+	if f == math.Trunc(f) {
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (s *Server) aggregateOne(hits []*hit, kind string, params map[string]interface{}, sub map[string]interface{}) (interface{}, *esError) {
+	field, _ := params["field"].(string)
+	switch kind {
+	case "min", "max", "sum", "avg":
+		values := numericValues(hits, field)
+		if len(values) == 0 {
+			if kind == "sum" {
+				return map[string]interface{}{"value": 0}, nil
+			}
+			return map[string]interface{}{"value": nil}, nil
+		}
+		r := values[0]
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+			if kind == "min" {
+				r = math.Min(r, v)
+			} else if kind == "max" {
+				r = math.Max(r, v)
+			}
+		}
+		if kind == "sum" {
+			r = sum
+		} else if kind == "avg" {
+			r = sum / float64(len(values))
+		}
+		return map[string]interface{}{"value": r}, nil
+	case "value_count":
+		n := 0
+		for _, h := range hits {
+			n += len(docValues(h.doc, field))
+		}
+		return map[string]interface{}{"value": n}, nil
+	case "cardinality":
+		seen := make(map[string]bool)
+		for _, h := range hits {
+			for _, v := range docValues(h.doc, field) {
+				seen[fmt.Sprint(v)] = true
+			}
+		}
+		return map[string]interface{}{"value": len(seen)}, nil
+	case "terms":
+		return s.termsAgg(hits, field, params, sub)
+	case "range":
+		return s.rangeAgg(hits, field, params, sub)
+	case "histogram":
+		return s.histogramAgg(hits, field, params, sub)
+	case "date_histogram":
+		return s.dateHistogramAgg(hits, field, params, sub)
+	case "filter":
+		filtered := make([]*hit, 0)
+		for _, h := range hits {
+			ok, _, e := matches(h.idx, h.doc, params)
+			if e != nil {
+				return nil, e
+			}
+			if ok {
+				filtered = append(filtered, h)
+			}
+		}
+		return s.bucket(filtered, sub, map[string]interface{}{})
+	}
+	return nil, badRequest("estest: unsupported aggregation type [%s]", kind)
+}
+
+func (s *Server) termsAgg(hits []*hit, field string, params map[string]interface{}, sub map[string]interface{}) (interface{}, *esError) {
+	size := intParam(params, "size", 10)
+	groups := make(map[string][]*hit)
+	keys := make(map[string]interface{})
+	for _, h := range hits {
+		seen := make(map[string]bool)
+		for _, v := range docValues(h.doc, field) {
+			k := fmt.Sprint(v)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			groups[k] = append(groups[k], h)
+			keys[k] = v
+		}
+	}
+	names := make([]string, 0, len(groups))
+	for k := range groups {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(groups[names[i]]) != len(groups[names[j]]) {
+			return len(groups[names[i]]) > len(groups[names[j]])
+		}
+		return compare(keys[names[i]], keys[names[j]]) < 0
+	})
+	buckets := make([]interface{}, 0)
+	other := 0
+	for i, k := range names {
+		if i >= size {
+			other += len(groups[k])
+			continue
+		}
+		b, e := s.bucket(groups[k], sub, map[string]interface{}{"key": keys[k]})
+		if e != nil {
+			return nil, e
+		}
+		buckets = append(buckets, b)
+	}
+	return map[string]interface{}{
+		"doc_count_error_upper_bound": 0,
+		"sum_other_doc_count":         other,
+		"buckets":                     buckets,
+	}, nil
+}
+
+func (s *Server) rangeAgg(hits []*hit, field string, params map[string]interface{}, sub map[string]interface{}) (interface{}, *esError) {
+	buckets := make([]interface{}, 0)
+	for _, r := range asList(params["ranges"]) {
+		rm, _ := r.(map[string]interface{})
+		from, hasFrom := toFloat(rm["from"])
+		to, hasTo := toFloat(rm["to"])
+		key := "*"
+		if hasFrom {
+			key = formatDouble(from)
+		}
+		key += "-"
+		if hasTo {
+			key += formatDouble(to)
+		} else {
+			key += "*"
+		}
+		if k, ok := rm["key"].(string); ok {
+			key = k
+		}
+		inRange := make([]*hit, 0)
+		for _, h := range hits {
+			for _, v := range numericValues([]*hit{h}, field) {
+				if (!hasFrom || v >= from) && (!hasTo || v < to) {
+					inRange = append(inRange, h)
+					break
+				}
+			}
+		}
+		bucket := map[string]interface{}{"key": key}
+		if hasFrom {
+			bucket["from"] = from
+		}
+		if hasTo {
+			bucket["to"] = to
+		}
+		b, e := s.bucket(inRange, sub, bucket)
+		if e != nil {
+			return nil, e
+		}
+		buckets = append(buckets, b)
+	}
+	return map[string]interface{}{"buckets": buckets}, nil
+}
+
+func (s *Server) histogramAgg(hits []*hit, field string, params map[string]interface{}, sub map[string]interface{}) (interface{}, *esError) {
+	interval, ok := toFloat(params["interval"])
+	if !ok || interval <= 0 {
+		return nil, badRequest("[histogram] requires a positive interval")
+	}
+	minDocCount := intParam(params, "min_doc_count", 0)
+	groups := make(map[float64][]*hit)
+	for _, h := range hits {
+		seen := make(map[float64]bool)
+		for _, v := range numericValues([]*hit{h}, field) {
+			k := math.Floor(v/interval) * interval
+			if !seen[k] {
+				seen[k] = true
+				groups[k] = append(groups[k], h)
+			}
+		}
+	}
+	keys := make([]float64, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	buckets := make([]interface{}, 0)
+	if len(keys) > 0 {
+		for k := keys[0]; k <= keys[len(keys)-1]; k += interval {
+			if len(groups[k]) < minDocCount {
+				continue
+			}
+			b, e := s.bucket(groups[k], sub, map[string]interface{}{"key": k})
+			if e != nil {
+				return nil, e
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	return map[string]interface{}{"buckets": buckets}, nil
+}
@@ -0,0 +1,243 @@
+package estest
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//别名指向的索引, 按名字排序
+func (s *Server) aliasIndices(alias string) []*index {
+	result := make([]*index, 0)
+	for _, name := range s.sortedNames() {
+		if s.indices[name].aliases[alias] {
+			result = append(result, s.indices[name])
+		}
+	}
+	return result
+}
+
+type aliasAction struct {
+	op      string
+	indices []*index
+	alias   string
+}
+
+//POST /_aliases, 所有action先检查再一起执行, 和es一样是原子的
+func (s *Server) updateAliases(body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	list, _ := req["actions"].([]interface{})
+	actions := make([]aliasAction, 0, len(list))
+	for _, item := range list {
+		m, _ := item.(map[string]interface{})
+		if len(m) != 1 {
+			return 0, badRequest("[aliases] expected one action per item")
+		}
+		for op, v := range m {
+			spec, _ := v.(map[string]interface{})
+			action := aliasAction{op: op}
+			action.alias, _ = spec["alias"].(string)
+			names := make([]string, 0)
+			if name, ok := spec["index"].(string); ok {
+				names = append(names, name)
+			}
+			if list, ok := spec["indices"].([]interface{}); ok {
+				for _, n := range list {
+					names = append(names, fmt.Sprint(n))
+				}
+			}
+			if len(names) == 0 {
+				return 0, badRequest("[%s] one of [index] or [indices] is required", op)
+			}
+			for _, name := range names {
+				indices, e := s.resolveConcrete(name)
+				if e != nil {
+					return 0, e
+				}
+				action.indices = append(action.indices, indices...)
+			}
+			switch op {
+			case "add", "remove":
+				if action.alias == "" {
+					return 0, badRequest("[%s] alias is required", op)
+				}
+				if op == "remove" {
+					for _, idx := range action.indices {
+						if !idx.aliases[action.alias] {
+							return 0, &esError{status: http.StatusNotFound, typ: "aliases_not_found_exception",
+								reason: fmt.Sprintf("aliases [%s] missing", action.alias), index: idx.name}
+						}
+					}
+				}
+			case "remove_index":
+			default:
+				return 0, badRequest("unknown alias action [%s]", op)
+			}
+			actions = append(actions, action)
+		}
+	}
+
+	for _, action := range actions {
+		if _, ok := s.indices[action.alias]; ok && action.op == "add" && !removedIn(actions, action.alias) {
+			return 0, &esError{status: http.StatusBadRequest, typ: "invalid_alias_name_exception",
+				reason: fmt.Sprintf("Invalid alias name [%s], an index exists with the same name as the alias", action.alias)}
+		}
+	}
+	for _, action := range actions {
+		for _, idx := range action.indices {
+			switch action.op {
+			case "add":
+				idx.aliases[action.alias] = true
+			case "remove":
+				delete(idx.aliases, action.alias)
+			case "remove_index":
+				delete(s.indices, idx.name)
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+//同一个请求里用 remove_index 删掉了同名索引时, 可以用这个名字加别名
+func removedIn(actions []aliasAction, name string) bool {
+	for _, action := range actions {
+		if action.op != "remove_index" {
+			continue
+		}
+		for _, idx := range action.indices {
+			if idx.name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//别名操作里的 index 只能是实际的索引名或者通配符
+func (s *Server) resolveConcrete(name string) ([]*index, *esError) {
+	if strings.ContainsAny(name, "*?") {
+		result := make([]*index, 0)
+		for _, n := range s.sortedNames() {
+			if ok, _ := path.Match(name, n); ok {
+				result = append(result, s.indices[n])
+			}
+		}
+		return result, nil
+	}
+	idx, ok := s.indices[name]
+	if !ok {
+		return nil, indexNotFound(name)
+	}
+	return []*index{idx}, nil
+}
+
+//GET /_alias/{name} 和 /{index}/_alias/{name}
+func (s *Server) getAliases(indexExpr, aliasExpr string) (int, interface{}) {
+	var indices []*index
+	if indexExpr == "" {
+		for _, name := range s.sortedNames() {
+			indices = append(indices, s.indices[name])
+		}
+	} else {
+		var e *esError
+		if indices, e = s.resolve(indexExpr); e != nil {
+			return 0, e
+		}
+	}
+	resp := make(map[string]interface{})
+	for _, idx := range indices {
+		aliases := make(map[string]interface{})
+		for alias := range idx.aliases {
+			if aliasExpr == "" || matchAny(aliasExpr, alias) {
+				aliases[alias] = map[string]interface{}{}
+			}
+		}
+		if len(aliases) > 0 || aliasExpr == "" {
+			resp[idx.name] = map[string]interface{}{"aliases": aliases}
+		}
+	}
+	if len(resp) == 0 && aliasExpr != "" {
+		return http.StatusNotFound, map[string]interface{}{
+			"error":  fmt.Sprintf("alias [%s] missing", aliasExpr),
+			"status": http.StatusNotFound,
+		}
+	}
+	return http.StatusOK, resp
+}
+
+func matchAny(expr, name string) bool {
+	for _, pattern := range strings.Split(expr, ",") {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//POST /_reindex, 只支持 source.index/dest.index, 可选 source.query
+func (s *Server) reindex(body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	source, _ := req["source"].(map[string]interface{})
+	dest, _ := req["dest"].(map[string]interface{})
+	srcName, _ := source["index"].(string)
+	destName, _ := dest["index"].(string)
+	if srcName == "" || destName == "" {
+		return 0, badRequest("[reindex] source.index and dest.index are required")
+	}
+	srcIndices, e := s.resolve(srcName)
+	if e != nil {
+		return 0, e
+	}
+	query, _ := source["query"].(map[string]interface{})
+	if query == nil {
+		query = map[string]interface{}{"match_all": map[string]interface{}{}}
+	}
+	destIdx, e := s.writableIndex(destName)
+	if e != nil {
+		return 0, e
+	}
+
+	var total, created, updated int64
+	for _, idx := range srcIndices {
+		for _, doc := range idx.all() {
+			ok, _, e := matches(idx, doc, query)
+			if e != nil {
+				return 0, e
+			}
+			if !ok {
+				continue
+			}
+			copied := make(map[string]interface{}, len(doc.source))
+			for k, v := range doc.source {
+				copied[k] = v
+			}
+			status, _, e := s.put(destIdx, doc.typ, doc.id, copied, "index")
+			if e != nil {
+				return 0, e
+			}
+			total++
+			if status == http.StatusCreated {
+				created++
+			} else {
+				updated++
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"total":     total,
+		"created":   created,
+		"updated":   updated,
+		"deleted":   0,
+		"batches":   1,
+		"failures":  []interface{}{},
+	}
+}
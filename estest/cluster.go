@@ -0,0 +1,37 @@
+package estest
+
+//集群状态默认 green, 测试时可以改成 yellow 或 red
+func (s *Server) SetHealth(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = status
+}
+
+//接下来的 n 个 bulk 条目返回 429 es_rejected_execution_exception, 模拟写入队列满
+func (s *Server) RejectBulkItems(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejectBulk = n
+}
+
+//GET /_cluster/health, 只有一个节点, 每个索引一个分片; 调用时已经加锁
+func (s *Server) clusterHealth() map[string]interface{} {
+	status := s.health
+	if status == "" {
+		status = "green"
+	}
+	return map[string]interface{}{
+		"cluster_name":                    "estest",
+		"status":                          status,
+		"timed_out":                       false,
+		"number_of_nodes":                 1,
+		"number_of_data_nodes":            1,
+		"active_primary_shards":           len(s.indices),
+		"active_shards":                   len(s.indices),
+		"relocating_shards":               0,
+		"initializing_shards":             0,
+		"unassigned_shards":               0,
+		"number_of_pending_tasks":         0,
+		"active_shards_percent_as_number": 100.0,
+	}
+}
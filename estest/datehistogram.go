@@ -0,0 +1,194 @@
+package estest
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//date_histogram 的 key_as_string 默认格式
+const dateKeyLayout = "2006-01-02T15:04:05.000Z07:00"
+
+var fixedInterval = regexp.MustCompile(`^(\d+)(ms|s|m|h|d)$`)
+
+//按间隔取整和取下一个桶的起点
+type dateRounding struct {
+	floor func(time.Time) time.Time
+	next  func(time.Time) time.Time
+}
+
+//日历间隔(minute, day, 1M 等)按时区里的日历取整, 固定间隔(90m, 7d)按时区偏移后的毫秒数取整
+func newDateRounding(interval string, loc *time.Location) (*dateRounding, *esError) {
+	calendar := map[string]string{
+		"1m": "minute", "1h": "hour", "1d": "day", "1w": "week", "1M": "month", "1q": "quarter", "1y": "year",
+	}
+	if name, ok := calendar[interval]; ok {
+		interval = name
+	}
+	date := func(t time.Time, unit string) time.Time {
+		t = t.In(loc)
+		y, mo, d := t.Date()
+		switch unit {
+		case "minute":
+			return time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc)
+		case "hour":
+			return time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc)
+		case "week":
+			//es的周从周一开始
+			return time.Date(y, mo, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+		case "month":
+			return time.Date(y, mo, 1, 0, 0, 0, 0, loc)
+		case "quarter":
+			return time.Date(y, (mo-1)/3*3+1, 1, 0, 0, 0, 0, loc)
+		case "year":
+			return time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+		}
+		return time.Date(y, mo, d, 0, 0, 0, 0, loc)
+	}
+	switch interval {
+	case "minute", "hour", "day", "week", "month", "quarter", "year":
+		unit := interval
+		return &dateRounding{
+			floor: func(t time.Time) time.Time { return date(t, unit) },
+			next: func(t time.Time) time.Time {
+				switch unit {
+				case "minute":
+					return t.Add(time.Minute)
+				case "hour":
+					return t.Add(time.Hour)
+				case "week":
+					return t.AddDate(0, 0, 7)
+				case "month":
+					return t.AddDate(0, 1, 0)
+				case "quarter":
+					return t.AddDate(0, 3, 0)
+				case "year":
+					return t.AddDate(1, 0, 0)
+				}
+				return t.AddDate(0, 0, 1)
+			},
+		}, nil
+	}
+	match := fixedInterval.FindStringSubmatch(interval)
+	if match == nil {
+		return nil, badRequest("failed to parse setting [date_histogram.interval] with value [%s]", interval)
+	}
+	n, _ := strconv.ParseInt(match[1], 10, 64)
+	unit := map[string]time.Duration{"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[match[2]]
+	step := time.Duration(n) * unit
+	if step <= 0 {
+		return nil, badRequest("[date_histogram] requires a positive interval")
+	}
+	return &dateRounding{
+		floor: func(t time.Time) time.Time {
+			_, offset := t.In(loc).Zone()
+			local := t.UnixNano() + int64(offset)*int64(time.Second)
+			rem := local % int64(step)
+			if rem < 0 {
+				rem += int64(step)
+			}
+			return time.Unix(0, t.UnixNano()-rem).In(loc)
+		},
+		next: func(t time.Time) time.Time { return t.Add(step) },
+	}, nil
+}
+
+//"+08:00" 这样的偏移或者 Asia/Shanghai 这样的时区名
+func parseTimeZone(v interface{}) (*time.Location, *esError) {
+	zone, _ := v.(string)
+	if zone == "" || zone == "UTC" || zone == "Z" {
+		return time.UTC, nil
+	}
+	if t, err := time.Parse("-07:00", zone); err == nil {
+		_, offset := t.Zone()
+		return time.FixedZone(zone, offset), nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, badRequest("unknown time zone [%s]", zone)
+	}
+	return loc, nil
+}
+
+//数字按字段的 format 当作秒或者毫秒, 字符串按常见的日期格式解析
+func (idx *index) dateValue(field string, v interface{}) (time.Time, bool) {
+	if f, ok := toFloat(v); ok {
+		if format, _ := idx.fieldDef(field)["format"].(string); strings.Contains(format, "epoch_second") {
+			return time.Unix(0, int64(f*1e9)), true
+		}
+		return time.Unix(0, int64(f*1e6)), true
+	}
+	return toTime(v)
+}
+
+func (s *Server) dateHistogramAgg(hits []*hit, field string, params map[string]interface{}, sub map[string]interface{}) (interface{}, *esError) {
+	loc, e := parseTimeZone(params["time_zone"])
+	if e != nil {
+		return nil, e
+	}
+	rounding, e := newDateRounding(fmt.Sprint(params["interval"]), loc)
+	if e != nil {
+		return nil, e
+	}
+	minDocCount := intParam(params, "min_doc_count", 0)
+	groups := make(map[int64][]*hit)
+	starts := make(map[int64]time.Time)
+	for _, h := range hits {
+		seen := make(map[int64]bool)
+		for _, v := range docValues(h.doc, field) {
+			t, ok := h.idx.dateValue(field, v)
+			if !ok {
+				continue
+			}
+			start := rounding.floor(t)
+			k := start.UnixNano() / 1e6
+			if !seen[k] {
+				seen[k] = true
+				groups[k] = append(groups[k], h)
+				starts[k] = start
+			}
+		}
+	}
+	keys := make([]int64, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var first, last time.Time
+	if len(keys) > 0 {
+		first, last = starts[keys[0]], starts[keys[len(keys)-1]]
+	}
+	//extended_bounds 把没有数据的首尾桶也补上
+	if bounds, ok := params["extended_bounds"].(map[string]interface{}); ok && len(hits) > 0 {
+		if t, ok := hits[0].idx.dateValue(field, bounds["min"]); ok {
+			if t = rounding.floor(t); first.IsZero() || t.Before(first) {
+				first = t
+			}
+		}
+		if t, ok := hits[0].idx.dateValue(field, bounds["max"]); ok {
+			if t = rounding.floor(t); last.IsZero() || t.After(last) {
+				last = t
+			}
+		}
+	}
+
+	buckets := make([]interface{}, 0)
+	if !first.IsZero() {
+		for t := first; !t.After(last); t = rounding.next(t) {
+			k := t.UnixNano() / 1e6
+			if len(groups[k]) < minDocCount {
+				continue
+			}
+			b, e := s.bucket(groups[k], sub, map[string]interface{}{"key": k, "key_as_string": t.In(loc).Format(dateKeyLayout)})
+			if e != nil {
+				return nil, e
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	return map[string]interface{}{"buckets": buckets}, nil
+}
@@ -0,0 +1,279 @@
+package estest
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var durationPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(ms|s|m|h|d|w)$`)
+
+//"30d" 这样的时间间隔换成毫秒
+func parseDurationMillis(v interface{}) (float64, bool) {
+	if f, ok := toFloat(v); ok {
+		return f, true
+	}
+	s, _ := v.(string)
+	match := durationPattern.FindStringSubmatch(s)
+	if match == nil {
+		return 0, false
+	}
+	n, _ := strconv.ParseFloat(match[1], 64)
+	unit := map[string]float64{"ms": 1, "s": 1e3, "m": 6e4, "h": 36e5, "d": 864e5, "w": 6048e5}[match[2]]
+	return n * unit, true
+}
+
+//function_score, 支持 weight, field_value_factor 和 gauss/exp/linear 衰减函数
+func matchFunctionScore(idx *index, doc *document, body interface{}) (bool, float64, *esError) {
+	b, _ := body.(map[string]interface{})
+	ok, score, e := matches(idx, doc, b["query"])
+	if e != nil || !ok {
+		return false, 0, e
+	}
+	functions := asList(b["functions"])
+	if len(functions) == 0 {
+		//只有一个函数时可以直接写在 function_score 里
+		functions = []interface{}{b}
+	}
+	scoreMode, _ := b["score_mode"].(string)
+	if scoreMode == "" {
+		scoreMode = "multiply"
+	}
+	values := make([]float64, 0, len(functions))
+	weights := make([]float64, 0, len(functions))
+	for _, f := range functions {
+		fn, _ := f.(map[string]interface{})
+		if filter, ok := fn["filter"]; ok {
+			matched, _, e := matches(idx, doc, filter)
+			if e != nil {
+				return false, 0, e
+			}
+			if !matched {
+				continue
+			}
+		}
+		weight := 1.0
+		if w, ok := toFloat(fn["weight"]); ok {
+			weight = w
+		}
+		v, found, e := scoreFunction(idx, doc, fn)
+		if e != nil {
+			return false, 0, e
+		}
+		if !found {
+			if _, ok := fn["weight"]; !ok {
+				continue
+			}
+			v = 1
+		}
+		values = append(values, v*weight)
+		weights = append(weights, weight)
+	}
+
+	fnScore := 1.0
+	if len(values) > 0 {
+		switch scoreMode {
+		case "multiply":
+			for _, v := range values {
+				fnScore *= v
+			}
+		case "sum", "avg":
+			fnScore = 0
+			for _, v := range values {
+				fnScore += v
+			}
+			if scoreMode == "avg" {
+				total := 0.0
+				for _, w := range weights {
+					total += w
+				}
+				fnScore /= total
+			}
+		case "first":
+			fnScore = values[0]
+		case "max", "min":
+			fnScore = values[0]
+			for _, v := range values[1:] {
+				if (scoreMode == "max" && v > fnScore) || (scoreMode == "min" && v < fnScore) {
+					fnScore = v
+				}
+			}
+		default:
+			return false, 0, badRequest("illegal score_mode [%s]", scoreMode)
+		}
+	}
+	if max, ok := toFloat(b["max_boost"]); ok && fnScore > max {
+		fnScore = max
+	}
+
+	boostMode, _ := b["boost_mode"].(string)
+	switch boostMode {
+	case "", "multiply":
+		score *= fnScore
+	case "replace":
+		score = fnScore
+	case "sum":
+		score += fnScore
+	case "avg":
+		score = (score + fnScore) / 2
+	case "max":
+		score = math.Max(score, fnScore)
+	case "min":
+		score = math.Min(score, fnScore)
+	default:
+		return false, 0, badRequest("illegal boost_mode [%s]", boostMode)
+	}
+	return true, score, nil
+}
+
+//单个函数的得分, 只有 weight 时返回 found=false
+func scoreFunction(idx *index, doc *document, fn map[string]interface{}) (float64, bool, *esError) {
+	for kind, params := range fn {
+		p, _ := params.(map[string]interface{})
+		switch kind {
+		case "filter", "weight":
+			continue
+		case "field_value_factor":
+			v, e := fieldValueFactor(idx, doc, p)
+			return v, true, e
+		case "gauss", "exp", "linear":
+			v, e := decayScore(idx, doc, kind, p)
+			return v, true, e
+		default:
+			return 0, false, badRequest("estest: function [%s] is not supported", kind)
+		}
+	}
+	return 0, false, nil
+}
+
+func fieldValueFactor(idx *index, doc *document, p map[string]interface{}) (float64, *esError) {
+	field, _ := p["field"].(string)
+	var value float64
+	found := false
+	for _, v := range docValues(doc, field) {
+		if f, ok := toFloat(v); ok {
+			value, found = f, true
+			break
+		}
+	}
+	if !found {
+		missing, ok := toFloat(p["missing"])
+		if !ok {
+			return 0, &esError{status: 400, typ: "exception", reason: fmt.Sprintf("Missing value for field [%s]", field)}
+		}
+		value = missing
+	}
+	if factor, ok := toFloat(p["factor"]); ok {
+		value *= factor
+	}
+	modifier, _ := p["modifier"].(string)
+	switch modifier {
+	case "", "none":
+	case "log":
+		value = math.Log10(value)
+	case "log1p":
+		value = math.Log10(value + 1)
+	case "log2p":
+		value = math.Log10(value + 2)
+	case "ln":
+		value = math.Log(value)
+	case "ln1p":
+		value = math.Log1p(value)
+	case "ln2p":
+		value = math.Log(value + 2)
+	case "square":
+		value = value * value
+	case "sqrt":
+		value = math.Sqrt(value)
+	case "reciprocal":
+		value = 1 / value
+	default:
+		return 0, badRequest("illegal modifier [%s]", modifier)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+		return 0, badRequest("field value function must not produce negative scores, but got [%v] for field [%s]", value, field)
+	}
+	return value, nil
+}
+
+//衰减函数, 日期字段的距离按毫秒算, origin 默认 now; 数值字段必须给 origin
+func decayScore(idx *index, doc *document, kind string, p map[string]interface{}) (float64, *esError) {
+	var field string
+	var params map[string]interface{}
+	for k, v := range p {
+		if k == "multi_value_mode" {
+			continue
+		}
+		field = k
+		params, _ = v.(map[string]interface{})
+	}
+	if idx.fieldDef(field) == nil {
+		return 0, &esError{status: 400, typ: "parsing_exception", reason: fmt.Sprintf("unknown field [%s]", field)}
+	}
+	isDate := idx.fieldType(field) == "date"
+	var origin, scale, offset float64
+	if isDate {
+		t := time.Now()
+		if o, ok := params["origin"]; ok && o != "now" {
+			var ok bool
+			if t, ok = idx.dateValue(field, o); !ok {
+				return 0, badRequest("unable to parse origin [%v]", o)
+			}
+		}
+		origin = float64(t.UnixNano()) / 1e6
+		var ok bool
+		if scale, ok = parseDurationMillis(params["scale"]); !ok {
+			return 0, badRequest("unable to parse scale [%v]", params["scale"])
+		}
+		if o, exists := params["offset"]; exists {
+			if offset, ok = parseDurationMillis(o); !ok {
+				return 0, badRequest("unable to parse offset [%v]", o)
+			}
+		}
+	} else {
+		var ok bool
+		if origin, ok = toFloat(params["origin"]); !ok {
+			return 0, badRequest("[%s] numeric decay needs an origin", kind)
+		}
+		if scale, ok = toFloat(params["scale"]); !ok {
+			return 0, badRequest("unable to parse scale [%v]", params["scale"])
+		}
+		offset, _ = toFloat(params["offset"])
+	}
+	decay := 0.5
+	if d, ok := toFloat(params["decay"]); ok {
+		decay = d
+	}
+
+	//多值字段取离 origin 最近的值
+	distance := math.Inf(1)
+	for _, v := range docValues(doc, field) {
+		var x float64
+		if isDate {
+			t, ok := idx.dateValue(field, v)
+			if !ok {
+				continue
+			}
+			x = float64(t.UnixNano()) / 1e6
+		} else if f, ok := toFloat(v); ok {
+			x = f
+		} else {
+			continue
+		}
+		distance = math.Min(distance, math.Max(0, math.Abs(x-origin)-offset))
+	}
+	if math.IsInf(distance, 1) {
+		//没有值的文档不衰减
+		return 1, nil
+	}
+	switch kind {
+	case "exp":
+		return math.Exp(math.Log(decay) / scale * distance), nil
+	case "linear":
+		s := scale / (1 - decay)
+		return math.Max(0, (s-distance)/s), nil
+	}
+	return math.Exp(distance * distance * math.Log(decay) / (scale * scale)), nil
+}
@@ -0,0 +1,119 @@
+package estest
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const earthRadius = 6371008.8 // 米
+
+var distancePattern = regexp.MustCompile(`^([\d.]+)\s*(km|m|cm|mm|mi|yd|ft|in|nmi|NM)?$`)
+
+//"10km" 这样的距离换成米, 没有单位时是米
+func parseDistance(v interface{}) (float64, *esError) {
+	if f, ok := toFloat(v); ok {
+		return f, nil
+	}
+	s, _ := v.(string)
+	match := distancePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, badRequest("failed to parse distance [%v]", v)
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, badRequest("failed to parse distance [%v]", v)
+	}
+	unit := map[string]float64{
+		"": 1, "m": 1, "km": 1000, "cm": 0.01, "mm": 0.001, "mi": 1609.344,
+		"yd": 0.9144, "ft": 0.3048, "in": 0.0254, "nmi": 1852, "NM": 1852,
+	}[match[2]]
+	return n * unit, nil
+}
+
+//geo_point 的几种写法: {"lat": 1, "lon": 2}, "1,2", [2, 1](注意数组是先经度后纬度)
+func parsePoint(v interface{}) (lat, lon float64, ok bool) {
+	switch p := v.(type) {
+	case map[string]interface{}:
+		lat, ok1 := toFloat(p["lat"])
+		lon, ok2 := toFloat(p["lon"])
+		return lat, lon, ok1 && ok2
+	case string:
+		parts := strings.Split(p, ",")
+		if len(parts) != 2 {
+			return 0, 0, false
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		return lat, lon, err1 == nil && err2 == nil
+	case []interface{}:
+		if len(p) != 2 {
+			return 0, 0, false
+		}
+		lon, ok1 := toFloat(p[0])
+		lat, ok2 := toFloat(p[1])
+		return lat, lon, ok1 && ok2
+	}
+	return 0, 0, false
+}
+
+//文档里的坐标, 字段可以是一个点或者点的数组
+func geoPoints(doc *document, field string) [][2]float64 {
+	var cur interface{} = doc.source
+	for _, p := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = m[p]; !ok {
+			return nil
+		}
+	}
+	if lat, lon, ok := parsePoint(cur); ok {
+		return [][2]float64{{lat, lon}}
+	}
+	points := make([][2]float64, 0)
+	if list, ok := cur.([]interface{}); ok {
+		for _, item := range list {
+			if lat, lon, ok := parsePoint(item); ok {
+				points = append(points, [2]float64{lat, lon})
+			}
+		}
+	}
+	return points
+}
+
+//两点间的球面距离, 米
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func matchGeoDistance(doc *document, body interface{}) (bool, float64, *esError) {
+	b, _ := body.(map[string]interface{})
+	distance, e := parseDistance(b["distance"])
+	if e != nil {
+		return false, 0, e
+	}
+	for field, v := range b {
+		switch field {
+		case "distance", "distance_type", "validation_method", "_name", "boost":
+			continue
+		}
+		lat, lon, ok := parsePoint(v)
+		if !ok {
+			return false, 0, badRequest("[geo_distance] failed to parse point for field [%s]", field)
+		}
+		for _, p := range geoPoints(doc, field) {
+			if haversine(lat, lon, p[0], p[1]) <= distance {
+				return true, 1, nil
+			}
+		}
+		return false, 0, nil
+	}
+	return false, 0, badRequest("[geo_distance] requires a field")
+}
@@ -0,0 +1,565 @@
+package estest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//按 standard 分词器的方式切词: 英文数字按单词切, 中文一个字一个词, 统一转小写
+func tokenize(s string) []string {
+	tokens := make([]string, 0)
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+//按路径取字段值, 数组字段返回所有元素
+func fieldValues(source map[string]interface{}, field string) []interface{} {
+	var cur interface{} = source
+	for _, p := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = m[p]; !ok {
+			return nil
+		}
+	}
+	switch v := cur.(type) {
+	case nil, map[string]interface{}:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{cur}
+}
+
+//取文档字段, 支持 _id 元字段
+func docValues(doc *document, field string) []interface{} {
+	if field == "_id" {
+		return []interface{}{doc.id}
+	}
+	if vals := fieldValues(doc.source, field); vals != nil {
+		return vals
+	}
+	//多字段(如 title.keyword, createdTime.date)不存在时用父字段的值
+	if i := strings.LastIndex(field, "."); i > 0 {
+		return fieldValues(doc.source, field[:i])
+	}
+	return nil
+}
+
+//mapping里字段的类型, 没有mapping时返回空
+func (idx *index) fieldType(field string) string {
+	t, _ := idx.fieldDef(field)["type"].(string)
+	return t
+}
+
+//mapping里字段的定义, 支持对象字段和多字段(title.keyword)
+func (idx *index) fieldDef(field string) map[string]interface{} {
+	for _, m := range idx.mappings {
+		typeMapping, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		props, _ := typeMapping["properties"].(map[string]interface{})
+		parts := strings.Split(field, ".")
+		for i, p := range parts {
+			def, ok := props[p].(map[string]interface{})
+			if !ok {
+				break
+			}
+			if i == len(parts)-1 {
+				return def
+			}
+			if sub, ok := def["properties"].(map[string]interface{}); ok {
+				props = sub
+			} else if sub, ok := def["fields"].(map[string]interface{}); ok {
+				props = sub
+			} else {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+var numericTypes = map[string]bool{
+	"long": true, "integer": true, "short": true, "byte": true,
+	"double": true, "float": true, "half_float": true, "scaled_float": true,
+}
+
+//只检查顶层字段: mapping 里是数字类型但值不能转成数字时, 和es一样报 mapper_parsing_exception
+func (idx *index) checkSource(source map[string]interface{}) *esError {
+	for field, v := range source {
+		if v == nil || !numericTypes[idx.fieldType(field)] {
+			continue
+		}
+		if _, ok := toFloat(v); !ok {
+			return &esError{status: http.StatusBadRequest, typ: "mapper_parsing_exception",
+				reason: fmt.Sprintf("failed to parse field [%s] of type [%s]", field, idx.fieldType(field)),
+				index:  idx.name}
+		}
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+func toTime(v interface{}) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+//比较两个值, 数字按数值, 日期按时间, 其它按字符串
+func compare(a, b interface{}) int {
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	if fa, ok := toFloat(a); ok && !(aStr && bStr) {
+		if fb, ok := toFloat(b); ok {
+			return cmpFloat(fa, fb)
+		}
+	}
+	if ta, ok := toTime(a); ok {
+		if tb, ok := toTime(b); ok {
+			return cmpFloat(float64(ta.UnixNano()), float64(tb.UnixNano()))
+		}
+		if fb, ok := toFloat(b); ok {
+			return cmpFloat(float64(ta.UnixNano()/int64(time.Millisecond)), fb)
+		}
+	}
+	if fa, ok := toFloat(a); ok {
+		if tb, ok := toTime(b); ok {
+			return cmpFloat(fa, float64(tb.UnixNano()/int64(time.Millisecond)))
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func equal(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			return fa == fb
+		}
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+//查询的单个条件, 返回是否命中以及得分
+func matches(idx *index, doc *document, query interface{}) (bool, float64, *esError) {
+	if query == nil {
+		return true, 1, nil
+	}
+	q, ok := query.(map[string]interface{})
+	if !ok || len(q) != 1 {
+		return false, 0, badRequest("query malformed, must be an object with exactly one key")
+	}
+	for kind, body := range q {
+		switch kind {
+		case "match_all":
+			return true, 1, nil
+		case "match_none":
+			return false, 0, nil
+		case "bool":
+			return matchBool(idx, doc, body)
+		case "constant_score":
+			b, _ := body.(map[string]interface{})
+			ok, _, e := matches(idx, doc, b["filter"])
+			return ok, 1, e
+		case "term":
+			field, params := fieldParams(body, "value")
+			return matchTerm(idx, doc, field, []interface{}{params["value"]})
+		case "terms":
+			b, _ := body.(map[string]interface{})
+			for field, values := range b {
+				if field == "boost" {
+					continue
+				}
+				vals, _ := values.([]interface{})
+				return matchTerm(idx, doc, field, vals)
+			}
+			return false, 0, badRequest("[terms] query requires a field")
+		case "ids":
+			b, _ := body.(map[string]interface{})
+			values, _ := b["values"].([]interface{})
+			for _, v := range values {
+				if fmt.Sprint(v) == doc.id {
+					return true, 1, nil
+				}
+			}
+			return false, 0, nil
+		case "match", "match_phrase", "match_phrase_prefix":
+			field, params := fieldParams(body, "query")
+			operator, _ := params["operator"].(string)
+			return matchText(idx, doc, []string{field}, fmt.Sprint(params["query"]), operator, kind)
+		case "multi_match":
+			b, _ := body.(map[string]interface{})
+			fields := make([]string, 0)
+			if fs, ok := b["fields"].([]interface{}); ok {
+				for _, f := range fs {
+					name := fmt.Sprint(f)
+					if i := strings.Index(name, "^"); i > 0 {
+						name = name[:i]
+					}
+					fields = append(fields, name)
+				}
+			}
+			if len(fields) == 0 {
+				fields = stringFields(doc.source, "")
+			}
+			operator, _ := b["operator"].(string)
+			return matchText(idx, doc, fields, fmt.Sprint(b["query"]), operator, "match")
+		case "range":
+			return matchRange(doc, body)
+		case "exists":
+			b, _ := body.(map[string]interface{})
+			field, _ := b["field"].(string)
+			//geo_point 这样的对象值 docValues 里取不到
+			return len(docValues(doc, field)) > 0 || len(sourceValues(doc.source, field)) > 0, 1, nil
+		case "function_score":
+			return matchFunctionScore(idx, doc, body)
+		case "geo_distance":
+			return matchGeoDistance(doc, body)
+		case "prefix":
+			field, params := fieldParams(body, "value")
+			prefix := fmt.Sprint(params["value"])
+			for _, v := range docValues(doc, field) {
+				if strings.HasPrefix(fmt.Sprint(v), prefix) {
+					return true, 1, nil
+				}
+			}
+			return false, 0, nil
+		case "wildcard":
+			field, params := fieldParams(body, "value")
+			pattern := fmt.Sprint(params["value"])
+			if params["wildcard"] != nil {
+				pattern = fmt.Sprint(params["wildcard"])
+			}
+			for _, v := range docValues(doc, field) {
+				if ok, _ := path.Match(pattern, fmt.Sprint(v)); ok {
+					return true, 1, nil
+				}
+			}
+			return false, 0, nil
+		}
+		return false, 0, badRequest("no [query] registered for [%s]", kind)
+	}
+	return false, 0, nil
+}
+
+//解析 {"field": value} 和 {"field": {"value": ..}} 两种写法
+func fieldParams(body interface{}, key string) (string, map[string]interface{}) {
+	b, _ := body.(map[string]interface{})
+	for field, v := range b {
+		if field == "boost" || field == "_name" {
+			continue
+		}
+		if m, ok := v.(map[string]interface{}); ok {
+			return field, m
+		}
+		return field, map[string]interface{}{key: v}
+	}
+	return "", map[string]interface{}{}
+}
+
+//文档里所有字符串类型的字段, multi_match不指定字段时用
+func stringFields(source map[string]interface{}, prefix string) []string {
+	fields := make([]string, 0)
+	for k, v := range source {
+		switch val := v.(type) {
+		case string:
+			fields = append(fields, prefix+k)
+		case map[string]interface{}:
+			fields = append(fields, stringFields(val, prefix+k+".")...)
+		}
+	}
+	return fields
+}
+
+func asList(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return val
+	}
+	return []interface{}{v}
+}
+
+func matchBool(idx *index, doc *document, body interface{}) (bool, float64, *esError) {
+	b, _ := body.(map[string]interface{})
+	score := 0.0
+	for _, clause := range []string{"must", "filter"} {
+		for _, q := range asList(b[clause]) {
+			ok, s, e := matches(idx, doc, q)
+			if e != nil || !ok {
+				return false, 0, e
+			}
+			if clause == "must" {
+				score += s
+			}
+		}
+	}
+	for _, q := range asList(b["must_not"]) {
+		ok, _, e := matches(idx, doc, q)
+		if e != nil || ok {
+			return false, 0, e
+		}
+	}
+	should := asList(b["should"])
+	minShould := 0
+	if len(should) > 0 && b["must"] == nil && b["filter"] == nil {
+		minShould = 1
+	}
+	if m, ok := toFloat(b["minimum_should_match"]); ok {
+		minShould = int(m)
+	}
+	matched := 0
+	for _, q := range should {
+		ok, s, e := matches(idx, doc, q)
+		if e != nil {
+			return false, 0, e
+		}
+		if ok {
+			matched++
+			score += s
+		}
+	}
+	if matched < minShould {
+		return false, 0, nil
+	}
+	if score == 0 {
+		score = 1
+	}
+	return true, score, nil
+}
+
+func matchTerm(idx *index, doc *document, field string, values []interface{}) (bool, float64, *esError) {
+	text := idx.fieldType(field) == "text"
+	for _, dv := range docValues(doc, field) {
+		for _, v := range values {
+			if equal(dv, v) {
+				return true, 1, nil
+			}
+			if s, ok := dv.(string); ok && text {
+				for _, token := range tokenize(s) {
+					if token == fmt.Sprint(v) {
+						return true, 1, nil
+					}
+				}
+			}
+		}
+	}
+	return false, 0, nil
+}
+
+func matchText(idx *index, doc *document, fields []string, text, operator, kind string) (bool, float64, *esError) {
+	queryTokens := tokenize(text)
+	if len(queryTokens) == 0 {
+		return false, 0, nil
+	}
+	best := 0.0
+	for _, field := range fields {
+		values := docValues(doc, field)
+		if t := idx.fieldType(field); t == "keyword" || t == "integer" || t == "long" || t == "date" {
+			for _, v := range values {
+				if equal(v, text) {
+					best = math.Max(best, 1)
+				}
+			}
+			continue
+		}
+		tokens := make(map[string]bool)
+		joined := make([]string, 0)
+		for _, v := range values {
+			for _, t := range tokenize(fmt.Sprint(v)) {
+				tokens[t] = true
+				joined = append(joined, t)
+			}
+		}
+		if kind != "match" {
+			//短语匹配要求词连续出现
+			if containsSequence(joined, queryTokens, kind == "match_phrase_prefix") {
+				best = math.Max(best, float64(len(queryTokens)))
+			}
+			continue
+		}
+		hit := 0
+		for _, t := range queryTokens {
+			if tokens[t] {
+				hit++
+			}
+		}
+		if hit == 0 || (strings.ToLower(operator) == "and" && hit < len(queryTokens)) {
+			continue
+		}
+		//命中词越多, 字段越短得分越高
+		score := float64(hit) + float64(hit)/float64(len(joined)+1)
+		best = math.Max(best, score)
+	}
+	return best > 0, best, nil
+}
+
+func containsSequence(tokens, seq []string, prefix bool) bool {
+	for i := 0; i+len(seq) <= len(tokens); i++ {
+		ok := true
+		for j, t := range seq {
+			last := j == len(seq)-1
+			if tokens[i+j] != t && !(prefix && last && strings.HasPrefix(tokens[i+j], t)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+//range查询, 同时支持 gt/gte/lt/lte 和 olivere 生成的 from/to/include_lower/include_upper
+func matchRange(doc *document, body interface{}) (bool, float64, *esError) {
+	field, params := fieldParams(body, "")
+	type bound struct {
+		value     interface{}
+		inclusive bool
+	}
+	var lower, upper *bound
+	if v, ok := params["from"]; ok && v != nil {
+		inc, has := params["include_lower"].(bool)
+		lower = &bound{v, !has || inc}
+	}
+	if v, ok := params["to"]; ok && v != nil {
+		inc, has := params["include_upper"].(bool)
+		upper = &bound{v, !has || inc}
+	}
+	if v, ok := params["gt"]; ok && v != nil {
+		lower = &bound{v, false}
+	}
+	if v, ok := params["gte"]; ok && v != nil {
+		lower = &bound{v, true}
+	}
+	if v, ok := params["lt"]; ok && v != nil {
+		upper = &bound{v, false}
+	}
+	if v, ok := params["lte"]; ok && v != nil {
+		upper = &bound{v, true}
+	}
+	for _, dv := range docValues(doc, field) {
+		if lower != nil {
+			c := compare(dv, lower.value)
+			if c < 0 || (c == 0 && !lower.inclusive) {
+				continue
+			}
+		}
+		if upper != nil {
+			c := compare(dv, upper.value)
+			if c > 0 || (c == 0 && !upper.inclusive) {
+				continue
+			}
+		}
+		return true, 1, nil
+	}
+	return false, 0, nil
+}
+
+var assignScript = regexp.MustCompile(`ctx\._source\.([\w.]+)\s*(\+?=)\s*([^;]+);?`)
+
+//只支持 ctx._source.x = params.y / 字面量 / += 这几种简单的painless脚本
+func applyScript(source map[string]interface{}, script interface{}) *esError {
+	var code string
+	params := map[string]interface{}{}
+	switch s := script.(type) {
+	case string:
+		code = s
+	case map[string]interface{}:
+		code, _ = s["source"].(string)
+		if code == "" {
+			code, _ = s["inline"].(string)
+		}
+		if p, ok := s["params"].(map[string]interface{}); ok {
+			params = p
+		}
+	}
+	stmts := assignScript.FindAllStringSubmatch(code, -1)
+	if len(stmts) == 0 && strings.TrimSpace(code) != "" {
+		return badRequest("estest: unsupported script [%s]", code)
+	}
+	for _, m := range stmts {
+		field, op, expr := m[1], m[2], strings.TrimSpace(m[3])
+		var value interface{}
+		if strings.HasPrefix(expr, "params.") {
+			value = params[strings.TrimPrefix(expr, "params.")]
+		} else if err := json.Unmarshal([]byte(expr), &value); err != nil {
+			return badRequest("estest: unsupported script expression [%s]", expr)
+		}
+		if op == "+=" {
+			old, _ := toFloat(source[field])
+			add, _ := toFloat(value)
+			value = old + add
+		}
+		source[field] = value
+	}
+	return nil
+}
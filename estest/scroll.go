@@ -0,0 +1,76 @@
+package estest
+
+import (
+	"net/http"
+)
+
+//一次滚动查询剩下的结果, 第一次查询时已经排好序, 之后不再受写入影响(和es的快照语义一致)
+type scrollContext struct {
+	hits  []*hit
+	next  int
+	size  int
+	total int
+	req   map[string]interface{}
+	specs []sortSpec
+}
+
+func scrollMissing(id string) *esError {
+	return &esError{status: http.StatusNotFound, typ: "search_context_missing_exception", reason: "No search context found for id [" + id + "]"}
+}
+
+//POST /_search/scroll {"scroll": "1m", "scroll_id": ".."}
+func (s *Server) scroll(body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	id, _ := req["scroll_id"].(string)
+	ctx, ok := s.scrolls[id]
+	if !ok {
+		return 0, scrollMissing(id)
+	}
+	page := make([]interface{}, 0)
+	for ; ctx.next < len(ctx.hits) && len(page) < ctx.size; ctx.next++ {
+		page = append(page, s.renderHit(ctx.hits[ctx.next], ctx.req, ctx.specs))
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_scroll_id": id,
+		"took":       1,
+		"timed_out":  false,
+		"_shards":    map[string]interface{}{"total": 1, "successful": 1, "skipped": 0, "failed": 0},
+		"hits": map[string]interface{}{
+			"total":     ctx.total,
+			"max_score": nil,
+			"hits":      page,
+		},
+	}
+}
+
+//DELETE /_search/scroll {"scroll_id": [".."]}
+func (s *Server) clearScroll(body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	freed := 0
+	for _, v := range asList(req["scroll_id"]) {
+		id, _ := v.(string)
+		if id == "_all" {
+			freed += len(s.scrolls)
+			s.scrolls = make(map[string]*scrollContext)
+			continue
+		}
+		if _, ok := s.scrolls[id]; ok {
+			delete(s.scrolls, id)
+			freed++
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": freed}
+}
+
+//还没有清理的滚动查询个数, 测试里检查导出结束后有没有清理
+func (s *Server) OpenScrolls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.scrolls)
+}
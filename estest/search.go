@@ -0,0 +1,381 @@
+package estest
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type hit struct {
+	idx   *index
+	doc   *document
+	score float64
+	sort  []interface{}
+}
+
+//排序字段
+type sortSpec struct {
+	field   string
+	desc    bool
+	missing interface{}
+	mode    string
+}
+
+func parseSort(v interface{}) ([]sortSpec, *esError) {
+	specs := make([]sortSpec, 0)
+	for _, item := range asList(v) {
+		switch s := item.(type) {
+		case string:
+			specs = append(specs, sortSpec{field: s, desc: s == "_score"})
+		case map[string]interface{}:
+			for field, opt := range s {
+				spec := sortSpec{field: field, desc: field == "_score"}
+				switch o := opt.(type) {
+				case string:
+					spec.desc = strings.ToLower(o) == "desc"
+				case map[string]interface{}:
+					if order, ok := o["order"].(string); ok {
+						spec.desc = strings.ToLower(order) == "desc"
+					}
+					spec.missing = o["missing"]
+					spec.mode, _ = o["mode"].(string)
+				}
+				if field == "_script" {
+					return nil, badRequest("estest: script sort is not supported")
+				}
+				specs = append(specs, spec)
+			}
+		default:
+			return nil, badRequest("malformed sort")
+		}
+	}
+	return specs, nil
+}
+
+func (h *hit) sortValue(spec sortSpec) interface{} {
+	switch spec.field {
+	case "_score":
+		return h.score
+	case "_id":
+		return h.doc.id
+	}
+	values := docValues(h.doc, spec.field)
+	if len(values) == 0 {
+		//missing 除了 _first/_last 也可以是代替的值
+		if spec.missing != nil && spec.missing != "_first" && spec.missing != "_last" {
+			return spec.missing
+		}
+		return nil
+	}
+	switch spec.mode {
+	case "sum", "avg", "median":
+		nums := make([]float64, 0, len(values))
+		for _, v := range values {
+			if f, ok := toFloat(v); ok {
+				nums = append(nums, f)
+			}
+		}
+		if len(nums) == 0 {
+			return nil
+		}
+		sort.Float64s(nums)
+		sum := 0.0
+		for _, f := range nums {
+			sum += f
+		}
+		switch spec.mode {
+		case "sum":
+			return sum
+		case "avg":
+			return sum / float64(len(nums))
+		}
+		if n := len(nums); n%2 == 0 {
+			return (nums[n/2-1] + nums[n/2]) / 2
+		}
+		return nums[len(nums)/2]
+	}
+	//数组字段默认升序取最小, 降序取最大, 和es默认的mode一致
+	max := spec.desc
+	if spec.mode != "" {
+		max = spec.mode == "max"
+	}
+	v := values[0]
+	for _, o := range values[1:] {
+		c := compare(o, v)
+		if (max && c > 0) || (!max && c < 0) {
+			v = o
+		}
+	}
+	return v
+}
+
+//比较两个命中的排序值, 缺失的值默认排最后
+func compareHits(a, b *hit, specs []sortSpec) int {
+	for i, spec := range specs {
+		va, vb := a.sort[i], b.sort[i]
+		if va == nil || vb == nil {
+			if va == nil && vb == nil {
+				continue
+			}
+			first := spec.missing == "_first"
+			if (va == nil) == first {
+				return -1
+			}
+			return 1
+		}
+		c := compare(va, vb)
+		if spec.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func intParam(req map[string]interface{}, key string, def int) int {
+	if v, ok := toFloat(req[key]); ok {
+		return int(v)
+	}
+	return def
+}
+
+//scroll 不为空时保留排好序的结果, 之后用 _scroll_id 继续取
+func (s *Server) search(expr string, body []byte, scroll string) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	indices, e := s.readable(expr)
+	if e != nil {
+		return 0, e
+	}
+	specs, e := parseSort(req["sort"])
+	if e != nil {
+		return 0, e
+	}
+
+	matched := make([]*hit, 0)
+	for _, idx := range indices {
+		for _, doc := range idx.all() {
+			ok, score, e := matches(idx, doc, req["query"])
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				matched = append(matched, &hit{idx: idx, doc: doc, score: score})
+			}
+		}
+	}
+
+	resp := map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+		"_shards":   map[string]interface{}{"total": len(indices), "successful": len(indices), "skipped": 0, "failed": 0},
+	}
+	if aggs := aggsParam(req); aggs != nil {
+		result, e := s.aggregate(matched, aggs)
+		if e != nil {
+			return 0, e
+		}
+		resp["aggregations"] = result
+	}
+
+	if sg, ok := req["suggest"].(map[string]interface{}); ok {
+		result, e := s.suggest(indices, sg)
+		if e != nil {
+			return 0, e
+		}
+		resp["suggest"] = result
+	}
+
+	//post_filter 只影响返回的命中, 不影响聚合
+	hits := matched
+	if pf, ok := req["post_filter"]; ok {
+		hits = make([]*hit, 0, len(matched))
+		for _, h := range matched {
+			ok, _, e := matches(h.idx, h.doc, pf)
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				hits = append(hits, h)
+			}
+		}
+	}
+
+	for _, h := range hits {
+		h.sort = make([]interface{}, len(specs))
+		for i, spec := range specs {
+			h.sort[i] = h.sortValue(spec)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if len(specs) == 0 {
+			return hits[i].score > hits[j].score
+		}
+		return compareHits(hits[i], hits[j], specs) < 0
+	})
+
+	total := len(hits)
+	//search_after 跳过排序值不大于给定值的命中
+	if after, ok := req["search_after"]; ok {
+		values := asList(after)
+		if len(values) != len(specs) {
+			return 0, badRequest("search_after has %d value(s) but sort has %d", len(values), len(specs))
+		}
+		cursor := &hit{sort: values}
+		rest := make([]*hit, 0, len(hits))
+		for _, h := range hits {
+			if compareHits(h, cursor, specs) > 0 {
+				rest = append(rest, h)
+			}
+		}
+		hits = rest
+	}
+
+	maxScore := 0.0
+	for _, h := range hits {
+		maxScore = math.Max(maxScore, h.score)
+	}
+	from := intParam(req, "from", 0)
+	size := intParam(req, "size", 10)
+	if from < len(hits) {
+		hits = hits[from:]
+	} else {
+		hits = nil
+	}
+	page := make([]interface{}, 0)
+	for i := 0; i < len(hits) && i < size; i++ {
+		page = append(page, s.renderHit(hits[i], req, specs))
+	}
+	if scroll != "" {
+		s.autoId++
+		id := fmt.Sprintf("scroll-%d", s.autoId)
+		s.scrolls[id] = &scrollContext{hits: hits, next: len(page), size: size, req: req, specs: specs, total: total}
+		resp["_scroll_id"] = id
+	}
+	resp["hits"] = map[string]interface{}{
+		"total":     total,
+		"max_score": maxScore,
+		"hits":      page,
+	}
+	return http.StatusOK, resp
+}
+
+func (s *Server) renderHit(h *hit, req map[string]interface{}, specs []sortSpec) map[string]interface{} {
+	item := map[string]interface{}{
+		"_index":  h.idx.name,
+		"_type":   h.doc.typ,
+		"_id":     h.doc.id,
+		"_score":  h.score,
+		"_source": h.doc.source,
+	}
+	if len(specs) > 0 {
+		item["sort"] = h.sort
+		if specs[0].field != "_score" {
+			item["_score"] = nil
+		}
+	}
+	if hl, ok := req["highlight"].(map[string]interface{}); ok {
+		if fragments := highlight(h.doc, hl, req["query"]); len(fragments) > 0 {
+			item["highlight"] = fragments
+		}
+	}
+	return item
+}
+
+//简单的高亮: 把查询词在字段里出现的位置用标签包起来, 整个字段作为一个片段返回
+func highlight(doc *document, hl map[string]interface{}, query interface{}) map[string][]string {
+	pre, post := "<em>", "</em>"
+	if tags := asList(hl["pre_tags"]); len(tags) > 0 {
+		pre = fmt.Sprint(tags[0])
+	}
+	if tags := asList(hl["post_tags"]); len(tags) > 0 {
+		post = fmt.Sprint(tags[0])
+	}
+	terms := queryTerms(query)
+	result := make(map[string][]string)
+	fields, _ := hl["fields"].(map[string]interface{})
+	for field := range fields {
+		for _, v := range docValues(doc, field) {
+			text, ok := v.(string)
+			if !ok {
+				continue
+			}
+			marked, hit := markTerms(text, terms, pre, post)
+			if hit {
+				result[field] = append(result[field], marked)
+			}
+		}
+	}
+	return result
+}
+
+//收集查询里出现的全文检索词
+func queryTerms(query interface{}) map[string]bool {
+	terms := make(map[string]bool)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			for k, sub := range val {
+				if k == "query" || k == "value" {
+					if s, ok := sub.(string); ok {
+						for _, t := range tokenize(s) {
+							terms[t] = true
+						}
+						continue
+					}
+				}
+				if k == "match" || k == "match_phrase" || k == "term" {
+					if m, ok := sub.(map[string]interface{}); ok {
+						for _, fv := range m {
+							if s, ok := fv.(string); ok {
+								for _, t := range tokenize(s) {
+									terms[t] = true
+								}
+							}
+						}
+					}
+				}
+				walk(sub)
+			}
+		case []interface{}:
+			for _, sub := range val {
+				walk(sub)
+			}
+		}
+	}
+	walk(query)
+	return terms
+}
+
+func markTerms(text string, terms map[string]bool, pre, post string) (string, bool) {
+	var b strings.Builder
+	hit := false
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		matched := 0
+		for t := range terms {
+			tr := []rune(t)
+			if len(tr) > matched && i+len(tr) <= len(runes) && strings.ToLower(string(runes[i:i+len(tr)])) == t {
+				matched = len(tr)
+			}
+		}
+		if matched > 0 {
+			b.WriteString(pre)
+			b.WriteString(string(runes[i : i+matched]))
+			b.WriteString(post)
+			i += matched
+			hit = true
+			continue
+		}
+		b.WriteRune(runes[i])
+		i++
+	}
+	return b.String(), hit
+}
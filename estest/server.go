@@ -0,0 +1,842 @@
+//estest 是一个基于httptest的es6假服务, 只实现了 goes 和 main 的handler用到的那部分rest接口,
+//数据全部放在内存里, 写入后立即可查(相当于每次都refresh), 用来在没有es节点的环境跑测试
+package estest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const Version = "6.8.0"
+
+type document struct {
+	id      string
+	typ     string
+	source  map[string]interface{}
+	version int64
+	seqNo   int64
+}
+
+type index struct {
+	name     string
+	mappings map[string]interface{}
+	settings map[string]interface{}
+	docs     map[string]*document
+	order    []string //插入顺序, 保证没有排序时结果稳定
+	seqNo    int64
+	aliases  map[string]bool
+	closed   bool
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	indices map[string]*index
+	autoId  int64
+	scrolls map[string]*scrollContext
+	health  string
+	//接下来多少个 bulk 条目返回 429
+	rejectBulk int
+}
+
+func NewServer() *Server {
+	s := &Server{indices: make(map[string]*index), scrolls: make(map[string]*scrollContext)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+//es返回的错误格式, olivere会解析成 *elastic.Error
+type esError struct {
+	status  int
+	typ     string
+	reason  string
+	index   string
+	details map[string]interface{}
+}
+
+func (e *esError) Error() string {
+	return e.typ + ": " + e.reason
+}
+
+func (e *esError) body() map[string]interface{} {
+	cause := map[string]interface{}{"type": e.typ, "reason": e.reason}
+	if e.index != "" {
+		cause["index"] = e.index
+	}
+	for k, v := range e.details {
+		cause[k] = v
+	}
+	errBody := map[string]interface{}{"root_cause": []interface{}{cause}}
+	for k, v := range cause {
+		errBody[k] = v
+	}
+	return map[string]interface{}{"error": errBody, "status": e.status}
+}
+
+func badRequest(format string, args ...interface{}) *esError {
+	return &esError{status: http.StatusBadRequest, typ: "parsing_exception", reason: fmt.Sprintf(format, args...)}
+}
+
+func indexNotFound(name string) *esError {
+	return &esError{status: http.StatusNotFound, typ: "index_not_found_exception", reason: "no such index", index: name}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, badRequest("%v", err).body())
+		return
+	}
+	s.mu.Lock()
+	status, resp := s.route(r, body)
+	s.mu.Unlock()
+
+	if e, ok := resp.(*esError); ok {
+		status, resp = e.status, e.body()
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, resp)
+}
+
+func (s *Server) route(r *http.Request, body []byte) (int, interface{}) {
+	//和es一样按转义后的路径分段, id 里的 %2F 不会被当成分隔符
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, p := range parts {
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			parts[i] = unescaped
+		}
+	}
+	if len(parts) == 1 && parts[0] == "" {
+		parts = nil
+	}
+	method := r.Method
+	switch {
+	case len(parts) == 0:
+		return http.StatusOK, s.info()
+	case len(parts) == 2 && parts[0] == "_cluster" && parts[1] == "health":
+		return http.StatusOK, s.clusterHealth()
+	case len(parts) == 1 && parts[0] == "_bulk":
+		return s.bulk("", body)
+	case len(parts) == 1 && parts[0] == "_search":
+		return s.search("_all", body, r.URL.Query().Get("scroll"))
+	case len(parts) == 2 && parts[0] == "_search" && parts[1] == "scroll":
+		if method == http.MethodDelete {
+			return s.clearScroll(body)
+		}
+		return s.scroll(body)
+	case len(parts) == 1 && parts[0] == "_refresh":
+		return http.StatusOK, shards()
+	case len(parts) == 1 && parts[0] == "_aliases" && method == http.MethodPost:
+		return s.updateAliases(body)
+	case len(parts) == 1 && parts[0] == "_reindex" && method == http.MethodPost:
+		return s.reindex(body)
+	case parts[0] == "_alias" && len(parts) <= 2 && method == http.MethodGet:
+		return s.getAliases("", strings.Join(parts[1:], ""))
+	case len(parts) >= 2 && parts[1] == "_alias" && len(parts) <= 3 && method == http.MethodGet:
+		return s.getAliases(parts[0], strings.Join(parts[2:], ""))
+	case len(parts) == 1:
+		switch method {
+		case http.MethodPut:
+			return s.createIndex(parts[0], body)
+		case http.MethodHead:
+			return s.indexExists(parts[0])
+		case http.MethodDelete:
+			return s.deleteIndex(parts[0])
+		case http.MethodGet:
+			return s.getIndex(parts[0])
+		}
+	case len(parts) >= 2 && parts[1] == "_mapping" && method == http.MethodGet:
+		//olivere 会请求 /index/_mapping/_all
+		return s.getMapping(parts[0])
+	case len(parts) >= 2 && parts[1] == "_settings" && method == http.MethodGet:
+		return s.getSettings(parts[0])
+	case len(parts) == 2 && parts[1] == "_settings" && method == http.MethodPut:
+		return s.putSettings(parts[0], body)
+	case len(parts) == 2 && parts[1] == "_close" && method == http.MethodPost:
+		return s.setClosed(parts[0], true)
+	case len(parts) == 2 && parts[1] == "_open" && method == http.MethodPost:
+		return s.setClosed(parts[0], false)
+	case len(parts) >= 2 && actions[parts[len(parts)-1]]:
+		//带type的 /index/type/_search 等价于 /index/_search
+		name, action := parts[0], parts[len(parts)-1]
+		if len(parts) == 4 && action == "_update" {
+			return s.updateDoc(parts[0], parts[1], parts[2], body, r.URL.Query())
+		}
+		if len(parts) == 4 && action == "_create" {
+			return s.indexDoc(parts[0], parts[1], parts[2], body, "create", r.URL.Query())
+		}
+		switch action {
+		case "_search":
+			return s.search(name, body, r.URL.Query().Get("scroll"))
+		case "_count":
+			return s.count(name, body)
+		case "_bulk":
+			return s.bulk(name, body)
+		case "_refresh", "_flush":
+			return http.StatusOK, shards()
+		case "_mapping":
+			return s.getMapping(name)
+		case "_settings":
+			return s.getSettings(name)
+		case "_update_by_query":
+			return s.updateByQuery(name, body)
+		case "_delete_by_query":
+			return s.deleteByQuery(name, body)
+		}
+	case len(parts) == 2 && method == http.MethodPost:
+		return s.indexDoc(parts[0], parts[1], "", body, r.URL.Query().Get("op_type"), r.URL.Query())
+	case len(parts) == 3:
+		switch method {
+		case http.MethodPut, http.MethodPost:
+			return s.indexDoc(parts[0], parts[1], parts[2], body, r.URL.Query().Get("op_type"), r.URL.Query())
+		case http.MethodGet, http.MethodHead:
+			return s.getDoc(parts[0], parts[1], parts[2])
+		case http.MethodDelete:
+			return s.deleteDoc(parts[0], parts[1], parts[2], r.URL.Query())
+		}
+	}
+	return 0, &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception",
+		reason: fmt.Sprintf("estest: unsupported request %s %s", method, r.URL.Path)}
+}
+
+//路径最后一段是这些名字时当接口处理, 其它 _ 开头的段是文档 id
+var actions = map[string]bool{"_update": true, "_create": true, "_search": true, "_count": true, "_bulk": true,
+	"_refresh": true, "_flush": true, "_mapping": true, "_settings": true, "_update_by_query": true, "_delete_by_query": true}
+
+func shards() map[string]interface{} {
+	return map[string]interface{}{"_shards": map[string]interface{}{"total": 1, "successful": 1, "failed": 0}}
+}
+
+func (s *Server) info() map[string]interface{} {
+	return map[string]interface{}{
+		"name":         "estest",
+		"cluster_name": "estest",
+		"version": map[string]interface{}{
+			"number":         Version,
+			"lucene_version": "7.7.0",
+		},
+		"tagline": "You Know, for Search",
+	}
+}
+
+//把逗号分隔, 支持通配符的索引名展开成实际的索引
+func (s *Server) resolve(expr string) ([]*index, *esError) {
+	result := make([]*index, 0)
+	for _, name := range strings.Split(expr, ",") {
+		if name == "_all" || strings.ContainsAny(name, "*?") {
+			if name == "_all" {
+				name = "*"
+			}
+			for _, n := range s.sortedNames() {
+				if ok, _ := path.Match(name, n); ok {
+					result = append(result, s.indices[n])
+				}
+			}
+			continue
+		}
+		if idx, ok := s.indices[name]; ok {
+			result = append(result, idx)
+			continue
+		}
+		aliased := s.aliasIndices(name)
+		if len(aliased) == 0 {
+			return nil, indexNotFound(name)
+		}
+		result = append(result, aliased...)
+	}
+	return result, nil
+}
+
+func (s *Server) sortedNames() []string {
+	names := make([]string, 0, len(s.indices))
+	for n := range s.indices {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func decodeBody(body []byte) (map[string]interface{}, *esError) {
+	m := make(map[string]interface{})
+	if len(bytes.TrimSpace(body)) == 0 {
+		return m, nil
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, badRequest("failed to parse request body: %v", err)
+	}
+	return m, nil
+}
+
+func (s *Server) newIndex(name string) *index {
+	idx := &index{
+		name:     name,
+		mappings: make(map[string]interface{}),
+		settings: make(map[string]interface{}),
+		docs:     make(map[string]*document),
+		aliases:  make(map[string]bool),
+	}
+	s.indices[name] = idx
+	return idx
+}
+
+func (s *Server) createIndex(name string, body []byte) (int, interface{}) {
+	if _, ok := s.indices[name]; ok {
+		return 0, &esError{status: http.StatusBadRequest, typ: "resource_already_exists_exception",
+			reason: fmt.Sprintf("index [%s] already exists", name), index: name}
+	}
+	if len(s.aliasIndices(name)) > 0 {
+		return 0, &esError{status: http.StatusBadRequest, typ: "invalid_index_name_exception",
+			reason: fmt.Sprintf("Invalid index name [%s], already exists as alias", name), index: name}
+	}
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	idx := s.newIndex(name)
+	if m, ok := req["mappings"].(map[string]interface{}); ok {
+		idx.mappings = m
+	}
+	if st, ok := req["settings"].(map[string]interface{}); ok {
+		idx.settings = st
+		//{"index": {...}} 和直接写是一样的
+		if nested, ok := st["index"].(map[string]interface{}); ok {
+			delete(st, "index")
+			for k, v := range nested {
+				st[k] = v
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": name}
+}
+
+func (s *Server) indexExists(expr string) (int, interface{}) {
+	if _, e := s.resolve(expr); e != nil {
+		return http.StatusNotFound, nil
+	}
+	return http.StatusOK, nil
+}
+
+func (s *Server) deleteIndex(expr string) (int, interface{}) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	for _, idx := range indices {
+		delete(s.indices, idx.name)
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+func (s *Server) getIndex(expr string) (int, interface{}) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	resp := make(map[string]interface{})
+	for _, idx := range indices {
+		aliases := make(map[string]interface{})
+		for alias := range idx.aliases {
+			aliases[alias] = map[string]interface{}{}
+		}
+		resp[idx.name] = map[string]interface{}{
+			"aliases":  aliases,
+			"mappings": idx.mappings,
+			"settings": map[string]interface{}{"index": idx.settings},
+		}
+	}
+	return http.StatusOK, resp
+}
+
+func (s *Server) getMapping(expr string) (int, interface{}) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	resp := make(map[string]interface{})
+	for _, idx := range indices {
+		resp[idx.name] = map[string]interface{}{"mappings": idx.mappings}
+	}
+	return http.StatusOK, resp
+}
+
+//按索引名或者只指向一个索引的别名找到索引, 单文档读写用
+func (s *Server) lookup(name string) (*index, *esError) {
+	if idx, ok := s.indices[name]; ok {
+		if idx.closed {
+			return nil, indexClosed(name)
+		}
+		return idx, nil
+	}
+	aliased := s.aliasIndices(name)
+	switch len(aliased) {
+	case 0:
+		return nil, indexNotFound(name)
+	case 1:
+		if aliased[0].closed {
+			return nil, indexClosed(aliased[0].name)
+		}
+		return aliased[0], nil
+	}
+	return nil, badRequest("alias [%s] has more than one indices associated with it, can't execute a single index op", name)
+}
+
+//es返回的settings里数值都是字符串, 没设置的分片数用默认值
+func (s *Server) getSettings(expr string) (int, interface{}) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	resp := make(map[string]interface{})
+	for _, idx := range indices {
+		settings := map[string]interface{}{
+			"number_of_shards":   "5",
+			"number_of_replicas": "1",
+			"provided_name":      idx.name,
+		}
+		for k, v := range stringify(idx.settings).(map[string]interface{}) {
+			settings[k] = v
+		}
+		resp[idx.name] = map[string]interface{}{"settings": map[string]interface{}{"index": settings}}
+	}
+	return http.StatusOK, resp
+}
+
+func stringify(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = stringify(v)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, v := range t {
+			list[i] = stringify(v)
+		}
+		return list
+	case nil:
+		return nil
+	}
+	return fmt.Sprint(v)
+}
+
+//写入时索引不存在则自动创建, 和es默认行为一致
+func (s *Server) writableIndex(name string) (*index, *esError) {
+	idx, e := s.lookup(name)
+	if e != nil && e.typ == "index_not_found_exception" {
+		return s.newIndex(name), nil
+	}
+	if e == nil {
+		e = idx.writeBlock()
+	}
+	return idx, e
+}
+
+func (s *Server) nextId() string {
+	s.autoId++
+	return "auto_" + strconv.FormatInt(s.autoId, 10)
+}
+
+func docMeta(idx *index, doc *document) map[string]interface{} {
+	return map[string]interface{}{
+		"_index":        idx.name,
+		"_type":         doc.typ,
+		"_id":           doc.id,
+		"_version":      doc.version,
+		"_seq_no":       doc.seqNo,
+		"_primary_term": 1,
+		"_shards":       map[string]interface{}{"total": 1, "successful": 1, "failed": 0},
+	}
+}
+
+func (s *Server) put(idx *index, typ, id string, source map[string]interface{}, opType string) (int, map[string]interface{}, *esError) {
+	if id == "" {
+		id = s.nextId()
+	}
+	old, exists := idx.docs[id]
+	if exists && opType == "create" {
+		return 0, nil, &esError{status: http.StatusConflict, typ: "version_conflict_engine_exception",
+			reason: fmt.Sprintf("[%s][%s]: version conflict, document already exists (current version [%d])", typ, id, old.version),
+			index:  idx.name}
+	}
+	if err := idx.checkSource(source); err != nil {
+		return 0, nil, err
+	}
+	idx.seqNo++
+	doc := &document{id: id, typ: typ, source: source, version: 1, seqNo: idx.seqNo}
+	status, result := http.StatusCreated, "created"
+	if exists {
+		doc.version = old.version + 1
+		status, result = http.StatusOK, "updated"
+	} else {
+		idx.order = append(idx.order, id)
+	}
+	idx.docs[id] = doc
+	meta := docMeta(idx, doc)
+	meta["result"] = result
+	return status, meta, nil
+}
+
+func (s *Server) remove(idx *index, id string) (int, map[string]interface{}) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		meta := docMeta(idx, &document{id: id, typ: "doc", version: 1})
+		meta["result"] = "not_found"
+		return http.StatusNotFound, meta
+	}
+	delete(idx.docs, id)
+	for i, o := range idx.order {
+		if o == id {
+			idx.order = append(idx.order[:i], idx.order[i+1:]...)
+			break
+		}
+	}
+	idx.seqNo++
+	doc.version++
+	doc.seqNo = idx.seqNo
+	meta := docMeta(idx, doc)
+	meta["result"] = "deleted"
+	return http.StatusOK, meta
+}
+
+func (s *Server) indexDoc(name, typ, id string, body []byte, opType string, params url.Values) (int, interface{}) {
+	source, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	cond, e := parseCondition(params)
+	if e != nil {
+		return 0, e
+	}
+	idx, e := s.writableIndex(name)
+	if e != nil {
+		return 0, e
+	}
+	if e := cond.check(idx, typ, id); e != nil {
+		return 0, e
+	}
+	status, meta, e := s.put(idx, typ, id, source, opType)
+	if e != nil {
+		return 0, e
+	}
+	cond.apply(idx, meta["_id"].(string), meta)
+	return status, meta
+}
+
+func (s *Server) getDoc(name, typ, id string) (int, interface{}) {
+	idx, e := s.lookup(name)
+	if e != nil {
+		return 0, e
+	}
+	doc, ok := idx.docs[id]
+	if !ok {
+		return http.StatusNotFound, map[string]interface{}{"_index": idx.name, "_type": typ, "_id": id, "found": false}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_index":        idx.name,
+		"_type":         doc.typ,
+		"_id":           id,
+		"_version":      doc.version,
+		"_seq_no":       doc.seqNo,
+		"_primary_term": 1,
+		"found":         true,
+		"_source":       doc.source,
+	}
+}
+
+func (s *Server) deleteDoc(name, typ, id string, params url.Values) (int, interface{}) {
+	cond, e := parseCondition(params)
+	if e != nil {
+		return 0, e
+	}
+	idx, e := s.lookup(name)
+	if e == nil {
+		e = idx.writeBlock()
+	}
+	if e != nil {
+		return 0, e
+	}
+	if e := cond.check(idx, typ, id); e != nil {
+		return 0, e
+	}
+	status, meta := s.remove(idx, id)
+	return status, meta
+}
+
+//局部更新, 只支持 doc 合并和 doc_as_upsert
+func (s *Server) updateDoc(name, typ, id string, body []byte, params url.Values) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	cond, e := parseCondition(params)
+	if e != nil {
+		return 0, e
+	}
+	idx, e := s.writableIndex(name)
+	if e != nil {
+		return 0, e
+	}
+	if e := cond.check(idx, typ, id); e != nil {
+		return 0, e
+	}
+	status, meta, e := s.update(idx, typ, id, req)
+	if e != nil {
+		return 0, e
+	}
+	return status, meta
+}
+
+func (s *Server) update(idx *index, typ, id string, req map[string]interface{}) (int, map[string]interface{}, *esError) {
+	partial, _ := req["doc"].(map[string]interface{})
+	old, ok := idx.docs[id]
+	if !ok {
+		upsert, isUpsert := req["upsert"].(map[string]interface{})
+		if asUpsert, _ := req["doc_as_upsert"].(bool); asUpsert {
+			upsert, isUpsert = partial, true
+		}
+		if !isUpsert {
+			return 0, nil, &esError{status: http.StatusNotFound, typ: "document_missing_exception",
+				reason: fmt.Sprintf("[%s][%s]: document missing", typ, id), index: idx.name}
+		}
+		return s.put(idx, typ, id, upsert, "create")
+	}
+	source := make(map[string]interface{}, len(old.source))
+	for k, v := range old.source {
+		source[k] = v
+	}
+	if script, ok := req["script"]; ok {
+		if e := applyScript(source, script); e != nil {
+			return 0, nil, e
+		}
+	}
+	for k, v := range partial {
+		source[k] = v
+	}
+	status, meta, e := s.put(idx, old.typ, id, source, "index")
+	if e != nil {
+		return 0, nil, e
+	}
+	return status, meta, nil
+}
+
+func (s *Server) bulk(defaultIndex string, body []byte) (int, interface{}) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	items := make([]interface{}, 0)
+	hasErrors := false
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return 0, badRequest("malformed action/metadata line")
+		}
+		for op, meta := range action {
+			name, _ := meta["_index"].(string)
+			if name == "" {
+				name = defaultIndex
+			}
+			typ, _ := meta["_type"].(string)
+			id := fmt.Sprint(valueOr(meta["_id"], ""))
+
+			var source map[string]interface{}
+			if op != "delete" {
+				if !scanner.Scan() {
+					return 0, badRequest("bulk action [%s] is missing its source", op)
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &source); err != nil {
+					return 0, badRequest("failed to parse bulk source: %v", err)
+				}
+			}
+
+			switch op {
+			case "index", "create", "update", "delete":
+			default:
+				return 0, badRequest("unknown bulk action [%s]", op)
+			}
+			var status int
+			var result map[string]interface{}
+			var cond *writeCondition
+			idx, e := s.writableIndex(name)
+			if e == nil && s.rejectBulk > 0 {
+				s.rejectBulk--
+				e = &esError{status: http.StatusTooManyRequests, typ: "es_rejected_execution_exception",
+					reason: "rejected execution of bulk item", index: name}
+			}
+			if e == nil {
+				cond, e = parseCondition(bulkParams(meta))
+			}
+			if e == nil {
+				e = cond.check(idx, typ, id)
+			}
+			switch {
+			case e != nil:
+			case op == "index" || op == "create":
+				status, result, e = s.put(idx, typ, id, source, op)
+				if e == nil {
+					cond.apply(idx, result["_id"].(string), result)
+				}
+			case op == "update":
+				status, result, e = s.update(idx, typ, id, source)
+			case op == "delete":
+				status, result = s.remove(idx, id)
+			}
+			if e != nil {
+				hasErrors = true
+				status = e.status
+				result = map[string]interface{}{"_index": name, "_type": typ, "_id": id,
+					"error": map[string]interface{}{"type": e.typ, "reason": e.reason}}
+			}
+			result["status"] = status
+			items = append(items, map[string]interface{}{op: result})
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"took": 1, "errors": hasErrors, "items": items}
+}
+
+//bulk 的 action 行里的乐观锁参数, 和单文档接口的 url 参数同名
+func bulkParams(meta map[string]interface{}) url.Values {
+	params := make(url.Values)
+	for _, name := range []string{"version", "version_type", "if_seq_no", "if_primary_term"} {
+		if v, ok := meta[name]; ok {
+			params.Set(name, fmt.Sprint(v))
+		}
+	}
+	return params
+}
+
+func valueOr(v interface{}, def interface{}) interface{} {
+	if v == nil {
+		return def
+	}
+	return v
+}
+
+//返回索引中按插入顺序排列的文档
+func (idx *index) all() []*document {
+	docs := make([]*document, 0, len(idx.order))
+	for _, id := range idx.order {
+		docs = append(docs, idx.docs[id])
+	}
+	return docs
+}
+
+func (s *Server) count(expr string, body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	indices, e := s.readable(expr)
+	if e != nil {
+		return 0, e
+	}
+	var n int64
+	for _, idx := range indices {
+		for _, doc := range idx.all() {
+			ok, _, e := matches(idx, doc, req["query"])
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				n++
+			}
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"count": n, "_shards": shards()["_shards"]}
+}
+
+func (s *Server) updateByQuery(expr string, body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	var updated int64
+	for _, idx := range indices {
+		for _, doc := range idx.all() {
+			ok, _, e := matches(idx, doc, req["query"])
+			if e != nil {
+				return 0, e
+			}
+			if !ok {
+				continue
+			}
+			if script, has := req["script"]; has {
+				if e := applyScript(doc.source, script); e != nil {
+					return 0, e
+				}
+			}
+			idx.seqNo++
+			doc.version++
+			doc.seqNo = idx.seqNo
+			updated++
+		}
+	}
+	return http.StatusOK, byQueryResponse(updated, "updated")
+}
+
+func (s *Server) deleteByQuery(expr string, body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	var deleted int64
+	for _, idx := range indices {
+		for _, doc := range idx.all() {
+			ok, _, e := matches(idx, doc, req["query"])
+			if e != nil {
+				return 0, e
+			}
+			if ok {
+				s.remove(idx, doc.id)
+				deleted++
+			}
+		}
+	}
+	return http.StatusOK, byQueryResponse(deleted, "deleted")
+}
+
+func byQueryResponse(n int64, field string) map[string]interface{} {
+	return map[string]interface{}{
+		"took":              1,
+		"timed_out":         false,
+		"total":             n,
+		field:               n,
+		"batches":           1,
+		"version_conflicts": 0,
+		"noops":             0,
+		"failures":          []interface{}{},
+	}
+}
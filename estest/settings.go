@@ -0,0 +1,94 @@
+package estest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func indexClosed(name string) *esError {
+	return &esError{status: http.StatusBadRequest, typ: "index_closed_exception", reason: "closed", index: name}
+}
+
+//搜索和计数不能用在关闭的索引上
+func (s *Server) readable(expr string) ([]*index, *esError) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return nil, e
+	}
+	for _, idx := range indices {
+		if idx.closed {
+			return nil, indexClosed(idx.name)
+		}
+	}
+	return indices, nil
+}
+
+//index.blocks.write 为 true 时拒绝写入
+func (idx *index) writeBlock() *esError {
+	blocks, _ := idx.settings["blocks"].(map[string]interface{})
+	if blocked, _ := blocks["write"].(bool); blocked {
+		return &esError{status: http.StatusForbidden, typ: "cluster_block_exception",
+			reason: fmt.Sprintf("index [%s] blocked by: [FORBIDDEN/8/index write (api)];", idx.name), index: idx.name}
+	}
+	return nil
+}
+
+func (s *Server) setClosed(expr string, closed bool) (int, interface{}) {
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	for _, idx := range indices {
+		idx.closed = closed
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true}
+}
+
+//动态设置可以直接改, analysis 只能在索引关闭时改, 分片数不能改
+func (s *Server) putSettings(expr string, body []byte) (int, interface{}) {
+	req, e := decodeBody(body)
+	if e != nil {
+		return 0, e
+	}
+	if nested, ok := req["index"].(map[string]interface{}); ok {
+		delete(req, "index")
+		for k, v := range nested {
+			req[k] = v
+		}
+	}
+	indices, e := s.resolve(expr)
+	if e != nil {
+		return 0, e
+	}
+	for key := range req {
+		switch {
+		case key == "number_of_shards":
+			return 0, &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception",
+				reason: "final index setting [index.number_of_shards], not updateable"}
+		case key == "analysis" || strings.HasPrefix(key, "analysis."):
+			for _, idx := range indices {
+				if !idx.closed {
+					return 0, &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception",
+						reason: fmt.Sprintf("Can't update non dynamic settings [[index.%s]] for open indices [[%s]]", key, idx.name)}
+				}
+			}
+		}
+	}
+	for _, idx := range indices {
+		merge(idx.settings, req)
+	}
+	return http.StatusOK, map[string]interface{}{"acknowledged": true}
+}
+
+//按层合并, 叶子节点直接覆盖
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sub, ok := v.(map[string]interface{})
+		if old, isMap := dst[k].(map[string]interface{}); ok && isMap {
+			merge(old, sub)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,201 @@
+package estest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//completion 字段里的一条输入
+type completionEntry struct {
+	input    string
+	weight   float64
+	contexts map[string][]string
+}
+
+//文档里 completion 字段的值: 字符串, 字符串数组, 或者 {"input": .., "weight": .., "contexts": {..}}
+func completionEntries(doc *document, field string) []completionEntry {
+	values := sourceValues(doc.source, field)
+	if values == nil {
+		//子字段(如 suggest.pinyin)用父字段的输入
+		if i := strings.LastIndex(field, "."); i > 0 {
+			values = sourceValues(doc.source, field[:i])
+		}
+	}
+	entries := make([]completionEntry, 0)
+	for _, v := range values {
+		switch val := v.(type) {
+		case string:
+			entries = append(entries, completionEntry{input: val, weight: 1})
+		case map[string]interface{}:
+			weight := 1.0
+			if w, ok := toFloat(val["weight"]); ok {
+				weight = w
+			}
+			contexts := make(map[string][]string)
+			if c, ok := val["contexts"].(map[string]interface{}); ok {
+				for name, cv := range c {
+					for _, item := range asList(cv) {
+						contexts[name] = append(contexts[name], fmt.Sprint(item))
+					}
+				}
+			}
+			for _, input := range asList(val["input"]) {
+				entries = append(entries, completionEntry{input: fmt.Sprint(input), weight: weight, contexts: contexts})
+			}
+		}
+	}
+	return entries
+}
+
+//和 fieldValues 一样按路径取值, 但是保留对象形式的值
+func sourceValues(source map[string]interface{}, field string) []interface{} {
+	var cur interface{} = source
+	for _, p := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = m[p]; !ok {
+			return nil
+		}
+	}
+	if cur == nil {
+		return nil
+	}
+	return asList(cur)
+}
+
+//按前缀匹配 completion 字段, 得分是权重乘以上下文的boost, 不支持fuzzy和regex
+func (s *Server) suggest(indices []*index, body map[string]interface{}) (map[string]interface{}, *esError) {
+	result := make(map[string]interface{})
+	for name, v := range body {
+		sg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		completion, ok := sg["completion"].(map[string]interface{})
+		if !ok {
+			return nil, badRequest("suggester [%s] is not supported, only completion", name)
+		}
+		prefix, _ := sg["prefix"].(string)
+		if prefix == "" {
+			prefix, _ = sg["text"].(string)
+		}
+		field, _ := completion["field"].(string)
+		size := intParam(completion, "size", 5)
+		skipDuplicates, _ := completion["skip_duplicates"].(bool)
+		queryContexts := parseContexts(completion["contexts"])
+
+		type option struct {
+			idx   *index
+			doc   *document
+			text  string
+			score float64
+		}
+		options := make([]option, 0)
+		lower := strings.ToLower(prefix)
+		for _, idx := range indices {
+			for _, doc := range idx.all() {
+				//每个文档只返回得分最高的一条输入
+				best := option{score: -1}
+				for _, entry := range completionEntries(doc, field) {
+					if !strings.HasPrefix(strings.ToLower(entry.input), lower) {
+						continue
+					}
+					boost, ok := contextBoost(queryContexts, entry.contexts)
+					if !ok {
+						continue
+					}
+					if score := entry.weight * boost; score > best.score {
+						best = option{idx: idx, doc: doc, text: entry.input, score: score}
+					}
+				}
+				if best.doc != nil {
+					options = append(options, best)
+				}
+			}
+		}
+		sort.SliceStable(options, func(i, j int) bool {
+			if options[i].score != options[j].score {
+				return options[i].score > options[j].score
+			}
+			return options[i].text < options[j].text
+		})
+
+		rendered := make([]interface{}, 0)
+		seen := make(map[string]bool)
+		for _, o := range options {
+			if len(rendered) >= size {
+				break
+			}
+			if skipDuplicates && seen[o.text] {
+				continue
+			}
+			seen[o.text] = true
+			rendered = append(rendered, map[string]interface{}{
+				"text":    o.text,
+				"_index":  o.idx.name,
+				"_type":   o.doc.typ,
+				"_id":     o.doc.id,
+				"_score":  o.score,
+				"_source": o.doc.source,
+			})
+		}
+		result[name] = []interface{}{map[string]interface{}{
+			"text":    prefix,
+			"offset":  0,
+			"length":  utf8.RuneCountInString(prefix),
+			"options": rendered,
+		}}
+	}
+	return result, nil
+}
+
+//查询里的上下文: {"categoryId": [{"context": "1", "boost": 2}, "3"]}, 值 => boost
+func parseContexts(v interface{}) map[string]map[string]float64 {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	contexts := make(map[string]map[string]float64)
+	for name, cv := range m {
+		values := make(map[string]float64)
+		for _, item := range asList(cv) {
+			switch c := item.(type) {
+			case map[string]interface{}:
+				boost := 1.0
+				if b, ok := toFloat(c["boost"]); ok {
+					boost = b
+				}
+				values[fmt.Sprint(c["context"])] = boost
+			default:
+				values[fmt.Sprint(c)] = 1
+			}
+		}
+		contexts[name] = values
+	}
+	return contexts
+}
+
+//有上下文条件时文档至少要命中一个值, 返回命中值里最大的boost
+func contextBoost(query map[string]map[string]float64, doc map[string][]string) (float64, bool) {
+	boost := 1.0
+	for name, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		matched := 0.0
+		for _, v := range doc[name] {
+			if b, ok := values[v]; ok && b > matched {
+				matched = b
+			}
+		}
+		if matched == 0 {
+			return 0, false
+		}
+		boost *= matched
+	}
+	return boost, true
+}
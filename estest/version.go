@@ -0,0 +1,98 @@
+package estest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//单文档写请求的乐观锁参数: version(version_type=external 时是外部版本号) 或者 if_seq_no/if_primary_term
+type writeCondition struct {
+	version       *int64
+	external      bool
+	ifSeqNo       *int64
+	ifPrimaryTerm *int64
+}
+
+func parseCondition(params url.Values) (*writeCondition, *esError) {
+	c := &writeCondition{}
+	parse := func(name string) (*int64, *esError) {
+		v := params.Get(name)
+		if v == "" {
+			return nil, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception",
+				reason: fmt.Sprintf("failed to parse [%s] with value [%s]", name, v)}
+		}
+		return &n, nil
+	}
+	var e *esError
+	if c.version, e = parse("version"); e != nil {
+		return nil, e
+	}
+	if c.ifSeqNo, e = parse("if_seq_no"); e != nil {
+		return nil, e
+	}
+	if c.ifPrimaryTerm, e = parse("if_primary_term"); e != nil {
+		return nil, e
+	}
+	switch params.Get("version_type") {
+	case "", "internal":
+	case "external", "external_gt":
+		c.external = true
+	default:
+		return nil, badRequest("version type [%s] is not supported", params.Get("version_type"))
+	}
+	if (c.ifSeqNo == nil) != (c.ifPrimaryTerm == nil) {
+		return nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: ifSeqNo is set, but primary term is [0];"}
+	}
+	if c.external && c.version == nil {
+		return nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: an external version must be set;"}
+	}
+	return c, nil
+}
+
+//文档当前的版本和条件不一致时返回 409; 只有一个分片, primary term 总是 1
+func (c *writeCondition) check(idx *index, typ, id string) *esError {
+	old, exists := idx.docs[id]
+	conflict := func(reason string) *esError {
+		return &esError{status: http.StatusConflict, typ: "version_conflict_engine_exception",
+			reason: fmt.Sprintf("[%s][%s]: version conflict, %s", typ, id, reason), index: idx.name}
+	}
+	if c.ifSeqNo != nil {
+		if !exists {
+			return conflict(fmt.Sprintf("required seqNo [%d], primary term [%d] but no document was found", *c.ifSeqNo, *c.ifPrimaryTerm))
+		}
+		if old.seqNo != *c.ifSeqNo || *c.ifPrimaryTerm != 1 {
+			return conflict(fmt.Sprintf("required seqNo [%d], primary term [%d]. current document has seqNo [%d] and primary term [1]",
+				*c.ifSeqNo, *c.ifPrimaryTerm, old.seqNo))
+		}
+	}
+	if c.version == nil {
+		return nil
+	}
+	switch {
+	case c.external && exists && old.version >= *c.version:
+		return conflict(fmt.Sprintf("current version [%d] is higher or equal to the one provided [%d]", old.version, *c.version))
+	case !c.external && !exists:
+		return conflict(fmt.Sprintf("required version [%d] but no document was found", *c.version))
+	case !c.external && old.version != *c.version:
+		return conflict(fmt.Sprintf("current version [%d] is different than the one provided [%d]", old.version, *c.version))
+	}
+	return nil
+}
+
+//外部版本号写入后文档的版本就是请求里的版本
+func (c *writeCondition) apply(idx *index, id string, meta map[string]interface{}) {
+	if c.external {
+		if doc, ok := idx.docs[id]; ok {
+			doc.version = *c.version
+		}
+		meta["_version"] = *c.version
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+)
+
+//导出请求, 查询条件和 CommonSearch 相同, 不分页
+type ExportRequest struct {
+	Index      string `json:"Index" validate:"required"`
+	SearchKey  string
+	FieldBoost map[string]float64
+	Analyzer   string
+	Pinyin     bool
+	Filters    []*CommonFilter
+	Format     string   `validate:"omitempty,oneof=ndjson csv"` // 默认 ndjson
+	Fields     []string // 导出的字段, 支持 a.b 这样的路径; csv 必填, 是表头的顺序
+}
+
+const (
+	exportBatchSize = 500
+	exportKeepAlive = "1m"
+)
+
+func (r *ExportRequest) source() *elastic.SearchSource {
+	search := &CommonSearch{SearchKey: r.SearchKey, FieldBoost: r.FieldBoost, Analyzer: r.Analyzer, Pinyin: r.Pinyin}
+	source := elastic.NewSearchSource().Query(search.getBoolQuery(r.Filters)).Size(exportBatchSize)
+	if len(r.Fields) > 0 {
+		source.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(r.Fields...))
+	}
+	return source
+}
+
+//按 a.b 这样的路径取文档里的值
+func fieldValue(doc map[string]interface{}, field string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, p := range strings.Split(field, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+//csv 单元格: 字符串原样, 数字不用科学计数法, 其他的转成json
+func cell(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+//导出的一行, ndjson 和 csv 各一种实现
+type exportWriter interface {
+	write(doc map[string]interface{}) error
+	flush() error
+}
+
+type ndjsonWriter struct {
+	enc    *json.Encoder
+	fields []string
+}
+
+func (w *ndjsonWriter) write(doc map[string]interface{}) error {
+	if len(w.fields) == 0 {
+		return w.enc.Encode(doc)
+	}
+	//只输出指定的字段, 嵌套字段用完整路径作为key
+	row := make(map[string]interface{}, len(w.fields))
+	for _, f := range w.fields {
+		if v, ok := fieldValue(doc, f); ok {
+			row[f] = v
+		}
+	}
+	return w.enc.Encode(row)
+}
+
+func (w *ndjsonWriter) flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (w *csvWriter) write(doc map[string]interface{}) error {
+	row := make([]string, len(w.fields))
+	for i, f := range w.fields {
+		v, _ := fieldValue(doc, f)
+		row[i] = cell(v)
+	}
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+//POST /api/v1/export, 用 scroll 取出所有匹配的文档, 边查边写
+func exportDocuments(c *gin.Context) {
+	var req ExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	if err := validate.Struct(req); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := checkFilters(req.Filters); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "ndjson"
+	}
+	if req.Format == "csv" && len(req.Fields) == 0 {
+		abortWithError(c, errBadRequest(errors.New("csv export needs Fields")))
+		return
+	}
+
+	var out exportWriter
+	started := false
+	//第一批结果回来之后才写响应头, 在这之前出错还能返回正常的错误
+	start := func() error {
+		started = true
+		c.Status(http.StatusOK)
+		filename := req.Index + "." + req.Format
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if req.Format == "csv" {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			w := csv.NewWriter(c.Writer)
+			out = &csvWriter{w: w, fields: req.Fields}
+			return w.Write(req.Fields)
+		}
+		c.Header("Content-Type", "application/x-ndjson")
+		out = &ndjsonWriter{enc: json.NewEncoder(c.Writer), fields: req.Fields}
+		return nil
+	}
+
+	//导出可能很久, 不用 request_timeout, 客户端断开时停止
+	count := 0
+	err := repo.Scroll(c.Request.Context(), req.Index, req.source(), exportKeepAlive, func(res *elastic.SearchResult) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		for _, hit := range res.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			var doc map[string]interface{}
+			d := json.NewDecoder(bytes.NewReader(*hit.Source))
+			d.UseNumber()
+			if err := d.Decode(&doc); err != nil {
+				return err
+			}
+			if err := out.write(doc); err != nil {
+				return err
+			}
+			count++
+		}
+		if err := out.flush(); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil && !started {
+		abortWithError(c, err)
+		return
+	}
+	if err != nil {
+		//已经开始输出, 只能断开连接, 调用方读响应时出错, 不会把不完整的文件当成导出成功
+		log.Printf("export %s failed after %d documents: %v", req.Index, count, err)
+		panic(http.ErrAbortHandler)
+	}
+	if !started {
+		//没有匹配的文档, 也返回空文件(csv 只有表头)
+		if err := start(); err == nil {
+			out.flush()
+		}
+	}
+}
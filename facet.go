@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/olivere/elastic/v6"
+)
+
+type facetType int
+
+const (
+	FACET_TYPE_TERMS facetType = iota
+	FACET_TYPE_RANGE
+	FACET_TYPE_HISTOGRAM
+)
+
+//分面定义, 和搜索结果一起返回每个取值的文档数
+//Filters 里 FilterName 和分面 Name 相同的条件是这个分面的选中值, 会放到 post_filter 里,
+//这样选中的分面不会把自己其他取值的计数过滤掉, 但是会影响其他分面的计数
+type CommonFacet struct {
+	Name      string `validate:"required"` // 结果里的名字, 比如 category
+	FacetType facetType
+	Field     string        `validate:"required"`
+	Size      int           // terms 返回的取值个数, 默认 10
+	Ranges    []*FacetRange // range 的区间
+	Interval  float64       // histogram 的间隔
+}
+
+//range 分面的一个区间, 左闭右开, From/To 为空表示不限
+type FacetRange struct {
+	Key  string
+	From *float64
+	To   *float64
+}
+
+type FacetBucket struct {
+	Key   interface{} `json:"key"`
+	From  *float64    `json:"from,omitempty"`
+	To    *float64    `json:"to,omitempty"`
+	Count int64       `json:"count"`
+}
+
+type FacetResult struct {
+	Buckets []*FacetBucket `json:"buckets"`
+}
+
+//分面聚合放在 filter 聚合里, 下面这个名字的子聚合是真正的取值统计
+const facetValues = "values"
+
+func (f *CommonFacet) check() error {
+	if f == nil {
+		return errBadRequest(fmt.Errorf("facet is null"))
+	}
+	for _, r := range f.Ranges {
+		if r == nil {
+			return errBadRequest(fmt.Errorf("facet %s: range is null", f.Name))
+		}
+	}
+	return nil
+}
+
+//名字是聚合的名字, 也是结果和选中条件的key, 不能重复
+func checkFacets(facets []*CommonFacet) error {
+	names := make(map[string]bool, len(facets))
+	for _, f := range facets {
+		if err := f.check(); err != nil {
+			return err
+		}
+		if names[f.Name] {
+			return errBadRequest(fmt.Errorf("duplicate facet name %q", f.Name))
+		}
+		names[f.Name] = true
+	}
+	return nil
+}
+
+func (f *CommonFacet) aggregation() (elastic.Aggregation, error) {
+	switch f.FacetType {
+	case FACET_TYPE_TERMS:
+		size := f.Size
+		if size <= 0 {
+			size = 10
+		}
+		return elastic.NewTermsAggregation().Field(f.Field).Size(size), nil
+	case FACET_TYPE_RANGE:
+		if len(f.Ranges) == 0 {
+			return nil, errBadRequest(fmt.Errorf("facet %s: range facet needs Ranges", f.Name))
+		}
+		agg := elastic.NewRangeAggregation().Field(f.Field)
+		for _, r := range f.Ranges {
+			var from, to interface{}
+			if r.From != nil {
+				from = *r.From
+			}
+			if r.To != nil {
+				to = *r.To
+			}
+			if r.Key != "" {
+				agg.AddRangeWithKey(r.Key, from, to)
+			} else {
+				agg.AddRange(from, to)
+			}
+		}
+		return agg, nil
+	case FACET_TYPE_HISTOGRAM:
+		if f.Interval <= 0 {
+			return nil, errBadRequest(fmt.Errorf("facet %s: histogram facet needs a positive Interval", f.Name))
+		}
+		return elastic.NewHistogramAggregation().Field(f.Field).Interval(f.Interval).MinDocCount(0), nil
+	}
+	return nil, errBadRequest(fmt.Errorf("facet %s: unknown FacetType %d", f.Name, f.FacetType))
+}
+
+//把过滤条件分成普通的和分面选中的, 分面选中的按分面名分组
+func (r *CommonSearch) splitFilters() ([]*CommonFilter, map[string][]*CommonFilter) {
+	names := make(map[string]bool, len(r.Facets))
+	for _, f := range r.Facets {
+		names[f.Name] = true
+	}
+	filters := make([]*CommonFilter, 0)
+	selected := make(map[string][]*CommonFilter)
+	for _, fl := range r.Filters {
+		if fl.FilterName != "" && names[fl.FilterName] {
+			selected[fl.FilterName] = append(selected[fl.FilterName], fl)
+			continue
+		}
+		filters = append(filters, fl)
+	}
+	return filters, selected
+}
+
+//除了 exclude 之外所有分面的选中条件
+func selectedFilters(selected map[string][]*CommonFilter, exclude string) []elastic.Query {
+	queries := make([]elastic.Query, 0)
+	for name, filters := range selected {
+		if name == exclude {
+			continue
+		}
+		queries = append(queries, getFilters(filters)...)
+	}
+	return queries
+}
+
+//给搜索加上分面聚合和 post_filter
+func (r *CommonSearch) addFacets(search *elastic.SearchSource, selected map[string][]*CommonFilter) error {
+	if post := selectedFilters(selected, ""); len(post) > 0 {
+		search.PostFilter(elastic.NewBoolQuery().Filter(post...))
+	}
+	for _, f := range r.Facets {
+		agg, err := f.aggregation()
+		if err != nil {
+			return err
+		}
+		var filter elastic.Query = elastic.NewMatchAllQuery()
+		if others := selectedFilters(selected, f.Name); len(others) > 0 {
+			filter = elastic.NewBoolQuery().Filter(others...)
+		}
+		search.Aggregation(f.Name, elastic.NewFilterAggregation().Filter(filter).SubAggregation(facetValues, agg))
+	}
+	return nil
+}
+
+func facetResults(facets []*CommonFacet, aggs elastic.Aggregations) map[string]*FacetResult {
+	if len(facets) == 0 {
+		return nil
+	}
+	results := make(map[string]*FacetResult, len(facets))
+	for _, f := range facets {
+		result := &FacetResult{Buckets: make([]*FacetBucket, 0)}
+		results[f.Name] = result
+		agg, ok := aggs.Filter(f.Name)
+		if !ok {
+			continue
+		}
+		switch f.FacetType {
+		case FACET_TYPE_TERMS:
+			if terms, ok := agg.Terms(facetValues); ok {
+				for _, b := range terms.Buckets {
+					result.Buckets = append(result.Buckets, &FacetBucket{Key: b.Key, Count: b.DocCount})
+				}
+			}
+		case FACET_TYPE_RANGE:
+			if ranges, ok := agg.Range(facetValues); ok {
+				for _, b := range ranges.Buckets {
+					result.Buckets = append(result.Buckets, &FacetBucket{Key: b.Key, From: b.From, To: b.To, Count: b.DocCount})
+				}
+			}
+		case FACET_TYPE_HISTOGRAM:
+			if histogram, ok := agg.Histogram(facetValues); ok {
+				for _, b := range histogram.Buckets {
+					result.Buckets = append(result.Buckets, &FacetBucket{Key: b.Key, Count: b.DocCount})
+				}
+			}
+		}
+	}
+	return results
+}
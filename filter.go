@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/olivere/elastic/v6"
+)
+
+type filterType int
+
+const (
+	FILTER_TYPE_TERM filterType = iota
+	FILTER_TYPE_RANGE
+	FILTER_TYPE_EXISTS       // 字段有值
+	FILTER_TYPE_MISSING      // 字段没有值
+	FILTER_TYPE_PREFIX       // 前缀, 多个取值时匹配任意一个
+	FILTER_TYPE_WILDCARD     // 通配符 * 和 ?, 多个取值时匹配任意一个
+	FILTER_TYPE_GEO_DISTANCE // 到 FilterValue [lat, lon] 的距离在 Distance 以内
+	FILTER_TYPE_OR           // Filters 里的条件满足任意一个
+)
+
+//过滤条件, 可以用 Not 取反, 用 FILTER_TYPE_OR 嵌套组合
+type CommonFilter struct {
+	FilterType  filterType
+	FilterName  string
+	FilterField string
+	//range 是 [from] 或者 [from, to], from 为 null 表示只限制上界
+	FilterValue []interface{}
+	//range 是否包含边界, 默认都包含
+	IncludeLower *bool
+	IncludeUpper *bool
+	Distance     string // geo_distance 的距离, 比如 10km, 500m
+	Not          bool   // 不满足这个条件的文档
+	Filters      []*CommonFilter
+}
+
+//检查过滤条件的格式, 新加的类型格式不对时报错而不是忽略
+func (f *CommonFilter) check() error {
+	if f == nil {
+		return errBadRequest(fmt.Errorf("filter is null"))
+	}
+	if f.FilterType != FILTER_TYPE_OR && f.FilterField == "" {
+		return errBadRequest(fmt.Errorf("filter %d: FilterField is required", f.FilterType))
+	}
+	switch f.FilterType {
+	case FILTER_TYPE_TERM, FILTER_TYPE_EXISTS, FILTER_TYPE_MISSING:
+	case FILTER_TYPE_RANGE:
+		if len(f.FilterValue) > 2 {
+			return errBadRequest(fmt.Errorf("filter %s: range takes at most 2 values", f.FilterField))
+		}
+	case FILTER_TYPE_PREFIX, FILTER_TYPE_WILDCARD:
+		if len(f.FilterValue) == 0 {
+			return errBadRequest(fmt.Errorf("filter %s: FilterValue is required", f.FilterField))
+		}
+		for _, v := range f.FilterValue {
+			if _, ok := v.(string); !ok {
+				return errBadRequest(fmt.Errorf("filter %s: value %v is not a string", f.FilterField, v))
+			}
+		}
+	case FILTER_TYPE_GEO_DISTANCE:
+		if _, _, ok := f.latLon(); !ok {
+			return errBadRequest(fmt.Errorf("filter %s: geo distance needs FilterValue [lat, lon]", f.FilterField))
+		}
+		if f.Distance == "" {
+			return errBadRequest(fmt.Errorf("filter %s: geo distance needs Distance", f.FilterField))
+		}
+	case FILTER_TYPE_OR:
+		if len(f.Filters) == 0 {
+			return errBadRequest(fmt.Errorf("or filter needs Filters"))
+		}
+		for _, child := range f.Filters {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+	default:
+		return errBadRequest(fmt.Errorf("filter %s: unknown FilterType %d", f.FilterField, f.FilterType))
+	}
+	return nil
+}
+
+func checkFilters(filters []*CommonFilter) error {
+	for _, f := range filters {
+		if err := f.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//geo_distance 的中心点, 经纬度可以是数字或者数字字符串
+func (f *CommonFilter) latLon() (float64, float64, bool) {
+	if len(f.FilterValue) != 2 {
+		return 0, 0, false
+	}
+	lat, ok1 := toFloat(f.FilterValue[0])
+	lon, ok2 := toFloat(f.FilterValue[1])
+	if !ok1 || !ok2 || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// 过滤条件
+func getFilters(filters []*CommonFilter) []elastic.Query {
+	if filters == nil || len(filters) <= 0 {
+		return nil
+	}
+	var querys = make([]elastic.Query, 0)
+	for _, fl := range filters {
+		filter := getFilter(fl)
+		if filter == nil {
+			continue
+		}
+		querys = append(querys, filter)
+	}
+	return querys
+}
+
+func getFilter(filter *CommonFilter) elastic.Query {
+	query := filterQuery(filter)
+	if query == nil || !filter.Not {
+		return query
+	}
+	return elastic.NewBoolQuery().MustNot(query)
+}
+
+func filterQuery(filter *CommonFilter) elastic.Query {
+	switch filter.FilterType {
+	case FILTER_TYPE_TERM:
+		if len(filter.FilterValue) <= 0 {
+			log.Printf("filterField[%s] - filterValue is null.", filter.FilterField)
+			return nil
+		}
+		return elastic.NewTermsQuery(filter.FilterField, filter.FilterValue...)
+	case FILTER_TYPE_RANGE:
+		return rangeFilter(filter)
+	case FILTER_TYPE_EXISTS:
+		return elastic.NewExistsQuery(filter.FilterField)
+	case FILTER_TYPE_MISSING:
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(filter.FilterField))
+	case FILTER_TYPE_PREFIX, FILTER_TYPE_WILDCARD:
+		querys := make([]elastic.Query, 0, len(filter.FilterValue))
+		for _, v := range filter.FilterValue {
+			if filter.FilterType == FILTER_TYPE_PREFIX {
+				querys = append(querys, elastic.NewPrefixQuery(filter.FilterField, fmt.Sprint(v)))
+			} else {
+				querys = append(querys, elastic.NewWildcardQuery(filter.FilterField, fmt.Sprint(v)))
+			}
+		}
+		return anyOf(querys)
+	case FILTER_TYPE_GEO_DISTANCE:
+		lat, lon, ok := filter.latLon()
+		if !ok {
+			return nil
+		}
+		return elastic.NewGeoDistanceQuery(filter.FilterField).Lat(lat).Lon(lon).Distance(filter.Distance)
+	case FILTER_TYPE_OR:
+		return anyOf(getFilters(filter.Filters))
+	}
+	return nil
+}
+
+//range 的取值: 一个值是下界, 两个值是上下界, 值为 null 的一边不限制
+func rangeFilter(filter *CommonFilter) elastic.Query {
+	var from, to interface{}
+	if len(filter.FilterValue) > 0 {
+		from = filter.FilterValue[0]
+	}
+	if len(filter.FilterValue) > 1 {
+		to = filter.FilterValue[1]
+	}
+	if from == nil && to == nil {
+		log.Printf("filterField[%s] - filterValue is null.", filter.FilterField)
+		return nil
+	}
+	rangeQuery := elastic.NewRangeQuery(filter.FilterField)
+	if from != nil {
+		if filter.IncludeLower == nil || *filter.IncludeLower {
+			rangeQuery.Gte(from)
+		} else {
+			rangeQuery.Gt(from)
+		}
+	}
+	if to != nil {
+		if filter.IncludeUpper == nil || *filter.IncludeUpper {
+			rangeQuery.Lte(to)
+		} else {
+			rangeQuery.Lt(to)
+		}
+	}
+	return rangeQuery
+}
+
+//满足任意一个条件, 只有一个条件时直接用它
+func anyOf(querys []elastic.Query) elastic.Query {
+	switch len(querys) {
+	case 0:
+		return nil
+	case 1:
+		return querys[0]
+	}
+	return elastic.NewBoolQuery().Should(querys...).MinimumNumberShouldMatch(1)
+}
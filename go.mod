@@ -3,8 +3,7 @@ module edusoho_search
 go 1.13
 
 require (
-	github.com/elastic/go-elasticsearch/v6 v6.8.11-0.20200609085412-b4979d4be640
-	github.com/elastic/go-elasticsearch/v8 v8.0.0-20200716073932-4f0b75746dc1 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/fortytw2/leaktest v1.3.0 // indirect
 	github.com/gin-gonic/gin v1.6.3
 	github.com/go-sql-driver/mysql v1.5.0
@@ -14,6 +13,7 @@ require (
 	github.com/olivere/elastic/v6 v6.2.1
 	// github.com/olivere/elastic v6.2.34+incompatible
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/siddontang/go-mysql v1.1.0
 	github.com/tidwall/gjson v1.6.0
 	gopkg.in/go-playground/validator.v9 v9.31.0
 	gopkg.in/ini.v1 v1.61.0
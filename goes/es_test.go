@@ -3,13 +3,17 @@ package goes
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"reflect"
 	"testing"
 	"time"
 
-	"github.com/olivere/elastic"
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+
+	"github.com/olivere/elastic/v6"
 )
- 
+
 type Tweet struct {
 	User     string                `json:"user"`
 	Age      int                   `json:"age"`
@@ -21,7 +25,7 @@ type Tweet struct {
 	Location string                `json:"location,omitempty"`
 	Suggest  *elastic.SuggestField `json:"suggest_field,omitempty"`
 }
- 
+
 var mapping = `{
 	"settings":{
 		"number_of_shards": 3,
@@ -60,73 +64,164 @@ var mapping = `{
 		}
 	}
 }`
- 
+
+//用内存里的假es代替 127.0.0.1:9200, 不需要真实节点
+func TestMain(m *testing.M) {
+	server := estest.NewServer()
+	b, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	SetBackend(b)
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+//每个测试重新建 twitter 索引并写入固定的数据
+func seedTweets(t *testing.T) {
+	DelIndex("twitter")
+	if !CreateIndex("twitter", mapping) {
+		t.Fatal("create index twitter failed")
+	}
+	tweet1 := Tweet{User: "Jame1", Age: 23, Message: "Take One", Retweets: 1, Created: time.Now()}
+	tweet2 := Tweet{User: "Jame2", Age: 32, Message: "Take Two", Retweets: 0, Created: time.Now()}
+	tweet3 := Tweet{User: "Jame3", Age: 32, Message: "Take Three", Retweets: 0, Created: time.Now()}
+	tweet4 := Tweet{User: "Jame10", Age: 45, Message: "Take Ten", Retweets: 3, Created: time.Now()}
+	failed, err := Batch("twitter", "doc",
+		Doc{Id: "1", Source: tweet1}, Doc{Id: "2", Source: tweet2}, Doc{Id: "3", Source: tweet3}, Doc{Id: "10", Source: tweet4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("batch insert: %d items failed", len(failed))
+	}
+}
+
 func TestPingNode(t *testing.T) {
-	PingNode()
+	if version := PingNode(); version != estest.Version {
+		t.Errorf("version = %q, want %q", version, estest.Version)
+	}
 }
- 
+
 func TestIndexExists(t *testing.T) {
-	result := IndexExists("car_source", "test")
-	fmt.Println("all index exists: ", result)
+	seedTweets(t)
+	if IndexExists("car_source", "test") {
+		t.Error("car_source and test should not exist")
+	}
+	if !IndexExists("twitter") {
+		t.Error("twitter should exist")
+	}
+	if IndexExists("twitter", "test") {
+		t.Error("exists must be false when any index is missing")
+	}
 }
- 
+
 func TestDeleteIndex(t *testing.T) {
-	result := DelIndex("twitter")
-	fmt.Println("all index deleted: ", result)
+	seedTweets(t)
+	if !DelIndex("twitter") {
+		t.Fatal("delete twitter should be acknowledged")
+	}
+	if IndexExists("twitter") {
+		t.Error("twitter still exists after delete")
+	}
+	if DelIndex("twitter") {
+		t.Error("deleting a missing index should fail")
+	}
 }
- 
+
 func TestCreateIndex(t *testing.T) {
-	result := CreateIndex("twitter", mapping)
-	fmt.Println("mapping created: ", result)
+	DelIndex("twitter")
+	if !CreateIndex("twitter", mapping) {
+		t.Fatal("mapping not created")
+	}
+	if CreateIndex("twitter", mapping) {
+		t.Error("creating an existing index should fail")
+	}
 }
- 
+
 func TestBatch(t *testing.T) {
-	tweet1 := Tweet{User: "Jame1",Age: 23, Message: "Take One", Retweets: 1, Created: time.Now()}
-	tweet2 := Tweet{User: "Jame2",Age: 32, Message: "Take Two", Retweets: 0, Created: time.Now()}
-	tweet3 := Tweet{User: "Jame3",Age: 32, Message: "Take Three", Retweets: 0, Created: time.Now()}
-	Batch("twitter", "doc", tweet1, tweet2, tweet3)
+	seedTweets(t)
+	result := TermQuery("twitter", "doc", "retweets", "0")
+	if result.Hits.TotalHits != 2 {
+		t.Errorf("retweets=0 hits = %d, want 2", result.Hits.TotalHits)
+	}
+	//同样的 id 再写一次只会覆盖, 不会影响其他文档
+	failed, err := Batch("twitter", "doc", Doc{Id: "3", Source: Tweet{User: "Jame3", Age: 33, Message: "Take Three", Retweets: 5}})
+	if err != nil || len(failed) != 0 {
+		t.Fatalf("failed = %v, err = %v", failed, err)
+	}
+	if result := TermQuery("twitter", "doc", "retweets", "0"); result.Hits.TotalHits != 1 {
+		t.Errorf("retweets=0 hits = %d after overwrite, want 1", result.Hits.TotalHits)
+	}
+	var tweet Tweet
+	if err := json.Unmarshal(GetDoc("twitter", "2"), &tweet); err != nil || tweet.User != "Jame2" {
+		t.Errorf("doc 2 = %+v, err = %v", tweet, err)
+	}
 }
- 
+
 func TestGetDoc(t *testing.T) {
+	seedTweets(t)
 	var tweet Tweet
-	data := GetDoc("twitter", "1")
-	if err := json.Unmarshal(data, &tweet); err == nil {
-		fmt.Printf("data: %v\n", tweet)
+	data := GetDoc("twitter", "2")
+	if err := json.Unmarshal(data, &tweet); err != nil {
+		t.Fatal(err)
+	}
+	if tweet.User != "Jame2" || tweet.Age != 32 {
+		t.Errorf("got %+v, want Jame2 aged 32", tweet)
 	}
 }
- 
+
 func TestTermQuery(t *testing.T) {
+	seedTweets(t)
 	var tweet Tweet
-	result := TermQuery("twitter", "doc", "user", "Take Two")
+	result := TermQuery("twitter", "doc", "user", "Jame2")
 	//获得数据, 方法一
+	users := make([]string, 0)
 	for _, item := range result.Each(reflect.TypeOf(tweet)) {
 		if t, ok := item.(Tweet); ok {
-			fmt.Printf("tweet : %v\n", t)
+			users = append(users, t.User)
 		}
 	}
+	if len(users) != 1 || users[0] != "Jame2" {
+		t.Errorf("users = %v, want [Jame2]", users)
+	}
 	//获得数据, 方法二
-	fmt.Println("num of raws: ", result.Hits.TotalHits)
-	if result.Hits.TotalHits > 0 {
-		for _, hit := range result.Hits.Hits {
-			err := json.Unmarshal(*hit.Source, &tweet)
-			if err != nil {
-				fmt.Printf("source convert json failed, err: %v\n", err)
-			}
-			fmt.Printf("data: %v\n", tweet)
+	if result.Hits.TotalHits != 1 {
+		t.Fatalf("num of raws = %d, want 1", result.Hits.TotalHits)
+	}
+	for _, hit := range result.Hits.Hits {
+		if err := json.Unmarshal(*hit.Source, &tweet); err != nil {
+			t.Fatalf("source convert json failed, err: %v", err)
+		}
+		if tweet.Message != "Take Two" {
+			t.Errorf("message = %q, want %q", tweet.Message, "Take Two")
 		}
 	}
 }
- 
+
 func TestSearch(t *testing.T) {
+	seedTweets(t)
 	result := Search("twitter", "doc")
 	var tweet Tweet
-	for _, item := range result.Each(reflect.TypeOf(tweet)) {
-		if t, ok := item.(Tweet); ok {
-			fmt.Printf("tweet : %v\n", t)
-		}
+	items := result.Each(reflect.TypeOf(tweet))
+	if len(items) != 1 {
+		t.Fatalf("got %d tweets, want 1", len(items))
+	}
+	if got := items[0].(Tweet); got.User != "Jame10" || got.Age != 45 {
+		t.Errorf("got %+v, want Jame10 aged 45", got)
 	}
 }
- 
+
 func TestAggsSearch(t *testing.T) {
-	AggsSearch("twitter","doc")
-}
\ No newline at end of file
+	seedTweets(t)
+	min, buckets := AggsSearch("twitter", "doc")
+	if min != 23 {
+		t.Errorf("min age = %v, want 23", min)
+	}
+	want := map[string]int64{"0.0-30.0": 1, "30.0-60.0": 3, "60.0-*": 0}
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("range buckets = %v, want %v", buckets, want)
+	}
+}
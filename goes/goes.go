@@ -3,37 +3,41 @@ package goes
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"time"
 
-	"github.com/olivere/elastic"
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
 )
 
-var host = []string{
-	"http://127.0.0.1:9200",
-}
+//和handler共用同一个es连接, 由main启动时注入
+var repo backend.SearchBackend
 
-var client *elastic.Client
+func SetBackend(b backend.SearchBackend) {
+	repo = b
+}
 
-//ping连接测试
-func PingNode() {
+//ping连接测试, 返回es的版本号, 连不上时返回空
+func PingNode() string {
 	start := time.Now()
 
-	info, code, err := client.Ping(host[0]).Do(context.Background())
+	info, err := repo.Ping(context.Background())
 
 	if err != nil {
 		fmt.Printf("ping es failed, err %v", err)
+		return ""
 	}
 
 	duration := time.Since(start)
 	fmt.Printf("cost time: %v\n", duration)
-	fmt.Printf("Elasticsearch returned with code %d and version %s\n", code, info.Version.Number)
+	fmt.Printf("Elasticsearch returned with version %s\n", info.Version.Number)
+	return info.Version.Number
 }
 
 //校验index是否存在 语法助记：如果函数最后一个参数被记作 ...T,
 //这时函数可以接收任意个T类型参数作为最后一个参数，请注意只有函数的最后一个参数才允许可变的
 func IndexExists(index ...string) bool {
-	exists, err := client.IndexExists(index...).Do(context.Background())
+	exists, err := repo.IndexExists(context.Background(), index...)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 	}
@@ -42,9 +46,10 @@ func IndexExists(index ...string) bool {
 
 //创建Index
 func CreateIndex(index, mapping string) bool {
-	result, err := client.CreateIndex(index).BodyString(mapping).Do(context.Background())
+	result, err := repo.CreateIndex(context.Background(), index, mapping)
 	if err != nil {
 		fmt.Printf("create index failed, err: %v\n", err)
+		return false
 	}
 
 	return result.Acknowledged
@@ -52,38 +57,45 @@ func CreateIndex(index, mapping string) bool {
 
 //删除index
 func DelIndex(index ...string) bool {
-	response, err := client.DeleteIndex(index...).Do(context.Background())
+	response, err := repo.DeleteIndex(context.Background(), index...)
 	if err != nil {
 		fmt.Printf("delete index failed, err:%v\n", err)
+		return false
 	}
 	return response.Acknowledged
 }
 
-//批量插入
-func Batch(index string, type_ string, datas ...interface{}) {
-	bulkRequest := client.Bulk()
-	for i, data := range datas {
-		doc := elastic.NewBulkIndexRequest().Index(index).Type(type_).Id(strconv.Itoa(i)).Doc(data)
-		bulkRequest = bulkRequest.Add(doc)
+//批量写入的一条文档, Id 为空时由es生成
+type Doc struct {
+	Id     string
+	Source interface{}
+}
+
+//批量写入, 返回失败的条目, 可以只重试这些; 整个请求失败时返回 error
+func Batch(index string, type_ string, docs ...Doc) ([]*elastic.BulkResponseItem, error) {
+	requests := make([]elastic.BulkableRequest, 0, len(docs))
+	for _, doc := range docs {
+		req := elastic.NewBulkIndexRequest().Index(index).Type(type_).Doc(doc.Source)
+		if doc.Id != "" {
+			req.Id(doc.Id)
+		}
+		requests = append(requests, req)
 	}
-	response, err := bulkRequest.Do(context.TODO())
+	response, err := repo.Bulk(context.TODO(), requests...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	failed := response.Failed()
-	iter := len(failed)
-	fmt.Printf("error: %v, %v\n", response.Errors, iter)
+	return response.Failed(), nil
 }
 
 //获取指定Id的文档
 func GetDoc(index, id string) []byte {
-	temp := client.Get().Index(index).Id(id)
-	get, err := temp.Do(context.Background())
+	get, err := repo.Get(context.Background(), index, id)
 	if err != nil {
 		panic(err)
 	}
 	if get.Found {
-		fmt.Printf("Got document %s in version %d from index %s, type %s\n", get.Id, get.Version, get.Index, get.Type)
+		fmt.Printf("Got document %s in version %d from index %s, type %s\n", get.Id, *get.Version, get.Index, get.Type)
 	}
 	source, err := get.Source.MarshalJSON()
 	if err != nil {
@@ -95,13 +107,11 @@ func GetDoc(index, id string) []byte {
 //term
 func TermQuery(index, type_, fieldName, fieldValue string) *elastic.SearchResult {
 	query := elastic.NewTermQuery(fieldName, fieldValue)
-
-	searchResult, err := client.Search().
-		Index(index).Type(type_).
+	source := elastic.NewSearchSource().
 		Query(query).
-		From(0).Size(10).
-		Pretty(true).
-		Do(context.Background())
+		From(0).Size(10)
+
+	searchResult, err := repo.Search(context.Background(), index, source)
 	if err != nil {
 		panic(err)
 	}
@@ -114,8 +124,7 @@ func Search(index, type_ string) *elastic.SearchResult {
 	boolQuery := elastic.NewBoolQuery()
 	boolQuery.Must(elastic.NewMatchQuery("user", "Jame10"))
 	boolQuery.Filter(elastic.NewRangeQuery("age").Gt("30"))
-	searchResult, err := client.Search(index).
-		Type(type_).Query(boolQuery).Pretty(true).Do(context.Background())
+	searchResult, err := repo.Search(context.Background(), index, elastic.NewSearchSource().Query(boolQuery))
 
 	if err != nil {
 		panic(err)
@@ -125,23 +134,36 @@ func Search(index, type_ string) *elastic.SearchResult {
 
 }
 
-func AggsSearch(index, type_ string) {
+//返回age的最小值, 以及各年龄段的文档数
+func AggsSearch(index, type_ string) (float64, map[string]int64) {
 	minAgg := elastic.NewMinAggregation().Field("age")
 	rangeAgg := elastic.NewRangeAggregation().Field("age").AddRange(0, 30).AddRange(30, 60).Gt(60)
 
-	build := client.Search(index).Type(type_).Pretty(true)
+	source := elastic.NewSearchSource().Size(0)
 
-	minResult, err := build.Aggregation("minAgg", minAgg).Do(context.Background())
-	rangeResult, err := build.Aggregation("rangeAgg", rangeAgg).Do(context.Background())
+	minResult, err := repo.Search(context.Background(), index, source.Aggregation("minAgg", minAgg))
+	if err != nil {
+		panic(err)
+	}
+	rangeResult, err := repo.Search(context.Background(), index, source.Aggregation("rangeAgg", rangeAgg))
 	if err != nil {
 		panic(err)
 	}
 
+	var min float64
 	minAggRes, _ := minResult.Aggregations.Min("minAgg")
-	fmt.Printf("min: %v\n", *minAggRes.Value)
+	if minAggRes != nil && minAggRes.Value != nil {
+		min = *minAggRes.Value
+	}
+	fmt.Printf("min: %v\n", min)
 
+	counts := make(map[string]int64)
 	rangeAggRes, _ := rangeResult.Aggregations.Range("rangeAgg")
-	for _, item := range rangeAggRes.Buckets {
-		fmt.Printf("key: %s, value: %v\n", item.Key, item.DocCount)
+	if rangeAggRes != nil {
+		for _, item := range rangeAggRes.Buckets {
+			fmt.Printf("key: %s, value: %v\n", item.Key, item.DocCount)
+			counts[item.Key] = item.DocCount
+		}
 	}
+	return min, counts
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//单项检查的结果, 没有配置的依赖(比如没开binlog同步)是 disabled, 不影响就绪
+const (
+	CHECK_OK       = "ok"
+	CHECK_FAIL     = "fail"
+	CHECK_DISABLED = "disabled"
+)
+
+type checkResult struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+func checkFailed(err error, detail interface{}) *checkResult {
+	return &checkResult{Status: CHECK_FAIL, Error: err.Error(), Detail: detail}
+}
+
+//es 集群状态由好到坏
+var clusterStatusLevel = map[string]int{"green": 0, "yellow": 1, "red": 2}
+
+type readinessCheck func(ctx context.Context) *checkResult
+
+func readinessChecks() map[string]readinessCheck {
+	return map[string]readinessCheck{
+		"elasticsearch": checkElasticsearch,
+		"indices":       checkIndices,
+		"mysql":         checkMySQL,
+		"binlog":        checkBinlog,
+	}
+}
+
+//集群状态不能比 min_cluster_status 差, 默认允许 yellow(单节点没有副本)
+func checkElasticsearch(ctx context.Context) *checkResult {
+	min := appConfig().Health.MinClusterStatus
+	health, err := repo.ClusterHealth(ctx)
+	if err != nil {
+		return checkFailed(err, nil)
+	}
+	detail := gin.H{"cluster_name": health.ClusterName, "status": health.Status, "number_of_nodes": health.NumberOfNodes}
+	level, ok := clusterStatusLevel[health.Status]
+	if !ok || level > clusterStatusLevel[min] {
+		return checkFailed(fmt.Errorf("cluster status is %s, want %s or better", health.Status, min), detail)
+	}
+	return &checkResult{Status: CHECK_OK, Detail: detail}
+}
+
+//搜索用到的索引或别名都要存在
+func checkIndices(ctx context.Context) *checkResult {
+	required := appConfig().Health.RequiredIndices
+	missing := make([]string, 0)
+	for _, name := range required {
+		exists, err := repo.IndexExists(ctx, name)
+		if err != nil {
+			return checkFailed(err, nil)
+		}
+		if !exists {
+			missing = append(missing, name)
+		}
+	}
+	detail := gin.H{"required": required, "missing": missing}
+	if len(missing) > 0 {
+		return checkFailed(fmt.Errorf("missing indices %v", missing), detail)
+	}
+	return &checkResult{Status: CHECK_OK, Detail: detail}
+}
+
+//课程导入要用的mysql
+func checkMySQL(ctx context.Context) *checkResult {
+	if importDB == nil {
+		return &checkResult{Status: CHECK_DISABLED}
+	}
+	if err := importDB.PingContext(ctx); err != nil {
+		return checkFailed(err, nil)
+	}
+	return &checkResult{Status: CHECK_OK}
+}
+
+//binlog 同步没有出错, 延迟不超过 max_binlog_delay
+func checkBinlog(ctx context.Context) *checkResult {
+	if binlogRiver == nil {
+		return &checkResult{Status: CHECK_DISABLED}
+	}
+	maxDelay := appConfig().Health.MaxBinlogDelay
+	status := binlogRiver.Status()
+	detail := gin.H{"position": status.Position, "delay": status.Delay}
+	if status.Error != "" {
+		return checkFailed(fmt.Errorf("%s", status.Error), detail)
+	}
+	if delay := time.Duration(status.Delay * float64(time.Second)); delay > maxDelay {
+		return checkFailed(fmt.Errorf("binlog delay %s exceeds %s", delay, maxDelay), detail)
+	}
+	return &checkResult{Status: CHECK_OK, Detail: detail}
+}
+
+//GET /healthz, 进程还能处理请求就返回200, 不检查依赖
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+//GET /readyz, 所有依赖都可用时返回200, 否则503, 每一项的结果都在 checks 里
+func readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), appConfig().Health.Timeout)
+	defer cancel()
+
+	checks := readinessChecks()
+	results := make(map[string]*checkResult, len(checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check readinessCheck) {
+			defer wg.Done()
+			result := check(ctx)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status, code := "ready", http.StatusOK
+	for _, result := range results {
+		if result.Status == CHECK_FAIL {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": results})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"edusoho_search/importer"
+
+	"github.com/gin-gonic/gin"
+)
+
+//课程导入, main里初始化, 没有配置mysql时为nil
+var courseImporter *importer.Importer
+
+//导入用的mysql连接, /readyz 检查是否可以连接
+var importDB *sql.DB
+
+//[import] 段和当前模式下的 mysql_dsn
+func importConfig() importer.Config {
+	cfg := appConfig()
+	return importer.Config{
+		DSN:               cfg.MySQL.DSN,
+		DocType:           cfg.ES.DocType,
+		Table:             cfg.Import.Table,
+		Index:             cfg.Import.Index,
+		ShowMode:          cfg.Import.ShowMode,
+		ExcludeCategories: cfg.Import.ExcludeCategories,
+		PageSize:          cfg.Import.PageSize,
+	}
+}
+
+func setupImporter() {
+	cfg := importConfig()
+	if cfg.DSN == "" {
+		fmt.Println("没有配置mysql_dsn, 课程导入不可用")
+		return
+	}
+	//sql.Open 不会真正连接, 连接错误在任务里报告
+	db, err := sql.Open("mysql", cfg.DSN)
+	checkErr(err)
+	importDB = db
+	courseImporter = importer.New(cfg, bulkProcessor, importer.NewMySQLSource(db, cfg))
+}
+
+//启动导入任务, 立即返回任务id, 进度通过 /api/v1/import/jobs/:id 查询
+func startCourseImport(c *gin.Context) {
+	if courseImporter == nil {
+		abortWithError(c, errInternal(errors.New("course import is not configured")))
+		return
+	}
+	job, err := courseImporter.Start()
+	if err == importer.ErrJobRunning {
+		abortWithError(c, errConflict(err))
+		return
+	}
+	c.JSON(http.StatusAccepted, job.Status())
+}
+
+//id 为 latest 时返回最近一次任务
+func importJobStatus(c *gin.Context) {
+	if courseImporter == nil {
+		abortWithError(c, errNotFound("course import is not configured"))
+		return
+	}
+	id := c.Param("id")
+	var job *importer.Job
+	var ok bool
+	if id == "latest" {
+		job, ok = courseImporter.Latest()
+	} else {
+		job, ok = courseImporter.Job(id)
+	}
+	if !ok {
+		abortWithError(c, errNotFound("import job "+id+" not found"))
+		return
+	}
+	c.JSON(http.StatusOK, job.Status())
+}
@@ -0,0 +1,265 @@
+//importer 把mysql里的课程分批导入es, 每个导入在后台以job的形式运行, 可以查询进度
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/bulk"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//导入配置, 来自 conf/app.ini 的 [import] 段
+type Config struct {
+	DSN               string
+	DocType           string //文档的type, 默认 doc
+	Table             string //课程表, 默认 course_set_v8
+	Index             string //写入的索引, 默认 course
+	ShowMode          int    //只导入该showMode的课程, 小于0表示不过滤
+	ExcludeCategories []int  //不导入的分类
+	PageSize          int    //每次从mysql读取的行数
+}
+
+func (c *Config) setDefaults() {
+	if c.DocType == "" {
+		c.DocType = backend.DefaultType
+	}
+	if c.Table == "" {
+		c.Table = "course_set_v8"
+	}
+	if c.Index == "" {
+		c.Index = "course"
+	}
+	if c.PageSize <= 0 {
+		c.PageSize = 500
+	}
+}
+
+var ErrJobRunning = errors.New("importer: an import job is already running")
+
+const (
+	StatusRunning  = "running"
+	StatusFinished = "finished"
+	StatusFailed   = "failed"
+)
+
+//最多保留多少条失败明细, 避免全部失败时占满内存
+const maxFailures = 100
+
+//单条文档写入失败的原因
+type Failure struct {
+	Id     string `json:"id"`
+	Status int    `json:"status"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+//导入任务的进度
+type JobStatus struct {
+	Id         string     `json:"id"`
+	Status     string     `json:"status"`
+	Index      string     `json:"index"`
+	Processed  int64      `json:"processed"`
+	Succeeded  int64      `json:"succeeded"`
+	Failed     int64      `json:"failed"`
+	LastId     int64      `json:"last_id"`
+	Error      string     `json:"error,omitempty"`
+	Failures   []*Failure `json:"failures,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Job struct {
+	mu     sync.Mutex
+	status JobStatus
+	done   chan struct{}
+}
+
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	s := j.status
+	s.Failures = append([]*Failure(nil), j.status.Failures...)
+	return s
+}
+
+//等待任务结束
+func (j *Job) Wait() JobStatus {
+	<-j.done
+	return j.Status()
+}
+
+func (j *Job) record(r *bulk.Result, id int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Processed++
+	//多个 worker 同时写入, 结果不一定按 id 顺序返回
+	if id > j.status.LastId {
+		j.status.LastId = id
+	}
+	if r.Succeeded() {
+		j.status.Succeeded++
+		return
+	}
+	j.status.Failed++
+	if len(j.status.Failures) >= maxFailures {
+		return
+	}
+	f := &Failure{Id: r.Id, Status: r.Status}
+	if r.Error != nil {
+		f.Type, f.Reason = r.Error.Type, r.Error.Reason
+	}
+	j.status.Failures = append(j.status.Failures, f)
+}
+
+func (j *Job) finish(err error) {
+	j.mu.Lock()
+	now := time.Now()
+	j.status.FinishedAt = &now
+	j.status.Status = StatusFinished
+	if err != nil {
+		j.status.Status = StatusFailed
+		j.status.Error = err.Error()
+	}
+	j.mu.Unlock()
+	close(j.done)
+}
+
+type Importer struct {
+	cfg       Config
+	processor *bulk.Processor
+	source    Source
+
+	mu      sync.Mutex
+	seq     int
+	running *Job
+	jobs    map[string]*Job
+	order   []string
+}
+
+//文档放进共用的 processor 写入, 分批和重试都由它负责
+func New(cfg Config, processor *bulk.Processor, source Source) *Importer {
+	cfg.setDefaults()
+	return &Importer{
+		cfg:       cfg,
+		processor: processor,
+		source:    source,
+		jobs:      make(map[string]*Job),
+	}
+}
+
+//启动一个后台导入任务, 同一时间只允许一个任务在跑
+func (im *Importer) Start() (*Job, error) {
+	job, err := im.newJob()
+	if err != nil {
+		return job, err
+	}
+	go im.runJob(context.Background(), job)
+	return job, nil
+}
+
+//同步执行导入, 重建索引时使用
+func (im *Importer) Run(ctx context.Context) (JobStatus, error) {
+	job, err := im.newJob()
+	if err != nil {
+		return JobStatus{}, err
+	}
+	err = im.runJob(ctx, job)
+	return job.Status(), err
+}
+
+//导入到另一个索引, 共用数据来源, 任务记录各自独立
+func (im *Importer) WithIndex(index string) *Importer {
+	cfg := im.cfg
+	cfg.Index = index
+	return New(cfg, im.processor, im.source)
+}
+
+func (im *Importer) newJob() (*Job, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.running != nil {
+		return im.running, ErrJobRunning
+	}
+	im.seq++
+	job := &Job{
+		status: JobStatus{
+			Id:        strconv.Itoa(im.seq),
+			Status:    StatusRunning,
+			Index:     im.cfg.Index,
+			StartedAt: time.Now(),
+		},
+		done: make(chan struct{}),
+	}
+	im.running = job
+	im.jobs[job.status.Id] = job
+	im.order = append(im.order, job.status.Id)
+	//只保留最近20个任务的记录
+	if len(im.order) > 20 {
+		delete(im.jobs, im.order[0])
+		im.order = im.order[1:]
+	}
+	return job, nil
+}
+
+func (im *Importer) runJob(ctx context.Context, job *Job) error {
+	err := im.run(ctx, job)
+	if err != nil {
+		log.Printf("import job %s failed: %v", job.status.Id, err)
+	}
+	im.mu.Lock()
+	im.running = nil
+	im.mu.Unlock()
+	job.finish(err)
+	return err
+}
+
+func (im *Importer) Job(id string) (*Job, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	job, ok := im.jobs[id]
+	return job, ok
+}
+
+//最近一次的任务
+func (im *Importer) Latest() (*Job, bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if len(im.order) == 0 {
+		return nil, false
+	}
+	return im.jobs[im.order[len(im.order)-1]], true
+}
+
+//processor 的队列满时读取 mysql 也会停下来; 返回前等所有文档都有结果
+func (im *Importer) run(ctx context.Context, job *Job) error {
+	var afterId int64
+	group := im.processor.NewGroup()
+	defer group.Wait()
+	for {
+		courses, err := im.source.Fetch(ctx, afterId, im.cfg.PageSize)
+		if err != nil {
+			return fmt.Errorf("fetch courses after id %d: %v", afterId, err)
+		}
+		for _, c := range courses {
+			c.Suggest = NewSuggest(c)
+			req := elastic.NewBulkIndexRequest().
+				Index(im.cfg.Index).Type(im.cfg.DocType).Id(strconv.FormatInt(c.Id, 10)).Doc(c)
+			id := c.Id
+			if err := group.Add(ctx, req, func(r *bulk.Result) { job.record(r, id) }); err != nil {
+				return fmt.Errorf("queue course %d: %v", c.Id, err)
+			}
+			afterId = c.Id
+		}
+		if len(courses) < im.cfg.PageSize {
+			return nil
+		}
+	}
+}
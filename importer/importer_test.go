@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/bulk"
+	"edusoho_search/estest"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//内存里的课程表, 记录每次分页的起点
+type fakeSource struct {
+	courses []*Course
+	afters  []int64
+}
+
+func (s *fakeSource) Fetch(ctx context.Context, afterId int64, limit int) ([]*Course, error) {
+	s.afters = append(s.afters, afterId)
+	page := make([]*Course, 0, limit)
+	for _, c := range s.courses {
+		if c.Id > afterId && len(page) < limit {
+			page = append(page, c)
+		}
+	}
+	return page, nil
+}
+
+//记录每次bulk的条数
+type countingBackend struct {
+	backend.SearchBackend
+	sizes []int
+}
+
+func (b *countingBackend) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (*elastic.BulkResponse, error) {
+	b.sizes = append(b.sizes, len(requests))
+	return b.SearchBackend.Bulk(ctx, requests...)
+}
+
+func newBackend(t *testing.T) (*countingBackend, func()) {
+	server := estest.NewServer()
+	b, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingBackend{SearchBackend: b}, server.Close
+}
+
+//只按条数分批的 processor
+func newProcessor(repo backend.SearchBackend, actions int) *bulk.Processor {
+	return bulk.NewProcessor(repo, bulk.Config{MaxActions: actions, FlushInterval: time.Hour})
+}
+
+func TestImport(t *testing.T) {
+	repo, stop := newBackend(t)
+	defer stop()
+	source := &fakeSource{}
+	for i := int64(1); i <= 7; i++ {
+		source.courses = append(source.courses, &Course{Id: i * 10, Title: "课程", ShowMode: 1, CategoryId: i % 3, StudentNum: i})
+	}
+
+	p := newProcessor(repo, 2)
+	defer p.Close(context.Background())
+	im := New(Config{PageSize: 3}, p, source)
+	job, err := im.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := job.Wait()
+	if status.Status != StatusFinished || status.Processed != 7 || status.Succeeded != 7 || status.Failed != 0 {
+		t.Fatalf("status = %+v", status)
+	}
+	if status.LastId != 70 {
+		t.Errorf("last id = %d, want 70", status.LastId)
+	}
+	if want := []int64{0, 30, 60}; !reflect.DeepEqual(source.afters, want) {
+		t.Errorf("fetch after ids = %v, want %v", source.afters, want)
+	}
+	if want := []int{2, 2, 2, 1}; !reflect.DeepEqual(repo.sizes, want) {
+		t.Errorf("bulk sizes = %v, want %v", repo.sizes, want)
+	}
+	res, err := repo.Get(context.Background(), "course", "40")
+	if err != nil || !res.Found {
+		t.Fatalf("course 40 not indexed: %v", err)
+	}
+	var doc Course
+	json.Unmarshal(*res.Source, &doc)
+	if doc.Suggest == nil || doc.Suggest.Weight != 4 || !reflect.DeepEqual(doc.Suggest.Contexts["categoryId"], []string{"1"}) {
+		t.Errorf("suggest = %+v", doc.Suggest)
+	}
+	if latest, _ := im.Latest(); latest != job {
+		t.Error("latest job is not the finished one")
+	}
+}
+
+func TestImportFailures(t *testing.T) {
+	repo, stop := newBackend(t)
+	defer stop()
+	//title 映射成数字, 非数字标题的课程会写入失败
+	_, err := repo.CreateIndex(context.Background(), "course",
+		`{"mappings":{"doc":{"properties":{"title":{"type":"long"}}}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &fakeSource{courses: []*Course{
+		{Id: 1, Title: "100"},
+		{Id: 2, Title: "遴选"},
+		{Id: 3, Title: "300"},
+	}}
+	p := newProcessor(repo, 0)
+	defer p.Close(context.Background())
+	job, err := New(Config{}, p, source).Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := job.Wait()
+	if status.Processed != 3 || status.Succeeded != 2 || status.Failed != 1 {
+		t.Fatalf("status = %+v", status)
+	}
+	if len(status.Failures) != 1 || status.Failures[0].Id != "2" || status.Failures[0].Type != "mapper_parsing_exception" {
+		t.Errorf("failures = %+v", status.Failures)
+	}
+}
+
+func TestMySQLQuery(t *testing.T) {
+	cfg := Config{ShowMode: 1, ExcludeCategories: []int{23, 24, 25}}
+	cfg.setDefaults()
+	query, args := NewMySQLSource(nil, cfg).query(100, 500)
+	want := "SELECT id,title,categoryId,createdTime,showMode,studentNum,minCoursePrice,rating FROM course_set_v8 WHERE id > ? AND showMode = ? AND categoryId NOT IN (?,?,?) ORDER BY id LIMIT ?"
+	if query != want {
+		t.Errorf("query = %s", query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{int64(100), 1, 23, 24, 25, 500}) {
+		t.Errorf("args = %v", args)
+	}
+}
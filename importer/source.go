@@ -0,0 +1,123 @@
+package importer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//写入es的课程文档, 字段名和线上 course 索引保持一致
+type Course struct {
+	Id          int64   `json:"id"`
+	Title       string  `json:"title"`
+	CategoryId  int64   `json:"categoryId"`
+	CreatedTime int64   `json:"createdTime"`
+	ShowMode    int     `json:"showMode"`
+	StudentNum  int64   `json:"studentNum"`
+	Price       float64 `json:"price"`  //课程里的最低价格
+	Rating      float64 `json:"rating"` //评分
+
+	//标题补全, 导入时由 NewSuggest 生成
+	Suggest *Suggest `json:"suggest,omitempty"`
+}
+
+//completion 字段的值, 按学员数加权, 可以按分类过滤
+type Suggest struct {
+	Input    []string            `json:"input"`
+	Weight   int64               `json:"weight"`
+	Contexts map[string][]string `json:"contexts"`
+}
+
+//没有标题的课程不生成补全
+func NewSuggest(c *Course) *Suggest {
+	title := strings.TrimSpace(c.Title)
+	if title == "" {
+		return nil
+	}
+	//es的权重是非负的int32
+	weight := c.StudentNum
+	if weight < 0 {
+		weight = 0
+	} else if weight > math.MaxInt32 {
+		weight = math.MaxInt32
+	}
+	return &Suggest{
+		Input:    []string{title},
+		Weight:   weight,
+		Contexts: map[string][]string{"categoryId": {strconv.FormatInt(c.CategoryId, 10)}},
+	}
+}
+
+//课程数据来源, 按id升序分页返回 afterId 之后的数据
+type Source interface {
+	Fetch(ctx context.Context, afterId int64, limit int) ([]*Course, error)
+}
+
+//从 course_set_v8 读取课程
+type MySQLSource struct {
+	db  *sql.DB
+	cfg Config
+}
+
+func NewMySQLSource(db *sql.DB, cfg Config) *MySQLSource {
+	return &MySQLSource{db: db, cfg: cfg}
+}
+
+//按主键做keyset分页, 避免大offset的慢查询
+func (s *MySQLSource) query(afterId int64, limit int) (string, []interface{}) {
+	var b strings.Builder
+	args := []interface{}{afterId}
+	fmt.Fprintf(&b, "SELECT id,title,categoryId,createdTime,showMode,studentNum,minCoursePrice,rating FROM %s WHERE id > ?", s.cfg.Table)
+	if s.cfg.ShowMode >= 0 {
+		b.WriteString(" AND showMode = ?")
+		args = append(args, s.cfg.ShowMode)
+	}
+	if len(s.cfg.ExcludeCategories) > 0 {
+		b.WriteString(" AND categoryId NOT IN (")
+		for i, id := range s.cfg.ExcludeCategories {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("?")
+			args = append(args, id)
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(" ORDER BY id LIMIT ?")
+	args = append(args, limit)
+	return b.String(), args
+}
+
+func (s *MySQLSource) Fetch(ctx context.Context, afterId int64, limit int) ([]*Course, error) {
+	query, args := s.query(afterId, limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	courses := make([]*Course, 0, limit)
+	for rows.Next() {
+		//使用sqlNull***来避免为null情况
+		var title sql.NullString
+		var categoryId, createdTime sql.NullInt64
+		var showMode, studentNum sql.NullInt64
+		var price, rating sql.NullFloat64
+		c := &Course{}
+		if err := rows.Scan(&c.Id, &title, &categoryId, &createdTime, &showMode, &studentNum, &price, &rating); err != nil {
+			return nil, err
+		}
+		c.Title = title.String
+		c.CategoryId = categoryId.Int64
+		c.CreatedTime = createdTime.Int64
+		c.ShowMode = int(showMode.Int64)
+		c.StudentNum = studentNum.Int64
+		c.Price = price.Float64
+		c.Rating = rating.Float64
+		courses = append(courses, c)
+	}
+	return courses, rows.Err()
+}
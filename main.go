@@ -3,91 +3,156 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 
-	"database/sql"
+	"edusoho_search/analysis"
+	"edusoho_search/auth"
+	"edusoho_search/backend"
+	"edusoho_search/goes"
+	"edusoho_search/mappings"
+	"edusoho_search/metrics"
+	"edusoho_search/ranking"
 
-	"github.com/elastic/go-elasticsearch/v6"
-	"github.com/elastic/go-elasticsearch/v6/esapi"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/olivere/elastic/v6"
 	"gopkg.in/go-playground/validator.v9"
-	"gopkg.in/ini.v1"
 )
 
 var (
-	es *elasticsearch.Client
-	r  map[string]interface{}
-	//配置信息
-	iniFile *ini.File
+	//带版本号的mapping文件
+	registry *mappings.Registry
 
-	//elastic的连接
-	client   *elastic.Client
+	//es的连接, handler和goes共用
+	repo     backend.SearchBackend
 	validate *validator.Validate
-	host     string
 )
 
 func init() {
-	var err error
-	//加载配置文件
-	file, e := ini.Load("conf/app.ini")
-
-	if e != nil {
-		checkErr(e)
-	}
-	iniFile = file
-	//读取配置的开发模式
-	RunMode := iniFile.Section("").Key("app_mode").String()
-	//直接通过函数拼接获取对应模块的url
-	host = iniFile.Section(RunMode).Key("host").String()
-	fmt.Println(host)
-
-	config := elasticsearch.Config{}
-	config.Addresses = []string{host}
-	es, err = elasticsearch.NewClient(config)
-	fmt.Println("连接es成功")
+	validate = validator.New()
+}
+
+//连接es, 放在main里而不是init里, 测试时可以换成假的es
+func setupBackend() {
+	es := appConfig().ES
+	cfg := backend.Config{
+		Addresses:           es.Hosts,
+		DocType:             es.DocType,
+		Username:            es.Username,
+		Password:            es.Password,
+		APIKey:              es.APIKey,
+		CAFile:              es.CAFile,
+		CertFile:            es.CertFile,
+		KeyFile:             es.KeyFile,
+		InsecureSkipVerify:  es.InsecureSkipVerify,
+		Timeout:             es.Timeout,
+		RetryOnStatus:       es.RetryOnStatus,
+		MaxRetries:          es.MaxRetries,
+		RetryBackoff:        es.RetryBackoff,
+		RetryMaxBackoff:     es.RetryMaxBackoff,
+		Sniff:               es.Sniff,
+		SnifferInterval:     es.SnifferInterval,
+		DisableHealthcheck:  !es.Healthcheck,
+		HealthcheckInterval: es.HealthcheckInterval,
+	}
+	transport, err := backend.NewTransport(cfg)
 	checkErr(err)
+	//统计连接池的状态
+	cfg.Transport = metrics.NewTransport(metricsRegistry, transport)
+	b, err := backend.New(cfg)
+	checkErr(err)
+	repo = metrics.InstrumentBackend(b, esMetrics, appConfig().Indices.Course, appConfig().Indices.CourseAll)
+	setupCache()
+	goes.SetBackend(repo)
 
-	res, err := es.Info()
+	//es 不可用时降级启动, 搜索接口返回错误, /readyz 报告不可用, 等es恢复后自动可用
+	info, err := repo.Ping(context.Background())
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
+		log.Printf("elasticsearch is not available, starting in degraded mode: %v", err)
+		return
 	}
+	fmt.Println("连接es成功")
+	fmt.Printf("Elasticsearch version %s\n", info.Version.Number)
+}
 
-	defer res.Body.Close()
-	log.Println(res)
-
-	//通过elastic连接
-	errorlog := log.New(os.Stdout, "APP", log.LstdFlags)
-	var err2 error
-	client, err = elastic.NewClient(elastic.SetSniff(false), elastic.SetErrorLog(errorlog), elastic.SetURL(host))
-	if err != nil {
-		panic(err2)
-	}
-	info, code, err := client.Ping(host).Do(context.Background())
-	if err != nil {
-		panic(err2)
-	}
-	fmt.Printf("Elasticsearch returned with code %d and version %s\n", code, info.Version.Number)
+func main() {
+	configPath := flag.String("config", "conf/app.ini", "配置文件, 环境变量 SEARCH_* 可以覆盖其中的项")
+	flag.Parse()
+	checkErr(setupConfig(*configPath))
+
+	setupBackend()
+	setupBulk()
+	checkMappings()
+	setupImporter()
+	setupReindexer()
+
+	//子命令
+	if args := flag.Args(); len(args) > 0 && args[0] == "reindex" {
+		code := runReindexCommand(args[1:])
+		ctx, cancel := context.WithTimeout(context.Background(), appConfig().Bulk.DrainTimeout)
+		closeBulk(ctx)
+		cancel()
+		os.Exit(code)
+	}
+
+	setupRiver()
+	watchRanking()
+	watchConfig()
+	serveMetrics()
+
+	server := appConfig().Server
+	srv := &http.Server{
+		Addr:         server.Addr,
+		Handler:      newRouter(),
+		ReadTimeout:  server.ReadTimeout,
+		WriteTimeout: server.WriteTimeout,
+	}
+	go func() {
+		log.Printf("listening on %s", server.Addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	waitShutdown(srv)
+}
 
-	esversion, err := client.ElasticsearchVersion(host)
-	if err != nil {
-		panic(err2)
-	}
-	fmt.Printf("Elasticsearch version %s\n", esversion)
+//收到 SIGINT/SIGTERM 后不再接收新请求, 等正在处理的请求结束, 再提交完排队的写入
+func waitShutdown(srv *http.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	log.Printf("received %v, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig().Bulk.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	closeBulk(ctx)
 }
 
-func main() {
+func newRouter() *gin.Engine {
 	//注册路由 router := routers.InitRouter()
 
-	r := gin.Default()
+	r := gin.New()
+	//recovery 在 metrics 里面, panic 的请求也按 500 统计
+	r.Use(gin.Logger(), metricsMiddleware(), recovery())
+	if m := appConfig().Metrics; m.Addr == "" {
+		r.GET(m.Path, gin.WrapH(metricsRegistry))
+	}
+	//存活和就绪检查
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "pong",
@@ -99,42 +164,87 @@ func main() {
 		c.HTML(http.StatusOK, "query.html", gin.H{"title": c.Query("title"), "ce": "123456"})
 	})
 
-	r.GET("/search", search)
-	r.GET("/searchbak", searchBak)
-	r.GET("/add/index", Add)
-	r.GET("/create_index", createIndex)
-	r.GET("/delete_index", deleteIndex)
-	r.GET("/insert_single", insertSingle)
-	r.GET("/insert_batch", insertBatch)
-	r.GET("/update_single", updateSingle)
-	r.GET("/update_query", updateByQuery)
-	r.GET("/delete_single", deleteSingle)
-	r.GET("/delete_query", deleteByQuery)
-	r.GET("/select/by/search", selectBySearch)
-	r.GET("/select/course/:title", selectCourse)
-
-	//通过elastic连接的查询
-	r.GET("/query/:title", Query)
-	r.GET("/back/query", BackQuery)
-
-	//导入数据到es
-	r.GET("/insert/course/batch", insertCourseBatch)
-
-	r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
-}
-
-type filterType int
-
-const (
-	FILTER_TYPE_TERM filterType = iota
-	FILTER_TYPE_RANGE
-)
-
-type CommonFilter struct {
-	FilterType  filterType
-	FilterName  string
-	FilterField string
-	FilterValue []interface{}
+	//搜索, public_search 关掉后要 search 角色
+	public := r.Group("", requireRole(auth.RoleSearch))
+	{
+		public.GET("/search", search)
+		public.GET("/searchbak", searchBak)
+		public.GET("/select/by/search", selectBySearch)
+		public.GET("/select/course/:title", selectCourse)
+
+		//通过elastic连接的查询
+		public.GET("/query/:title", Query)
+		public.GET("/back/query", BackQuery)
+	}
+
+	//老的写接口, 虽然是 GET 也会修改索引, 只有 admin 可以调用, 每次调用都记审计日志
+	legacy := r.Group("", audit(true), requireRole(auth.RoleAdmin))
+	{
+		legacy.GET("/add/index", Add)
+		legacy.GET("/create_index", createIndex)
+		legacy.GET("/delete_index", deleteIndex)
+		legacy.GET("/insert_batch", insertBatch)
+
+		//导入数据到es, 老接口, 等同于 POST /api/v1/import/courses
+		legacy.GET("/insert/course/batch", startCourseImport)
+	}
+
+	apiv1 := r.Group("/api/v1")
+	search := apiv1.Group("", requireRole(auth.RoleSearch))
+	{
+		//通用搜索
+		search.POST("/search", apiSearch)
+		//标题补全
+		search.GET("/suggest", suggestCourses)
+		//按时间统计
+		search.POST("/analytics/date_histogram", dateHistogram)
+	}
+
+	//能取出整个索引的读接口, 至少要 search 角色, 不受 public_search 影响
+	reader := apiv1.Group("", requireClient(auth.RoleSearch))
+	{
+		//按搜索条件导出所有文档, ndjson 或 csv, 会打开 scroll
+		reader.POST("/export", exportDocuments)
+		//按id读取文档
+		reader.GET("/indexes/:index/docs/:id", getDocument)
+	}
+
+	//索引管理, GET 以外的请求记审计日志
+	admin := apiv1.Group("", audit(false), requireRole(auth.RoleAdmin))
+	{
+		//单文档的写入, 局部更新和删除, 支持 version/if_seq_no 乐观锁
+		admin.PUT("/indexes/:index/docs/:id", putDocument)
+		admin.PATCH("/indexes/:index/docs/:id", patchDocument)
+		admin.DELETE("/indexes/:index/docs/:id", deleteDocument)
+		admin.POST("/indexes/:index/_update_by_query", updateDocumentsByQuery)
+		admin.POST("/indexes/:index/_delete_by_query", deleteDocumentsByQuery)
+		//多个索引的批量写入, 返回每一条的结果
+		admin.POST("/_bulk", bulkDocuments)
+
+		//课程导入任务
+		admin.POST("/import/courses", startCourseImport)
+		admin.GET("/import/jobs/:id", importJobStatus)
+
+		//binlog同步状态
+		admin.GET("/river/status", riverStatus)
+
+		//通过别名重建索引
+		admin.POST("/admin/reindex", startReindex)
+		admin.GET("/admin/reindex", reindexStatus)
+		//mapping 版本和线上索引的差异
+		admin.GET("/admin/mappings", listMappings)
+		admin.GET("/admin/mappings/:name/diff", diffMapping)
+		//课程同义词
+		admin.GET("/admin/synonyms", getSynonyms)
+		admin.PUT("/admin/synonyms", putSynonyms)
+		//function_score 排序方案
+		admin.GET("/admin/ranking", listRankingProfiles)
+		//搜索缓存的命中统计
+		admin.GET("/admin/cache", cacheStats)
+		admin.GET("/admin/bulk", bulkStats)
+	}
+
+	return r
 }
 
 //搜索请求参数
@@ -144,16 +254,21 @@ type HightLight struct {
 	HighlightPreTags  string
 }
 
-// 搜索请求参数
+//搜索请求参数
 type CommonSearch struct {
 	Index      string             `json:"Index" validate:"required"` // es 索引
 	SearchKey  string             // 模糊搜索词
 	FieldBoost map[string]float64 // 搜索限定字段及权重, 为空时搜索所有字段，权重默认为 1.0
-	Analyzer   string             // 默认 standard
-	SortFields map[string]string  // 排序 field -> desc/asc
-	Page       int                `json:"Page" validate:"gt=0"`
+	Analyzer   string             // 为空时用mapping里字段的 search_analyzer(中文分词+同义词)
+	Pinyin     bool               // 同时匹配 FieldBoost 里字段的拼音子字段
+	SortFields map[string]string  // 排序 field -> desc/asc, 多个字段时按字段名的顺序, 建议用 Sort
+	Sort       []*SortField       `validate:"dive"` // 按顺序的排序条件, 为空时用 SortFields 或者索引的默认排序
+	Profile    string             // 排序方案, 见 conf/ranking.toml, 为空时只按查询的相关度
+	Page       int                `json:"Page" validate:"required_without=Cursor,omitempty,gt=0"`
 	PageSize   int                `json:"PageSize" validate:"gt=0"`
+	Cursor     string             // 上一页返回的 next_cursor, 不为空时用 search_after 翻页, 忽略 Page
 	Filters    []*CommonFilter
+	Facets     []*CommonFacet `validate:"dive"` // 分面统计, 和命中一起返回
 	*HightLight
 }
 
@@ -165,15 +280,38 @@ func Query(c *gin.Context) {
 	//res, err = client.Search("course").Type("doc").Do(context.Background())
 
 	title := c.Param("title")
+	//按排序方案调整相关度, 相关度相同时新的课程在前
+	profile, err := rankingProfile(c.Query("profile"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	//方案的内容也放进key里, 方案重新加载后不会用到旧的结果
+	key, hit := searchCache.Get(appConfig().Indices.Course, gin.H{"title": title, "profile": profile}, &res)
+	if hit {
+		c.JSON(200, res)
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
 
-	MatchPhraseQuery1 := elastic.NewMatchQuery("title", title).Operator("and")
-	res, err = client.Search("course").Type("doc").Sort("createdTime", false).Size(20).Query(MatchPhraseQuery1).Do(context.Background())
+	MatchPhraseQuery1 := textQuery("title", title)
+	if profile != nil {
+		MatchPhraseQuery1 = profile.Query(MatchPhraseQuery1)
+	}
+	res, err = repo.Search(ctx, appConfig().Indices.Course, elastic.NewSearchSource().Sort("_score", false).Sort("createdTime", false).Size(20).Query(MatchPhraseQuery1))
+	if err == nil {
+		searchCache.Set(key, res)
+	}
 
 	//短语搜索 搜索about字段中有 rock climbing
 	// matchPhraseQuery := elastic.NewMatchPhraseQuery("title", title)
 	// res, err = client.Search("course").Type("doc").Query(matchPhraseQuery).Do(context.Background())
 
-	checkErr(err)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 	c.JSON(200, res)
 
 }
@@ -187,18 +325,28 @@ func BackQuery(c *gin.Context) {
 
 	subtitle := c.DefaultQuery("subtitle", "")
 
+	if title == "" && subtitle == "" {
+		abortWithError(c, errBadRequest(errors.New("title or subtitle is required")))
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
 	if subtitle != "" {
-		MatchPhraseQuery1 := elastic.NewMatchQuery("subtitle", subtitle).Operator("and")
+		MatchPhraseQuery1 := textQuery("subtitle", subtitle)
 		//res, err = client.Search("course_all").Type("back").Query(MatchPhraseQuery1).Do(context.Background())
-		res, err = client.Search("course_all").Type("doc").Query(MatchPhraseQuery1).Do(context.Background())
+		res, err = repo.Search(ctx, appConfig().Indices.CourseAll, elastic.NewSearchSource().Query(MatchPhraseQuery1))
 	} else if title != "" {
-		MatchPhraseQuery1 := elastic.NewMatchQuery("title", title).Operator("and")
+		MatchPhraseQuery1 := textQuery("title", title)
 		//res, err = client.Search("course_all").Type("back").Query(MatchPhraseQuery1).Do(context.Background())
-		res, err = client.Search("course_all").Type("doc").Sort("createdTime", false).Size(20).Query(MatchPhraseQuery1).Do(context.Background())
+		res, err = repo.Search(ctx, appConfig().Indices.CourseAll, elastic.NewSearchSource().Sort("createdTime", false).Size(20).Query(MatchPhraseQuery1))
 
 	}
 
-	checkErr(err)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
 	c.JSON(200, res)
 
 }
@@ -209,46 +357,194 @@ type Search struct {
 	title      string
 }
 
-func (r *CommonSearch) Search() (result *elastic.SearchResult, err error) {
+func (r *CommonSearch) Search(ctx context.Context) (result *elastic.SearchResult, err error) {
 	if err = validate.Struct(r); err != nil {
 		return
 	}
+	if err = checkFilters(r.Filters); err != nil {
+		return
+	}
+	if err = checkFacets(r.Facets); err != nil {
+		return
+	}
 
-	boolQuery := r.getBoolQuery()
+	var profile *ranking.Profile
+	if r.Profile != "" {
+		if profile, err = rankingProfile(r.Profile); err != nil {
+			return
+		}
+	}
 
-	search := client.Search(r.Index).Query(boolQuery)
+	key, hit := searchCache.Get(r.Index, r.cacheKey(profile), &result)
+	if hit {
+		return
+	}
+	defer func() {
+		if err == nil {
+			searchCache.Set(key, result)
+		}
+	}()
+
+	filters, selected := r.splitFilters()
+	var query elastic.Query
+	if profile != nil {
+		//请求没有限定字段时用方案里的字段权重
+		ranked := *r
+		if len(ranked.FieldBoost) == 0 {
+			ranked.FieldBoost = profile.Fields
+		}
+		query = profile.Query(ranked.getBoolQuery(filters))
+	} else {
+		query = r.getBoolQuery(filters)
+	}
 
-	if sorters := getSorters(r.SortFields); sorters != nil {
-		search.SortBy(sorters...)
+	search := elastic.NewSearchSource().Query(query)
+	if err = r.addFacets(search, selected); err != nil {
+		return
 	}
+
+	//最后按 _id 排序, 排序值相同的文档顺序也是固定的, search_after 才不会漏掉或者重复
+	sorters, err := r.getSorters()
+	if err != nil {
+		return
+	}
+	search.SortBy(append(sorters, elastic.NewFieldSort("_id").Asc())...)
 	if highlight := getHighlight(r.HightLight); highlight != nil {
 		search.Highlight(highlight)
 	}
 
-	offset := (r.Page - 1) * r.PageSize
-	resp, err := search.From(offset).Size(r.PageSize).Do(context.Background())
+	if r.Cursor != "" {
+		var after []interface{}
+		if after, err = decodeCursor(r.Cursor, len(sorters)+1); err != nil {
+			return
+		}
+		search.SearchAfter(after...)
+	} else {
+		offset := (r.Page - 1) * r.PageSize
+		if offset+r.PageSize > maxResultWindow {
+			err = errBadRequest(fmt.Errorf("page %d is beyond the first %d results, use Cursor for deep pagination", r.Page, maxResultWindow))
+			return
+		}
+		search.From(offset)
+	}
+	result, err = repo.Search(ctx, r.Index, search.Size(r.PageSize))
+	return
+}
+
+//缓存用的请求, 搜索词去掉首尾空白, 带上排序方案的内容
+func (r *CommonSearch) cacheKey(profile *ranking.Profile) interface{} {
+	normalized := *r
+	normalized.SearchKey = strings.TrimSpace(r.SearchKey)
+	return struct {
+		Request *CommonSearch
+		Profile *ranking.Profile
+	}{&normalized, profile}
+}
+
+//通用搜索的返回结构
+type SearchHit struct {
+	Id        string              `json:"id"`
+	Index     string              `json:"index"`
+	Score     *float64            `json:"score"`
+	Source    *json.RawMessage    `json:"source"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
+}
+
+type SearchResponse struct {
+	Total    int64        `json:"total"`
+	Page     int          `json:"page"`
+	PageSize int          `json:"page_size"`
+	Took     int64        `json:"took"`
+	Hits     []*SearchHit `json:"hits"`
+	//分面名 => 各取值的文档数
+	Facets map[string]*FacetResult `json:"facets,omitempty"`
+	//下一页的游标, 放到请求的 Cursor 里; 没有更多结果时为空
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+//es 默认的 index.max_result_window, from+size 不能超过它
+const maxResultWindow = 10000
+
+//游标是最后一条命中的排序值, json 后 base64, 调用方不用关心内容
+func encodeCursor(sort []interface{}) string {
+	b, _ := json.Marshal(sort)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string, n int) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errBadRequest(fmt.Errorf("invalid cursor"))
+	}
+	var after []interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	//排序值可能是很大的整数, 不能变成float64
+	d.UseNumber()
+	if err := d.Decode(&after); err != nil || len(after) != n {
+		return nil, errBadRequest(fmt.Errorf("invalid cursor"))
+	}
+	return after, nil
+}
+
+func newSearchResponse(r *CommonSearch, res *elastic.SearchResult) *SearchResponse {
+	resp := &SearchResponse{
+		Page:     r.Page,
+		PageSize: r.PageSize,
+		Took:     res.TookInMillis,
+		Hits:     make([]*SearchHit, 0),
+		Facets:   facetResults(r.Facets, res.Aggregations),
+	}
+	if res.Hits == nil {
+		return resp
+	}
+	resp.Total = res.Hits.TotalHits
+	if n := len(res.Hits.Hits); n > 0 && n == r.PageSize {
+		resp.NextCursor = encodeCursor(res.Hits.Hits[n-1].Sort)
+	}
+	for _, hit := range res.Hits.Hits {
+		resp.Hits = append(resp.Hits, &SearchHit{
+			Id:        hit.Id,
+			Index:     hit.Index,
+			Score:     hit.Score,
+			Source:    hit.Source,
+			Highlight: hit.Highlight,
+		})
+	}
+	return resp
+}
 
+// 通用搜索接口 POST /api/v1/search, body 为 CommonSearch 的 json
+func apiSearch(c *gin.Context) {
+	var req CommonSearch
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := req.Search(ctx)
 	if err != nil {
+		abortWithError(c, err)
 		return
 	}
-	return resp, nil
+	c.JSON(http.StatusOK, newSearchResponse(&req, res))
 }
 
-func (r *CommonSearch) getBoolQuery() *elastic.BoolQuery {
+func (r *CommonSearch) getBoolQuery(filters []*CommonFilter) *elastic.BoolQuery {
 	boolQuery := elastic.NewBoolQuery()
 
-	if match := getMatch(r.SearchKey, r.Analyzer, r.FieldBoost); match != nil {
+	if match := getMatch(r.SearchKey, r.Analyzer, r.FieldBoost, r.Pinyin); match != nil {
 		boolQuery.Must(match)
 	}
-	if filters := getFilters(r.Filters); filters != nil {
+	if filters := getFilters(filters); filters != nil {
 		boolQuery.Filter(filters...)
 	}
 	return boolQuery
 }
 
 // 模糊匹配
-func getMatch(searchKey string, analyzer string, fieldBoost map[string]float64) elastic.Query {
-	if fieldBoost == nil || len(fieldBoost) <= 0 {
+func getMatch(searchKey string, analyzer string, fieldBoost map[string]float64, pinyin bool) elastic.Query {
+	if searchKey == "" {
 		return nil
 	}
 
@@ -260,61 +556,26 @@ func getMatch(searchKey string, analyzer string, fieldBoost map[string]float64)
 	if analyzer != "" && len(analyzer) > 0 {
 		match.Analyzer(analyzer)
 	}
-	return match
-}
-
-// 排序设置
-func getSorters(sortFields map[string]string) []elastic.Sorter {
-	if sortFields == nil || len(sortFields) <= 0 {
-		return nil
-	}
-	sorters := make([]elastic.Sorter, 0)
-	for f, s := range sortFields {
-		fs := elastic.NewFieldSort(f)
-		if strings.ToLower(s) == "desc" {
-			fs.Desc()
-		} else {
-			fs.Asc()
-		}
-		sorters = append(sorters, fs)
-	}
-	return sorters
-}
-
-// 过滤条件
-func getFilters(filters []*CommonFilter) []elastic.Query {
-	if filters == nil || len(filters) <= 0 {
-		return nil
+	if !pinyin {
+		return match
 	}
-	var querys = make([]elastic.Query, 0)
-	for _, fl := range filters {
-		filter := getFilter(fl)
-		if filter == nil {
-			continue
+	// 拼音子字段单独查询, 不能用上面指定的分词器, 权重减半; 不限定字段时查所有拼音子字段
+	pinyinBoost := make(map[string]float64)
+	for _, f := range analysis.PinyinFields {
+		if b, ok := fieldBoost[f]; ok {
+			pinyinBoost[f] = b / 2
+		} else if len(fieldBoost) == 0 {
+			pinyinBoost[f] = 0.5
 		}
-		querys = append(querys, filter)
 	}
-	return querys
-}
-
-func getFilter(filter *CommonFilter) elastic.Query {
-	if len(filter.FilterValue) <= 0 {
-		log.Printf("filterField[%s] - filterValue is null.", filter.FilterField)
-		return nil
+	if !analysisConfig().Pinyin || len(pinyinBoost) == 0 {
+		return match
 	}
-	switch filter.FilterType {
-	case FILTER_TYPE_TERM:
-		return elastic.NewTermsQuery(filter.FilterField, filter.FilterValue...)
-	case FILTER_TYPE_RANGE:
-		rangeQuery := elastic.NewRangeQuery(filter.FilterField)
-		if len(filter.FilterValue) == 1 {
-			rangeQuery.Gte(filter.FilterValue[0])
-		} else if len(filter.FilterValue) == 2 {
-			rangeQuery.Gte(filter.FilterValue[0]).Lte(filter.FilterValue[1])
-		}
-		return rangeQuery
+	pinyinMatch := elastic.NewMultiMatchQuery(searchKey)
+	for f, b := range pinyinBoost {
+		pinyinMatch.FieldWithBoost(f+".pinyin", b)
 	}
-	return nil
+	return elastic.NewBoolQuery().Should(match, pinyinMatch).MinimumNumberShouldMatch(1)
 }
 
 // 高亮设置
@@ -327,11 +588,18 @@ func getHighlight(hightlight *HightLight) *elastic.Highlight {
 		hl := elastic.NewHighlighterField(f)
 		hlfs = append(hlfs, hl)
 	}
-	hl := elastic.NewHighlight().Fields(hlfs...).
-		PreTags(hightlight.HighlightPreTags).PostTags(hightlight.HighlightPostTags)
+	hl := elastic.NewHighlight().Fields(hlfs...)
+	//不传时使用es默认的<em>标签
+	if hightlight.HighlightPreTags != "" {
+		hl.PreTags(hightlight.HighlightPreTags)
+	}
+	if hightlight.HighlightPostTags != "" {
+		hl.PostTags(hightlight.HighlightPostTags)
+	}
 	return hl
 }
 
+//只在启动阶段使用, handler里的错误用 abortWithError 返回
 func checkErr(err error) {
 	if err != nil {
 		fmt.Println(err)
@@ -369,23 +637,19 @@ func search(c *gin.Context) {
 			},
 		},
 	}
-	jsonBody, _ := json.Marshal(query)
 
-	req := esapi.SearchRequest{
-		Index:        []string{"course"},
-		DocumentType: []string{"doc"},
-		Body:         bytes.NewReader(jsonBody),
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, appConfig().Indices.Course, query)
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	c.JSON(200, req)
+	c.JSON(200, res)
 }
 
 func searchBak(c *gin.Context) {
 	//执行es查询返回json
-	var buf bytes.Buffer
-
 	query := map[string]interface{}{
 		"query": map[string]interface{}{
 			"match": map[string]interface{}{
@@ -393,23 +657,15 @@ func searchBak(c *gin.Context) {
 			},
 		},
 	}
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		log.Fatalf("Error encoding query: %s", err)
-	}
 
-	res, err := es.Search(
-		es.Search.WithContext(context.Background()),
-		es.Search.WithIndex("course"),
-		es.Search.WithBody(&buf),
-		es.Search.WithTrackTotalHits(true),
-		es.Search.WithPretty(),
-	)
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, appConfig().Indices.Course, query)
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
+		abortWithError(c, err)
+		return
 	}
-	defer res.Body.Close()
-
-	c.JSON(200, json.NewDecoder(res.Body).Decode(&r))
+	c.JSON(200, res)
 }
 
 // }
@@ -417,312 +673,92 @@ func searchBak(c *gin.Context) {
 func Add(c *gin.Context) {
 	// Build the request body.
 	var title string = "Test One"
-	var b strings.Builder
-	b.WriteString(`{"title" : "`)
-	b.WriteString(title)
-	b.WriteString(`"}`)
-
-	// Set up the request object.
-	req := esapi.IndexRequest{
-		Index:      "test",
-		DocumentID: strconv.Itoa(1),
-		Body:       strings.NewReader(b.String()),
-		Refresh:    "true",
+	body := map[string]interface{}{
+		"title": title,
 	}
 
 	// Perform the request with the client.
-	res, err := req.Do(context.Background(), es)
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Index(ctx, "test", strconv.Itoa(1), body)
 	if err != nil {
-		log.Fatalf("Error getting response: %s", err)
-	}
-	defer res.Body.Close()
-
-	if res.IsError() {
-		log.Printf("[%s] Error indexing document ID=%d", res.Status(), 1)
-	} else {
-		// Deserialize the response into a map.
-		var r map[string]interface{}
-		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-			log.Printf("Error parsing the response body: %s", err)
-		} else {
-			// Print the response status and indexed document version.
-			log.Printf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
-		}
+		log.Printf("Error indexing document ID=%d", 1)
+		abortWithError(c, err)
+		return
 	}
 
+	// Print the response status and indexed document version.
+	log.Printf("%s; version=%d", res.Result, res.Version)
 }
 
-//添加索引
+//添加索引, mapping 见 conf/mappings/test_index_v1.json
 func createIndex(c *gin.Context) {
-	body := map[string]interface{}{
-		"mappings": map[string]interface{}{
-			"test_type": map[string]interface{}{
-				"properties": map[string]interface{}{
-					"str": map[string]interface{}{
-						"type": "keyword", // 表示这个字段不分词
-					},
-				},
-			},
-		},
+	m, err := registry.Latest("test_index")
+	if err != nil {
+		abortWithError(c, errInternal(err))
+		return
 	}
-	jsonBody, _ := json.Marshal(body)
-	req := esapi.IndicesCreateRequest{
-		Index: "test_index",
-		Body:  bytes.NewReader(jsonBody),
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.CreateIndex(ctx, "test_index", m.Body)
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
+	c.JSON(http.StatusOK, res)
 }
 
 //删除索引
 func deleteIndex(c *gin.Context) {
-	req := esapi.IndicesDeleteRequest{
-		Index: []string{"test_index"},
-	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-//插入单条数据
-func insertSingle(c *gin.Context) {
-	body := map[string]interface{}{
-		"num": 0,
-		"v":   0,
-		"str": "test",
-	}
-	jsonBody, _ := json.Marshal(body)
-
-	req := esapi.CreateRequest{ // 如果是esapi.IndexRequest则是插入/替换
-		Index:        "test_index",
-		DocumentType: "test_type",
-		DocumentID:   "test_1",
-		Body:         bytes.NewReader(jsonBody),
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.DeleteIndex(ctx, "test_index")
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
+	c.JSON(http.StatusOK, res)
 }
 
 //批量插入(很明显，也可以批量做其他操作)
 func insertBatch(c *gin.Context) {
-	var bodyBuf bytes.Buffer
+	requests := make([]elastic.BulkableRequest, 0)
 	for i := 2; i < 10; i++ {
-		createLine := map[string]interface{}{
-			"create": map[string]interface{}{
-				"_index": "test_index",
-				"_id":    "test_" + strconv.Itoa(i),
-				"_type":  "test_type",
-			},
-		}
-		jsonStr, _ := json.Marshal(createLine)
-		bodyBuf.Write(jsonStr)
-		bodyBuf.WriteByte('\n')
-
 		body := map[string]interface{}{
 			"num": i % 3,
 			"v":   i,
 			"str": "test" + strconv.Itoa(i),
 		}
-		jsonStr, _ = json.Marshal(body)
-		bodyBuf.Write(jsonStr)
-		bodyBuf.WriteByte('\n')
-	}
-
-	req := esapi.BulkRequest{
-		Body: &bodyBuf,
-	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-func insertCourseBatch(c *gin.Context) {
-	var bodyBuf bytes.Buffer
-	db, _ := sql.Open("mysql", "root:root@tcp(127.0.0.1:3306)/edusoho?charset=utf8")
-
-	if errConn := db.Ping(); errConn != nil {
-		fmt.Println("open database fail")
-		return
+		doc := elastic.NewBulkIndexRequest().OpType("create").
+			Index("test_index").Type("test_type").Id("test_" + strconv.Itoa(i)).Doc(body)
+		requests = append(requests, doc)
 	}
 
-	if errConn := db.Ping(); errConn != nil {
-		fmt.Println("open database fail")
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Bulk(ctx, requests...)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
-
-	fmt.Println("connect success")
-	defer db.Close()
-
-	//查询出数据表里的url构建urls
-	rows, err := db.Query("SELECT id,title,categoryId,createdTime,showMode FROM course_set_v8 where showMode=1 categoryId not in (23, 24, 25)")
-	checkErr(err)
-
-	//使用sqlNull***来避免为null情况
-	for rows.Next() {
-		var id int
-		var title string
-		var categoryId int
-		var createdTime int
-		var showMode int
-
-		err = rows.Scan(&id, &title, &categoryId, &createdTime, &showMode)
-		checkErr(err)
-
-		fmt.Println(id)
-		fmt.Println(title)
-		fmt.Println(categoryId)
-
-		createLine := map[string]interface{}{
-			"create": map[string]interface{}{
-				"_index": "course",
-				"_id":    strconv.Itoa(id),
-				"_type":  "course_type",
-			},
-		}
-
-		jsonStr, _ := json.Marshal(createLine)
-		bodyBuf.Write(jsonStr)
-		bodyBuf.WriteByte('\n')
-
-		body := map[string]interface{}{
-			"id":          id,
-			"title":       title,
-			"categoryId":  categoryId,
-			"createdTime": createdTime,
-		}
-		jsonStr, _ = json.Marshal(body)
-		bodyBuf.Write(jsonStr)
-		bodyBuf.WriteByte('\n')
-
-	}
-
-	req := esapi.BulkRequest{
-		Body: &bodyBuf,
-	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-//根据id更新
-func updateSingle(c *gin.Context) {
-	body := map[string]interface{}{
-		"doc": map[string]interface{}{
-			"v": 100,
-		},
-	}
-	jsonBody, _ := json.Marshal(body)
-	req := esapi.UpdateRequest{
-		Index:        "test_index",
-		DocumentType: "test_type",
-		DocumentID:   "test_1",
-		Body:         bytes.NewReader(jsonBody),
-	}
-
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-//根据条件更新
-func updateByQuery(c *gin.Context) {
-	body := map[string]interface{}{
-		"script": map[string]interface{}{
-			"lang": "painless",
-			"source": `
-                ctx._source.v = params.value;
-            `,
-			"params": map[string]interface{}{
-				"value": 101,
-			},
-		},
-		"query": map[string]interface{}{
-			"match_all": map[string]interface{}{},
-		},
-	}
-	jsonBody, _ := json.Marshal(body)
-	req := esapi.UpdateByQueryRequest{
-		Index: []string{"test_index"},
-		Body:  bytes.NewReader(jsonBody),
-	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-//根据id删除
-func deleteSingle(c *gin.Context) {
-	req := esapi.DeleteRequest{
-		Index:        "test_index",
-		DocumentType: "test_type",
-		DocumentID:   "test_1",
-	}
-
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
-}
-
-func deleteByQuery(c *gin.Context) {
-	body := map[string]interface{}{
-		"query": map[string]interface{}{
-			"match_all": map[string]interface{}{},
-		},
-	}
-	jsonBody, _ := json.Marshal(body)
-	req := esapi.DeleteByQueryRequest{
-		Index: []string{"test_index"},
-		Body:  bytes.NewReader(jsonBody),
-	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
-	fmt.Println(res.String())
+	c.JSON(http.StatusOK, res)
 }
 
 func selectBySearch(c *gin.Context) {
-	url := "http://116.62.107.108:9200/course/_search"
-	query := []byte(`{
-            "query":{
-                "bool": {
-                    "should": [
-                    {"match": {"title": "遴选"}},
-                    ]
-                }
-            }
-            }`)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(query))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	fmt.Println(resp.Body)
-	body, err := ioutil.ReadAll(resp.Body)
+	query := elastic.NewBoolQuery().Should(elastic.NewMatchQuery("title", "遴选"))
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, appConfig().Indices.Course, elastic.NewSearchSource().Query(query))
 	if err != nil {
-		panic(err)
+		abortWithError(c, err)
+		return
 	}
-
-	fmt.Printf("%s", string(body))
+	c.JSON(http.StatusOK, res)
 }
 
 func selectCourse(c *gin.Context) {
 	//执行es查询返回json
-	var buf bytes.Buffer
-
 	title := c.Param("title")
 
 	query := map[string]interface{}{
@@ -732,27 +768,14 @@ func selectCourse(c *gin.Context) {
 			},
 		},
 	}
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		log.Fatalf("Error encoding query: %s", err)
-	}
-
-	jsonBody, _ := json.Marshal(query)
 
-	req := esapi.SearchRequest{
-		Index:        []string{"course"},
-		DocumentType: []string{"course_type"},
-		Body:         bytes.NewReader(jsonBody),
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, appConfig().Indices.Course, query)
+	if err != nil {
+		abortWithError(c, err)
+		return
 	}
-	res, err := req.Do(context.Background(), es)
-	checkErr(err)
-	defer res.Body.Close()
 
-	c.JSON(200, res.String())
+	c.JSON(200, res)
 }
-
-//同步mysql到es
-//go-mysql-elasticsearch
-//开启mysql binlog日志，且必须为ROW格式
-
-// <p>通常配置文件都是在mysql的my.cnf，不知道在哪的可以用<br><code>whereis my.cnf</code>
-// 找到，然后把<code>binlog_format</code>配置 <code> cat /etc/my.cnf|grep binlog_format</code>修改成ROW，重启！</p>
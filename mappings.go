@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"edusoho_search/mappings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//启动时把线上索引和最新的mapping对比, 不兼容的变化只打日志, 需要手动重建索引
+func checkMappings() {
+	ctx := context.Background()
+	for _, name := range registry.Names() {
+		if exists, err := repo.IndexExists(ctx, name); err != nil || !exists {
+			continue
+		}
+		m, _ := registry.Latest(name)
+		report, err := mappings.Diff(ctx, repo, m, name)
+		if err != nil {
+			log.Printf("mapping %s: %v", name, err)
+			continue
+		}
+		for _, change := range report.Changes {
+			if !change.Compatible {
+				log.Printf("mapping %s: %s %s: %s", name, change.Kind, change.Path, change.Reason)
+			}
+		}
+		if report.RequiresReindex {
+			log.Printf("mapping %s: index %s is not compatible with version %d, run reindex", name, report.Index, m.Version)
+		}
+	}
+}
+
+type mappingVersions struct {
+	Name     string `json:"name"`
+	Versions []int  `json:"versions"`
+}
+
+func listMappings(c *gin.Context) {
+	list := make([]mappingVersions, 0)
+	for _, name := range registry.Names() {
+		item := mappingVersions{Name: name}
+		for _, m := range registry.Versions(name) {
+			item.Versions = append(item.Versions, m.Version)
+		}
+		list = append(list, item)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+//GET /api/v1/admin/mappings/:name/diff?version=3&index=course, 默认最新版本和同名的索引(别名)
+func diffMapping(c *gin.Context) {
+	name := c.Param("name")
+	version, err := strconv.Atoi(c.DefaultQuery("version", "0"))
+	if err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	m, err := registry.Get(name, version)
+	if err != nil {
+		abortWithError(c, errNotFound(err.Error()))
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	report, err := mappings.Diff(ctx, repo, m, c.DefaultQuery("index", name))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,259 @@
+package mappings
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"edusoho_search/backend"
+)
+
+const (
+	ChangeAdded   = "added"   //文件里有, 线上没有
+	ChangeRemoved = "removed" //线上有, 文件里没有
+	ChangeChanged = "changed"
+)
+
+type Change struct {
+	Path       string      `json:"path"` //mappings.doc.properties.title.type 这样的路径
+	Kind       string      `json:"kind"`
+	Live       interface{} `json:"live,omitempty"`
+	Want       interface{} `json:"want,omitempty"`
+	Compatible bool        `json:"compatible"` //false 表示只能重建索引
+	Reason     string      `json:"reason,omitempty"`
+}
+
+type Report struct {
+	Name    string   `json:"name"`
+	Version int      `json:"version"`
+	Index   string   `json:"index"` //线上实际的索引名
+	Changes []Change `json:"changes"`
+	//有不兼容的变化, 需要按新版本重建索引
+	RequiresReindex bool `json:"requires_reindex"`
+}
+
+func (r *Report) add(c Change) {
+	r.Changes = append(r.Changes, c)
+	if !c.Compatible {
+		r.RequiresReindex = true
+	}
+}
+
+//可以在已有字段上直接修改的参数
+var updatableParams = map[string]bool{
+	"ignore_above":          true,
+	"search_analyzer":       true,
+	"search_quote_analyzer": true,
+	"boost":                 true,
+}
+
+//es返回mapping时会省略默认值, 文件里写了默认值不算变化
+var defaultParams = map[string]interface{}{
+	"index":      true,
+	"doc_values": true,
+	"store":      false,
+	"norms":      true,
+}
+
+//动态的索引设置, 可以直接修改
+var dynamicSettings = map[string]bool{
+	"number_of_replicas":   true,
+	"refresh_interval":     true,
+	"max_result_window":    true,
+	"auto_expand_replicas": true,
+}
+
+//把 index 对应的线上mapping/settings 和文件里的版本对比, index 可以是别名
+func Diff(ctx context.Context, repo backend.SearchBackend, m *Mapping, index string) (*Report, error) {
+	liveMappings, err := repo.GetMapping(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	liveSettings, err := repo.GetSettings(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	if len(liveMappings) != 1 {
+		return nil, fmt.Errorf("mappings: %s resolves to %d indices", index, len(liveMappings))
+	}
+	report := &Report{Name: m.Name, Version: m.Version, Changes: make([]Change, 0)}
+	var mapping, settings map[string]interface{}
+	for name, v := range liveMappings {
+		report.Index = name
+		body, _ := v.(map[string]interface{})
+		mapping, _ = body["mappings"].(map[string]interface{})
+	}
+	if s, ok := liveSettings[report.Index].(map[string]interface{}); ok {
+		settings = s
+	}
+	DiffMappings(report, m.Mappings, mapping)
+	DiffSettings(report, m.Settings, settings)
+	return report, nil
+}
+
+//按type比较字段定义
+func DiffMappings(report *Report, want, live map[string]interface{}) {
+	for _, typ := range sortedKeys(want) {
+		wantType, _ := want[typ].(map[string]interface{})
+		liveType, ok := live[typ].(map[string]interface{})
+		path := "mappings." + typ
+		if !ok {
+			//es6一个索引只能有一个type
+			report.add(Change{Path: path, Kind: ChangeAdded, Compatible: len(live) == 0, Reason: "mapping type does not exist in the live index"})
+			continue
+		}
+		wantProps, _ := wantType["properties"].(map[string]interface{})
+		liveProps, _ := liveType["properties"].(map[string]interface{})
+		diffProperties(report, path+".properties", wantProps, liveProps)
+	}
+}
+
+func diffProperties(report *Report, path string, want, live map[string]interface{}) {
+	for _, field := range sortedKeys(want) {
+		wantDef, _ := want[field].(map[string]interface{})
+		liveDef, ok := live[field].(map[string]interface{})
+		if !ok {
+			report.add(Change{Path: path + "." + field, Kind: ChangeAdded, Want: wantDef, Compatible: true, Reason: "new field can be added with put mapping"})
+			continue
+		}
+		diffField(report, path+"."+field, wantDef, liveDef)
+	}
+	for _, field := range sortedKeys(live) {
+		if _, ok := want[field]; !ok {
+			report.add(Change{Path: path + "." + field, Kind: ChangeRemoved, Live: live[field], Compatible: true, Reason: "field stays in the live index until it is rebuilt"})
+		}
+	}
+}
+
+func diffField(report *Report, path string, want, live map[string]interface{}) {
+	if wantType, liveType := fieldType(want), fieldType(live); wantType != liveType {
+		report.add(Change{Path: path + ".type", Kind: ChangeChanged, Live: liveType, Want: wantType, Reason: "field type can not be changed"})
+		return
+	}
+	params := make(map[string]bool)
+	for k := range want {
+		params[k] = true
+	}
+	for k := range live {
+		params[k] = true
+	}
+	for _, param := range sortedKeys(params) {
+		switch param {
+		case "type":
+			continue
+		case "properties":
+			wantProps, _ := want[param].(map[string]interface{})
+			liveProps, _ := live[param].(map[string]interface{})
+			diffProperties(report, path+".properties", wantProps, liveProps)
+			continue
+		case "fields":
+			//多字段可以新增, 已有的不能改
+			wantFields, _ := want[param].(map[string]interface{})
+			liveFields, _ := live[param].(map[string]interface{})
+			diffProperties(report, path+".fields", wantFields, liveFields)
+			continue
+		}
+		wantValue, inWant := want[param]
+		liveValue, inLive := live[param]
+		if !inWant {
+			wantValue = defaultParams[param]
+		}
+		if !inLive {
+			liveValue = defaultParams[param]
+		}
+		if equal(wantValue, liveValue) {
+			continue
+		}
+		c := Change{Path: path + "." + param, Kind: ChangeChanged, Live: liveValue, Want: wantValue, Compatible: updatableParams[param]}
+		if !c.Compatible {
+			c.Reason = fmt.Sprintf("%s can not be changed on an existing field", param)
+		}
+		report.add(c)
+	}
+}
+
+//有 properties 没有 type 的是 object
+func fieldType(def map[string]interface{}) string {
+	if t, ok := def["type"].(string); ok {
+		return t
+	}
+	if _, ok := def["properties"]; ok {
+		return "object"
+	}
+	return ""
+}
+
+//只比较文件里写了的设置, 线上多出来的(uuid, creation_date等)不管
+func DiffSettings(report *Report, want, live map[string]interface{}) {
+	wantFlat := make(map[string]interface{})
+	flatten("", want, wantFlat)
+	liveFlat := make(map[string]interface{})
+	flatten("", live, liveFlat)
+	for _, key := range sortedKeys(wantFlat) {
+		liveValue, ok := liveFlat[key]
+		if ok && equal(wantFlat[key], liveValue) {
+			continue
+		}
+		setting := strings.TrimPrefix(key, "index.")
+		c := Change{Path: "settings." + key, Kind: ChangeChanged, Live: liveValue, Want: wantFlat[key]}
+		if !ok {
+			c.Kind = ChangeAdded
+		}
+		switch {
+		case dynamicSettings[setting]:
+			c.Compatible = true
+		case strings.HasPrefix(setting, "analysis."):
+			c.Reason = "analysis settings need the index closed, and existing documents keep the old analysis"
+		default:
+			c.Reason = fmt.Sprintf("%s is fixed at index creation", setting)
+		}
+		report.add(c)
+	}
+}
+
+//settings 统一成 index.xxx.yyy 的形式
+func flatten(prefix string, v map[string]interface{}, out map[string]interface{}) {
+	for k, value := range v {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		} else if k != "index" && !strings.HasPrefix(k, "index.") {
+			key = "index." + k
+		}
+		if m, ok := value.(map[string]interface{}); ok {
+			flatten(key, m, out)
+			continue
+		}
+		out[key] = value
+	}
+}
+
+//es返回的设置值都是字符串, 数字和布尔按字符串比较
+func equal(a, b interface{}) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+	switch a.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return a != nil && b != nil && fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := make([]string, 0)
+	switch t := m.(type) {
+	case map[string]interface{}:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range t {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,123 @@
+package mappings
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+)
+
+//模板数据, 和 analysis.Config 的字段一致
+type analysisData struct {
+	Pinyin   bool
+	Synonyms []string
+}
+
+func (analysisData) IndexTokenizer() string  { return "ik_max_word" }
+func (analysisData) SearchTokenizer() string { return "ik_smart" }
+
+func TestLoad(t *testing.T) {
+	r, err := Load("../conf/mappings", analysisData{Pinyin: true, Synonyms: []string{"公务员, 公考"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := r.Latest("course")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IndexName() != "course_v8" || m.Mappings["doc"] == nil || m.Settings["analysis"] == nil {
+		t.Errorf("latest course mapping = %+v", m)
+	}
+	if _, err := r.Get("course", 99); err == nil {
+		t.Error("unknown version should fail")
+	}
+
+	analysis := m.Settings["analysis"].(map[string]interface{})
+	analyzer := analysis["analyzer"].(map[string]interface{})
+	if tokenizer := analyzer["course_index"].(map[string]interface{})["tokenizer"]; tokenizer != "ik_max_word" {
+		t.Errorf("course_index tokenizer = %v", tokenizer)
+	}
+	synonyms := analysis["filter"].(map[string]interface{})["course_synonym"].(map[string]interface{})["synonyms"]
+	if !reflect.DeepEqual(synonyms, []interface{}{"公务员, 公考"}) {
+		t.Errorf("synonyms = %v", synonyms)
+	}
+	if !strings.Contains(m.Body, `"pinyin": {`) {
+		t.Error("pinyin sub-field is missing")
+	}
+
+	//重新渲染: 关掉拼音, 同义词为空
+	if err := r.Render(analysisData{Synonyms: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = r.Latest("course")
+	if strings.Contains(m.Body, "pinyin") || !strings.Contains(m.Body, `"synonyms": []`) {
+		t.Errorf("rendered without pinyin:\n%s", m.Body)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	repo, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Load("../conf/mappings", analysisData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := r.Get("course", 3)
+	ctx := context.Background()
+
+	//按文件建的索引没有差异
+	if _, err := repo.CreateIndex(ctx, m.IndexName(), m.Body); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Diff(ctx, repo, m, m.IndexName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changes) != 0 || report.RequiresReindex {
+		t.Errorf("changes against itself = %+v", report.Changes)
+	}
+
+	//老的 course 索引: title 是 keyword, 没有 subtitle 和分词器
+	old := `{"settings":{"number_of_shards":5,"number_of_replicas":2},
+		"mappings":{"doc":{"properties":{"id":{"type":"long"},"title":{"type":"keyword"},
+		"categoryId":{"type":"long"},"createdTime":{"type":"long"},"showMode":{"type":"integer"},"price":{"type":"float"}}}}}`
+	if _, err := repo.CreateIndex(ctx, "course", old); err != nil {
+		t.Fatal(err)
+	}
+	report, err = Diff(ctx, repo, m, "course")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"mappings.doc.properties.title.type":                     false,
+		"mappings.doc.properties.subtitle":                       true,
+		"mappings.doc.properties.price":                          true,
+		"settings.index.number_of_shards":                        false,
+		"settings.index.number_of_replicas":                      true,
+		"settings.index.analysis.analyzer.course_text.type":      false,
+		"settings.index.analysis.analyzer.course_text.tokenizer": false,
+		"settings.index.analysis.analyzer.course_text.filter":    false,
+	}
+	got := make(map[string]bool)
+	for _, c := range report.Changes {
+		got[c.Path] = c.Compatible
+	}
+	for path, compatible := range want {
+		if c, ok := got[path]; !ok || c != compatible {
+			t.Errorf("%s: reported %v (compatible %v), want compatible %v", path, ok, c, compatible)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("changes = %+v", report.Changes)
+	}
+	if !report.RequiresReindex || report.Index != "course" {
+		t.Errorf("report = %+v", report)
+	}
+}
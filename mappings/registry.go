@@ -0,0 +1,158 @@
+//mappings 管理带版本号的索引 mapping/settings 文件(conf/mappings/<name>_v<N>.json), 并和线上索引做对比
+//
+//文件按 text/template 渲染, 数据是分词配置(analysis.Config), 比如 {{.IndexTokenizer}}, {{json .Synonyms}}
+package mappings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+)
+
+//一个版本的索引定义, Body 是建索引时原样发给es的内容
+type Mapping struct {
+	Name     string                 `json:"name"`
+	Version  int                    `json:"version"`
+	Settings map[string]interface{} `json:"settings,omitempty"`
+	Mappings map[string]interface{} `json:"mappings,omitempty"`
+	Body     string                 `json:"-"`
+}
+
+//带版本号的索引名, 比如 course_v3
+func (m *Mapping) IndexName() string {
+	return VersionedName(m.Name, m.Version)
+}
+
+func VersionedName(name string, version int) string {
+	return name + "_v" + strconv.Itoa(version)
+}
+
+type Registry struct {
+	dir       string
+	templates map[string]*template.Template //文件名 => 模板
+
+	mu       sync.RWMutex
+	mappings map[string][]*Mapping //按版本升序
+}
+
+var fileName = regexp.MustCompile(`^(.+)_v(\d+)\.json$`)
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+//启动时加载目录下的所有mapping文件, 模板或者渲染出的json格式不对时报错
+func Load(dir string, data interface{}) (*Registry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{dir: dir, templates: make(map[string]*template.Template)}
+	for _, f := range files {
+		match := fileName.FindStringSubmatch(f.Name())
+		if f.IsDir() || match == nil {
+			continue
+		}
+		if version, _ := strconv.Atoi(match[2]); version == 0 {
+			return nil, fmt.Errorf("mappings: %s: version starts at 1", f.Name())
+		}
+		text, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(f.Name()).Funcs(funcs).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("mappings: %v", err)
+		}
+		r.templates[f.Name()] = tmpl
+	}
+	if err := r.Render(data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//配置变化(比如同义词更新)后重新渲染所有文件, 失败时保留原来的结果
+func (r *Registry) Render(data interface{}) error {
+	all := make(map[string][]*Mapping)
+	for file, tmpl := range r.templates {
+		match := fileName.FindStringSubmatch(file)
+		version, _ := strconv.Atoi(match[2])
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("mappings: %v", err)
+		}
+		m := &Mapping{Name: match[1], Version: version, Body: buf.String()}
+		var body struct {
+			Settings map[string]interface{} `json:"settings"`
+			Mappings map[string]interface{} `json:"mappings"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &body); err != nil {
+			return fmt.Errorf("mappings: %s: %v", file, err)
+		}
+		m.Settings, m.Mappings = body.Settings, body.Mappings
+		all[m.Name] = append(all[m.Name], m)
+	}
+	for _, list := range all {
+		sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	}
+	r.mu.Lock()
+	r.mappings = all
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) Dir() string {
+	return r.dir
+}
+
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.mappings))
+	for name := range r.mappings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//所有版本, 按版本升序
+func (r *Registry) Versions(name string) []*Mapping {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.mappings[name]
+}
+
+//version为0时返回最新版本
+func (r *Registry) Get(name string, version int) (*Mapping, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := r.mappings[name]
+	if len(list) == 0 {
+		return nil, fmt.Errorf("mappings: no mapping for %s in %s", name, r.dir)
+	}
+	if version == 0 {
+		return list[len(list)-1], nil
+	}
+	for _, m := range list {
+		if m.Version == version {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("mappings: no mapping for %s version %d", name, version)
+}
+
+func (r *Registry) Latest(name string) (*Mapping, error) {
+	return r.Get(name, 0)
+}
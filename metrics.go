@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"edusoho_search/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+//prometheus 指标, GET /metrics
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	httpRequests = metricsRegistry.Counter("http_requests_total", "HTTP requests by method, route and status.", "method", "route", "status")
+	httpDuration = metricsRegistry.Histogram("http_request_duration_seconds", "HTTP request latency by method and route.", nil, "method", "route")
+
+	esMetrics = metrics.NewESMetrics(metricsRegistry)
+)
+
+func init() {
+	//缓存关闭时都是0
+	metricsRegistry.CounterFunc("search_cache_hits_total", "Search cache hits.", func() float64 {
+		return float64(searchCache.Stats().Hits)
+	})
+	metricsRegistry.CounterFunc("search_cache_misses_total", "Search cache misses.", func() float64 {
+		return float64(searchCache.Stats().Misses)
+	})
+	metricsRegistry.CounterFunc("search_cache_errors_total", "Search cache store errors, treated as misses.", func() float64 {
+		return float64(searchCache.Stats().Errors)
+	})
+	metricsRegistry.CounterFunc("search_cache_invalidations_total", "Search cache invalidations caused by index writes.", func() float64 {
+		return float64(searchCache.Stats().Invalidations)
+	})
+	metricsRegistry.GaugeFunc("bulk_queued_actions", "Actions waiting in the bulk processor queue.", func() float64 {
+		return float64(bulkProcessor.Stats().Queued)
+	})
+	metricsRegistry.GaugeFunc("bulk_in_flight_actions", "Actions in bulk requests being sent.", func() float64 {
+		return float64(bulkProcessor.Stats().InFlight)
+	})
+	metricsRegistry.CounterFunc("bulk_succeeded_actions_total", "Actions written by the bulk processor.", func() float64 {
+		return float64(bulkProcessor.Stats().Succeeded)
+	})
+	metricsRegistry.CounterFunc("bulk_failed_actions_total", "Actions the bulk processor failed to write.", func() float64 {
+		return float64(bulkProcessor.Stats().Failed)
+	})
+}
+
+//按路由统计请求数和耗时, 路由用注册时的路径, 404 的请求都算 unmatched
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		//断开连接的请求(panic(http.ErrAbortHandler))也要统计
+		defer func() {
+			route := c.FullPath()
+			if route == "" {
+				route = "unmatched"
+			}
+			httpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+			httpDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+		}()
+		c.Next()
+	}
+}
+
+//[metrics] addr 不为空时在单独的端口上提供 /metrics, 不对外暴露
+func serveMetrics() {
+	addr, path := appConfig().Metrics.Addr, appConfig().Metrics.Path
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, metricsRegistry)
+	go func() {
+		log.Printf("metrics listening on %s%s", addr, path)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("metrics server: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,263 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//es 访问的指标
+type ESMetrics struct {
+	Duration  *HistogramVec // 每种操作的耗时, 包括网络
+	Errors    *CounterVec   // 按操作和错误类型统计的失败次数
+	Took      *HistogramVec // 搜索返回的 took, es 内部的耗时
+	BulkItems *CounterVec   // bulk 写入的文档数, 按索引和成功失败
+}
+
+func NewESMetrics(r *Registry) *ESMetrics {
+	return &ESMetrics{
+		Duration:  r.Histogram("es_request_duration_seconds", "Elasticsearch request latency by operation.", nil, "op"),
+		Errors:    r.Counter("es_errors_total", "Elasticsearch request errors by operation and error type.", "op", "type"),
+		Took:      r.Histogram("es_search_took_seconds", "Search time reported by Elasticsearch (took).", nil, "index"),
+		BulkItems: r.Counter("es_bulk_items_total", "Documents sent in bulk requests by index and result.", "index", "result"),
+	}
+}
+
+//包一层 backend 记录每次访问es的耗时和错误, 导入和river的 bulk 也经过这里
+type instrumented struct {
+	backend.SearchBackend
+	m *ESMetrics
+	//搜索指标按这些索引名分开统计, 其他的都算 other
+	indices map[string]bool
+}
+
+//indices 是配置里的索引或者别名; 搜索接口可以传任意名字和通配符, 不能直接做标签
+func InstrumentBackend(b backend.SearchBackend, m *ESMetrics, indices ...string) backend.SearchBackend {
+	known := make(map[string]bool, len(indices))
+	for _, index := range indices {
+		known[index] = true
+	}
+	return &instrumented{SearchBackend: b, m: m, indices: known}
+}
+
+func (b *instrumented) indexLabel(index string) string {
+	if b.indices[index] {
+		return index
+	}
+	return "other"
+}
+
+//err 传指针, defer 的时候还没有返回值
+func (b *instrumented) observe(op string, start time.Time, err *error) {
+	b.m.Duration.Observe(time.Since(start).Seconds(), op)
+	if *err != nil {
+		b.m.Errors.Inc(op, ErrorType(*err))
+	}
+}
+
+//错误类型: es 返回的 error.type, 没有时用状态码; 连不上, 超时和取消单独统计
+func ErrorType(err error) string {
+	if e, ok := err.(*elastic.Error); ok {
+		if e.Details != nil && e.Details.Type != "" {
+			return e.Details.Type
+		}
+		return fmt.Sprintf("http_%d", e.Status)
+	}
+	switch {
+	case elastic.IsConnErr(err):
+		return "connection"
+	case elastic.IsContextErr(err):
+		if err == context.Canceled {
+			return "canceled"
+		}
+		return "timeout"
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
+
+func (b *instrumented) Ping(ctx context.Context) (res *elastic.PingResult, err error) {
+	defer b.observe("ping", time.Now(), &err)
+	return b.SearchBackend.Ping(ctx)
+}
+
+func (b *instrumented) Version(ctx context.Context) (res string, err error) {
+	defer b.observe("ping", time.Now(), &err)
+	return b.SearchBackend.Version(ctx)
+}
+
+func (b *instrumented) ClusterHealth(ctx context.Context) (res *elastic.ClusterHealthResponse, err error) {
+	defer b.observe("cluster_health", time.Now(), &err)
+	return b.SearchBackend.ClusterHealth(ctx)
+}
+
+func (b *instrumented) IndexExists(ctx context.Context, index ...string) (res bool, err error) {
+	defer b.observe("index_exists", time.Now(), &err)
+	return b.SearchBackend.IndexExists(ctx, index...)
+}
+
+func (b *instrumented) CreateIndex(ctx context.Context, index string, body interface{}) (res *elastic.IndicesCreateResult, err error) {
+	defer b.observe("create_index", time.Now(), &err)
+	return b.SearchBackend.CreateIndex(ctx, index, body)
+}
+
+func (b *instrumented) DeleteIndex(ctx context.Context, index ...string) (res *elastic.IndicesDeleteResponse, err error) {
+	defer b.observe("delete_index", time.Now(), &err)
+	return b.SearchBackend.DeleteIndex(ctx, index...)
+}
+
+func (b *instrumented) GetMapping(ctx context.Context, index string) (res map[string]interface{}, err error) {
+	defer b.observe("get_mapping", time.Now(), &err)
+	return b.SearchBackend.GetMapping(ctx, index)
+}
+
+func (b *instrumented) GetSettings(ctx context.Context, index string) (res map[string]interface{}, err error) {
+	defer b.observe("get_settings", time.Now(), &err)
+	return b.SearchBackend.GetSettings(ctx, index)
+}
+
+func (b *instrumented) PutSettings(ctx context.Context, index string, settings map[string]interface{}) (err error) {
+	defer b.observe("put_settings", time.Now(), &err)
+	return b.SearchBackend.PutSettings(ctx, index, settings)
+}
+
+func (b *instrumented) CloseIndex(ctx context.Context, index string) (err error) {
+	defer b.observe("close_index", time.Now(), &err)
+	return b.SearchBackend.CloseIndex(ctx, index)
+}
+
+func (b *instrumented) OpenIndex(ctx context.Context, index string) (err error) {
+	defer b.observe("open_index", time.Now(), &err)
+	return b.SearchBackend.OpenIndex(ctx, index)
+}
+
+func (b *instrumented) Refresh(ctx context.Context, index ...string) (err error) {
+	defer b.observe("refresh", time.Now(), &err)
+	return b.SearchBackend.Refresh(ctx, index...)
+}
+
+func (b *instrumented) Count(ctx context.Context, index string) (res int64, err error) {
+	defer b.observe("count", time.Now(), &err)
+	return b.SearchBackend.Count(ctx, index)
+}
+
+func (b *instrumented) AliasIndices(ctx context.Context, alias string) (res []string, err error) {
+	defer b.observe("get_aliases", time.Now(), &err)
+	return b.SearchBackend.AliasIndices(ctx, alias)
+}
+
+func (b *instrumented) ResolveIndices(ctx context.Context, expr string) (res []string, err error) {
+	defer b.observe("resolve_indices", time.Now(), &err)
+	return b.SearchBackend.ResolveIndices(ctx, expr)
+}
+
+func (b *instrumented) UpdateAliases(ctx context.Context, actions ...elastic.AliasAction) (err error) {
+	defer b.observe("update_aliases", time.Now(), &err)
+	return b.SearchBackend.UpdateAliases(ctx, actions...)
+}
+
+func (b *instrumented) Reindex(ctx context.Context, source, dest string) (res *elastic.BulkIndexByScrollResponse, err error) {
+	defer b.observe("reindex", time.Now(), &err)
+	return b.SearchBackend.Reindex(ctx, source, dest)
+}
+
+func (b *instrumented) Index(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (res *elastic.IndexResponse, err error) {
+	defer b.observe("index", time.Now(), &err)
+	return b.SearchBackend.Index(ctx, index, id, doc, opts...)
+}
+
+func (b *instrumented) Create(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (res *elastic.IndexResponse, err error) {
+	defer b.observe("create", time.Now(), &err)
+	return b.SearchBackend.Create(ctx, index, id, doc, opts...)
+}
+
+func (b *instrumented) Get(ctx context.Context, index, id string, opts ...backend.DocOption) (res *elastic.GetResult, err error) {
+	defer b.observe("get", time.Now(), &err)
+	return b.SearchBackend.Get(ctx, index, id, opts...)
+}
+
+func (b *instrumented) Update(ctx context.Context, index, id string, doc interface{}, opts ...backend.DocOption) (res *elastic.UpdateResponse, err error) {
+	defer b.observe("update", time.Now(), &err)
+	return b.SearchBackend.Update(ctx, index, id, doc, opts...)
+}
+
+func (b *instrumented) Delete(ctx context.Context, index, id string, opts ...backend.DocOption) (res *elastic.DeleteResponse, err error) {
+	defer b.observe("delete", time.Now(), &err)
+	return b.SearchBackend.Delete(ctx, index, id, opts...)
+}
+
+//按返回的每一条统计成功失败; 整个请求失败时所有文档都算失败
+func (b *instrumented) Bulk(ctx context.Context, requests ...elastic.BulkableRequest) (res *elastic.BulkResponse, err error) {
+	start := time.Now()
+	res, err = b.SearchBackend.Bulk(ctx, requests...)
+	b.observe("bulk", start, &err)
+	if err != nil || res == nil {
+		for _, r := range requests {
+			b.m.BulkItems.Inc(bulkIndex(r), "failed")
+		}
+		return
+	}
+	for _, item := range res.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				b.m.BulkItems.Inc(result.Index, "succeeded")
+			} else {
+				b.m.BulkItems.Inc(result.Index, "failed")
+			}
+		}
+	}
+	return
+}
+
+//bulk 请求第一行 {"index": {"_index": "course", ...}} 里的索引
+func bulkIndex(r elastic.BulkableRequest) string {
+	lines, err := r.Source()
+	if err != nil || len(lines) == 0 {
+		return ""
+	}
+	var action map[string]struct {
+		Index string `json:"_index"`
+	}
+	json.Unmarshal([]byte(lines[0]), &action)
+	for _, meta := range action {
+		return meta.Index
+	}
+	return ""
+}
+
+func (b *instrumented) Search(ctx context.Context, index string, source interface{}) (res *elastic.SearchResult, err error) {
+	start := time.Now()
+	res, err = b.SearchBackend.Search(ctx, index, source)
+	b.observe("search", start, &err)
+	if err == nil {
+		b.m.Took.Observe(float64(res.TookInMillis)/1000, b.indexLabel(index))
+	}
+	return
+}
+
+//每一批都记录一次 took, 耗时是整个滚动的时间
+func (b *instrumented) Scroll(ctx context.Context, index string, source *elastic.SearchSource, keepAlive string, fn func(*elastic.SearchResult) error) (err error) {
+	defer b.observe("scroll", time.Now(), &err)
+	return b.SearchBackend.Scroll(ctx, index, source, keepAlive, func(res *elastic.SearchResult) error {
+		b.m.Took.Observe(float64(res.TookInMillis)/1000, b.indexLabel(index))
+		return fn(res)
+	})
+}
+
+func (b *instrumented) UpdateByQuery(ctx context.Context, index string, query elastic.Query, script *elastic.Script, opts ...backend.DocOption) (res *elastic.BulkIndexByScrollResponse, err error) {
+	defer b.observe("update_by_query", time.Now(), &err)
+	return b.SearchBackend.UpdateByQuery(ctx, index, query, script, opts...)
+}
+
+func (b *instrumented) DeleteByQuery(ctx context.Context, index string, query elastic.Query, opts ...backend.DocOption) (res *elastic.BulkIndexByScrollResponse, err error) {
+	defer b.observe("delete_by_query", time.Now(), &err)
+	return b.SearchBackend.DeleteByQuery(ctx, index, query, opts...)
+}
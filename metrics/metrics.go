@@ -0,0 +1,284 @@
+//metrics 输出 prometheus 文本格式的监控指标, 只实现了用到的 counter, gauge 和 histogram,
+//没有引入 prometheus/client_golang
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//prometheus 默认的分桶, 单位秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+//一组指标, 按注册的顺序输出
+type Registry struct {
+	mu      sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+//名字重复是代码错误, 直接 panic
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+//一个指标按 label 的取值分成多条, 取值用 \xff 连起来做 key
+type series struct {
+	labels []string
+	value  interface{}
+}
+
+type vec struct {
+	name, help, typ string
+	labels          []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	return &vec{name: name, help: help, typ: typ, labels: labels, series: make(map[string]*series)}
+}
+
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...), value: create()}
+		v.series[key] = s
+	}
+	return s.value
+}
+
+//按 label 取值排序, 每次输出的顺序一样
+func (v *vec) sorted() []*series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = v.series[k]
+	}
+	return list
+}
+
+func (v *vec) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, escapeHelp(v.help), v.name, v.typ)
+}
+
+//计数器, 只增不减
+type CounterVec struct {
+	*vec
+}
+
+type counter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	s := c.get(values, func() interface{} { return &counter{} }).(*counter)
+	s.mu.Lock()
+	s.v += delta
+	s.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+//测试用
+func (c *CounterVec) Value(values ...string) float64 {
+	s := c.get(values, func() interface{} { return &counter{} }).(*counter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.v
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	for _, s := range c.sorted() {
+		v := s.value.(*counter)
+		v.mu.Lock()
+		writeSample(w, c.name, c.labels, s.labels, "", "", v.v)
+		v.mu.Unlock()
+	}
+}
+
+//直方图, 每个桶是小于等于上界的次数
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{vec: newVec(name, help, "histogram", labels), buckets: buckets}
+	r.register(name, h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	s := h.get(values, func() interface{} { return &histogram{counts: make([]uint64, len(h.buckets))} }).(*histogram)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+//测试用, 返回观察的次数和总和
+func (h *HistogramVec) Count(values ...string) (uint64, float64) {
+	s := h.get(values, func() interface{} { return &histogram{counts: make([]uint64, len(h.buckets))} }).(*histogram)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.sum
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	for _, s := range h.sorted() {
+		v := s.value.(*histogram)
+		v.mu.Lock()
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(upper), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", v.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(v.count))
+		v.mu.Unlock()
+	}
+}
+
+//输出时才取值, 用来导出其他地方已经有的统计, 比如缓存命中数和连接数
+type funcMetric struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name, help, "gauge", fn})
+}
+
+//fn 的返回值必须只增不减
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name, help, "counter", fn})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, m.typ)
+	writeSample(w, m.name, nil, nil, "", "", m.fn())
+}
+
+func writeSample(w *bufio.Writer, name string, names, values []string, extraName, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(names) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, n := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", n, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+
+	"github.com/olivere/elastic/v6"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type = %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("requests_total", "Requests.", "route", "status")
+	c.Inc("/b", "200")
+	c.Add(2, "/a", "500")
+	c.Inc("/quote\"", "200")
+	h := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.5, "/a")
+	h.Observe(5, "/a")
+	r.GaugeFunc("open", "Open connections.\nsecond line", func() float64 { return 3 })
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="/a",status="500"} 2
+requests_total{route="/b",status="200"} 1
+requests_total{route="/quote\"",status="200"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 5.55
+latency_seconds_count{route="/a"} 3
+# HELP open Open connections.\nsecond line
+# TYPE open gauge
+open 3
+`
+	if got := scrape(t, r); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x_total", "x")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering x_total twice should panic")
+		}
+	}()
+	r.GaugeFunc("x_total", "x", func() float64 { return 0 })
+}
+
+func TestErrorType(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{&elastic.Error{Status: 404, Details: &elastic.ErrorDetails{Type: "index_not_found_exception"}}, "index_not_found_exception"},
+		{&elastic.Error{Status: 409}, "http_409"},
+		{elastic.ErrNoClient, "connection"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{errors.New("boom"), "other"},
+	}
+	for _, c := range cases {
+		if got := ErrorType(c.err); got != c.want {
+			t.Errorf("ErrorType(%v) = %q, want %q", c.err, got, c.want)
+		}
+	}
+}
+
+func TestInstrumentBackend(t *testing.T) {
+	server := estest.NewServer()
+	defer server.Close()
+	r := NewRegistry()
+	m := NewESMetrics(r)
+	es, err := backend.New(backend.Config{Addresses: []string{server.URL}, Transport: NewTransport(r, nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := InstrumentBackend(es, m, "course")
+	ctx := context.Background()
+
+	if _, err := b.Bulk(ctx,
+		elastic.NewBulkIndexRequest().Index("course").Type("doc").Id("1").Doc(map[string]interface{}{"title": "遴选"}),
+		elastic.NewBulkIndexRequest().Index("course").Type("doc").Id("2").Doc(map[string]interface{}{"title": "申论"}),
+		elastic.NewBulkUpdateRequest().Index("course").Type("doc").Id("3").Doc(map[string]interface{}{"title": "面试"}),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.BulkItems.Value("course", "succeeded"); n != 2 {
+		t.Errorf("succeeded = %v, want 2", n)
+	}
+	if n := m.BulkItems.Value("course", "failed"); n != 1 {
+		t.Errorf("failed = %v, want 1 (update of a missing document)", n)
+	}
+
+	if _, err := b.Search(ctx, "course", elastic.NewSearchSource()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := m.Took.Count("course"); n != 1 {
+		t.Errorf("took observations = %d", n)
+	}
+	//不在配置里的名字和通配符都算 other
+	for _, index := range []string{"cour*", "course,course"} {
+		if _, err := b.Search(ctx, index, elastic.NewSearchSource()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := m.Took.Count("other"); n != 2 {
+		t.Errorf("took observations for other = %d", n)
+	}
+	if n, _ := m.Took.Count("cour*"); n != 0 {
+		t.Errorf("took observations labelled with the request's index = %d", n)
+	}
+	if _, err := b.Search(ctx, "missing", elastic.NewSearchSource()); err == nil {
+		t.Fatal("search on a missing index should fail")
+	}
+	if n := m.Errors.Value("search", "index_not_found_exception"); n != 1 {
+		t.Errorf("search errors = %v", n)
+	}
+	if n, _ := m.Duration.Count("search"); n != 4 {
+		t.Errorf("search duration observations = %d", n)
+	}
+
+	out := scrape(t, r)
+	for _, want := range []string{
+		`es_http_connections_total{reused="false"} 1`,
+		`es_http_connections_total{reused="true"}`,
+		"es_http_connections_open 1",
+		"es_http_requests_in_flight 0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+//es 客户端连接池的状态: 打开的连接数, 正在进行的请求数, 新建和复用连接的次数
+type Transport struct {
+	base http.RoundTripper
+
+	open, inFlight int64
+	conns          *CounterVec
+}
+
+//包装 t 的拨号和请求, t 为 nil 时用 http.DefaultTransport 的副本
+func NewTransport(r *Registry, t *http.Transport) *Transport {
+	if t == nil {
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	tr := &Transport{
+		base:  t,
+		conns: r.Counter("es_http_connections_total", "Connections used for Elasticsearch requests, new or reused from the pool.", "reused"),
+	}
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&tr.open, 1)
+		return &trackedConn{Conn: conn, open: &tr.open}, nil
+	}
+	r.GaugeFunc("es_http_connections_open", "Open connections to Elasticsearch.", func() float64 {
+		return float64(atomic.LoadInt64(&tr.open))
+	})
+	r.GaugeFunc("es_http_requests_in_flight", "Elasticsearch requests waiting for a response.", func() float64 {
+		return float64(atomic.LoadInt64(&tr.inFlight))
+	})
+	return tr
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.conns.Inc("true")
+			} else {
+				t.conns.Inc("false")
+			}
+		},
+	}
+	atomic.AddInt64(&t.inFlight, 1)
+	defer atomic.AddInt64(&t.inFlight, -1)
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+//关闭时打开的连接数减一, Close 可能被调用多次
+type trackedConn struct {
+	net.Conn
+	open   *int64
+	closed int32
+}
+
+func (c *trackedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.open, -1)
+	}
+	return c.Conn.Close()
+}
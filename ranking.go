@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"edusoho_search/ranking"
+
+	"github.com/gin-gonic/gin"
+)
+
+//function_score 排序方案, 配置文件修改后自动重新加载
+var rankings *ranking.Store
+
+func loadRanking() error {
+	store, err := ranking.Open(appConfig().Ranking.File)
+	if err != nil {
+		return err
+	}
+	rankings = store
+	return nil
+}
+
+//在main里启动, 测试时不需要
+func watchRanking() {
+	interval := appConfig().Ranking.ReloadInterval
+	log.Printf("ranking profiles %v, default %q", rankings.Names(), rankings.Default())
+	go rankings.Watch(context.Background(), interval)
+}
+
+//name 为空时是默认方案, 可能为 nil
+func rankingProfile(name string) (*ranking.Profile, error) {
+	p, err := rankings.Get(name)
+	if err == ranking.ErrUnknownProfile {
+		return nil, errBadRequest(fmt.Errorf("unknown ranking profile %q", name))
+	}
+	return p, err
+}
+
+//GET /api/v1/admin/ranking, 当前生效的排序方案
+func listRankingProfiles(c *gin.Context) {
+	profiles := make(map[string]*ranking.Profile)
+	for _, name := range rankings.Names() {
+		if p, err := rankings.Get(name); err == nil {
+			profiles[name] = p
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"default": rankings.Default(), "profiles": profiles})
+}
@@ -0,0 +1,191 @@
+//ranking 是课程搜索的排序方案, 用 function_score 按发布时间衰减, 学员数/评分, 分类调整相关度,
+//方案写在 conf/ranking.toml 里, 文件修改后自动重新加载
+package ranking
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//按时间(或者数值)离 origin 的距离衰减
+type Decay struct {
+	Field    string  `toml:"field"`    // 比如 createdTime.date
+	Function string  `toml:"function"` // gauss(默认), exp, linear
+	Origin   string  `toml:"origin"`   // 日期字段为空时是 now
+	Scale    string  `toml:"scale"`    // 距离 origin 多远时得分降到 decay, 比如 30d
+	Offset   string  `toml:"offset"`   // 这个距离以内不衰减
+	Decay    float64 `toml:"decay"`    // 默认 0.5
+	Weight   float64 `toml:"weight"`
+}
+
+//按字段的值加分, 比如学员数, 评分
+type FieldFactor struct {
+	Field    string  `toml:"field"`
+	Factor   float64 `toml:"factor"`   // 默认 1
+	Modifier string  `toml:"modifier"` // none(默认), log1p, sqrt 等, 和es的 field_value_factor 一致
+	Missing  float64 `toml:"missing"`  // 没有值的文档当作这个值
+	Weight   float64 `toml:"weight"`
+}
+
+//一个排序方案
+type Profile struct {
+	Name          string             `toml:"-"`
+	Fields        map[string]float64 `toml:"fields"`         // 请求没有指定 FieldBoost 时搜索的字段和权重
+	CategoryField string             `toml:"category_field"` // 默认 categoryId
+	Categories    map[string]float64 `toml:"categories"`     // 分类id => 权重
+	Recency       *Decay             `toml:"recency"`
+	Popularity    []*FieldFactor     `toml:"popularity"`
+	ScoreMode     string             `toml:"score_mode"` // 各个函数得分的合并方式, 默认 sum
+	BoostMode     string             `toml:"boost_mode"` // 和查询得分的合并方式, 默认 multiply
+	MaxBoost      float64            `toml:"max_boost"`
+}
+
+//conf/ranking.toml
+type Config struct {
+	Default  string              `toml:"default"` // /query/:title 等没有指定方案时使用
+	Profiles map[string]*Profile `toml:"profile"`
+}
+
+var (
+	decayFunctions = []string{"gauss", "exp", "linear"}
+	modifiers      = []string{"none", "log", "log1p", "log2p", "ln", "ln1p", "ln2p", "square", "sqrt", "reciprocal"}
+	scoreModes     = []string{"multiply", "sum", "avg", "first", "max", "min"}
+	boostModes     = []string{"multiply", "replace", "sum", "avg", "max", "min"}
+)
+
+func oneOf(v string, allowed []string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validate() error {
+	for name, p := range c.Profiles {
+		p.Name = name
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	if c.Default != "" && c.Profiles[c.Default] == nil {
+		return fmt.Errorf("default profile %s is not defined", c.Default)
+	}
+	return nil
+}
+
+func (p *Profile) validate() error {
+	if p.CategoryField == "" {
+		p.CategoryField = "categoryId"
+	}
+	if p.ScoreMode == "" {
+		p.ScoreMode = "sum"
+	}
+	if p.BoostMode == "" {
+		p.BoostMode = "multiply"
+	}
+	if !oneOf(p.ScoreMode, scoreModes) {
+		return fmt.Errorf("unknown score_mode %q", p.ScoreMode)
+	}
+	if !oneOf(p.BoostMode, boostModes) {
+		return fmt.Errorf("unknown boost_mode %q", p.BoostMode)
+	}
+	if d := p.Recency; d != nil {
+		if d.Field == "" || d.Scale == "" {
+			return fmt.Errorf("recency needs field and scale")
+		}
+		if d.Function == "" {
+			d.Function = "gauss"
+		}
+		if !oneOf(d.Function, decayFunctions) {
+			return fmt.Errorf("unknown decay function %q", d.Function)
+		}
+		if d.Decay == 0 {
+			d.Decay = 0.5
+		}
+		if d.Decay <= 0 || d.Decay >= 1 {
+			return fmt.Errorf("recency decay must be between 0 and 1")
+		}
+	}
+	for _, f := range p.Popularity {
+		if f.Field == "" {
+			return fmt.Errorf("popularity needs field")
+		}
+		if f.Factor == 0 {
+			f.Factor = 1
+		}
+		if f.Modifier == "" {
+			f.Modifier = "none"
+		}
+		if !oneOf(f.Modifier, modifiers) {
+			return fmt.Errorf("unknown modifier %q", f.Modifier)
+		}
+	}
+	for id, w := range p.Categories {
+		if w <= 0 {
+			return fmt.Errorf("category %s: weight must be positive", id)
+		}
+	}
+	return nil
+}
+
+//Decay 直接作为 function_score 的函数, olivere 的三种衰减函数是不同的类型, 不方便按配置选择
+func (d *Decay) Name() string {
+	return d.Function
+}
+
+func (d *Decay) GetWeight() *float64 {
+	if d.Weight > 0 {
+		return &d.Weight
+	}
+	return nil
+}
+
+func (d *Decay) Source() (interface{}, error) {
+	params := map[string]interface{}{"scale": d.Scale, "decay": d.Decay}
+	if d.Origin != "" {
+		params["origin"] = d.Origin
+	}
+	if d.Offset != "" {
+		params["offset"] = d.Offset
+	}
+	return map[string]interface{}{d.Field: params}, nil
+}
+
+//用 function_score 包住原来的查询, 没有任何函数时原样返回
+func (p *Profile) Query(query elastic.Query) elastic.Query {
+	fs := elastic.NewFunctionScoreQuery().Query(query).ScoreMode(p.ScoreMode).BoostMode(p.BoostMode)
+	if p.MaxBoost > 0 {
+		fs.MaxBoost(p.MaxBoost)
+	}
+	n := 0
+	if p.Recency != nil {
+		fs.AddScoreFunc(p.Recency)
+		n++
+	}
+	for _, f := range p.Popularity {
+		fn := elastic.NewFieldValueFactorFunction().Field(f.Field).Factor(f.Factor).Modifier(f.Modifier).Missing(f.Missing)
+		if f.Weight > 0 {
+			fn.Weight(f.Weight)
+		}
+		fs.AddScoreFunc(fn)
+		n++
+	}
+	//分类按id排序, 生成的查询每次一样
+	ids := make([]string, 0, len(p.Categories))
+	for id := range p.Categories {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fs.Add(elastic.NewTermQuery(p.CategoryField, id), elastic.NewWeightFactorFunction(p.Categories[id]))
+		n++
+	}
+	if n == 0 {
+		return query
+	}
+	return fs
+}
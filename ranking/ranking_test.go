@@ -0,0 +1,106 @@
+package ranking
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/olivere/elastic/v6"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ranking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "ranking.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := LoadConfig("../conf/ranking.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profiles[cfg.Default] == nil {
+		t.Errorf("default profile %q is not defined", cfg.Default)
+	}
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	cases := map[string]string{
+		"bad score mode": "[profile.a]\nscore_mode = \"nope\"",
+		"no scale":       "[profile.a.recency]\nfield = \"createdTime.date\"",
+		"bad modifier":   "[[profile.a.popularity]]\nfield = \"studentNum\"\nmodifier = \"cube\"",
+		"bad category":   "[profile.a.categories]\n\"1\" = -1.0",
+		"no default":     "default = \"b\"\n[profile.a]",
+	}
+	for name, content := range cases {
+		if _, err := LoadConfig(writeConfig(t, dir, content)); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestProfileQuery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeConfig(t, dir, `
+[profile.a]
+[profile.a.recency]
+field = "createdTime.date"
+scale = "30d"
+[[profile.a.popularity]]
+field = "studentNum"
+modifier = "log1p"
+[profile.a.categories]
+"2" = 1.5
+
+[profile.empty]
+`)
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, _ := p.Query(elastic.NewMatchAllQuery()).Source()
+	b, _ := json.Marshal(src)
+	for _, want := range []string{
+		`"gauss":{"createdTime.date":{"decay":0.5,"scale":"30d"}}`,
+		`"field_value_factor":{"factor":1,"field":"studentNum","missing":0,"modifier":"log1p"}`,
+		`"filter":{"term":{"categoryId":"2"}},"weight":1.5`,
+		`"boost_mode":"multiply"`,
+		`"score_mode":"sum"`,
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("query %s does not contain %s", b, want)
+		}
+	}
+
+	//没有函数的方案不包 function_score
+	empty, _ := store.Get("empty")
+	if _, ok := empty.Query(elastic.NewMatchAllQuery()).(*elastic.MatchAllQuery); !ok {
+		t.Error("empty profile should return the query unchanged")
+	}
+	if _, err := store.Get("nope"); err != ErrUnknownProfile {
+		t.Errorf("unknown profile: err = %v", err)
+	}
+	if p, err := store.Get(""); p != nil || err != nil {
+		t.Errorf("no default: %v, %v", p, err)
+	}
+}
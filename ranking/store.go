@@ -0,0 +1,120 @@
+package ranking
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var ErrUnknownProfile = errors.New("unknown ranking profile")
+
+//当前生效的排序方案, 配置文件改了以后 Reload 换成新的, 新配置有错时保留旧的
+type Store struct {
+	path string
+
+	mu      sync.RWMutex
+	cfg     *Config
+	modTime time.Time
+}
+
+func LoadConfig(path string) (*Config, error) {
+	var cfg Config
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+//文件不存在时没有任何方案, 之后创建了也会加载
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, cfg: &Config{}}
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//文件的修改时间变了才重新加载, 返回是否加载了新配置
+func (s *Store) Reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	same := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	cfg, err := LoadConfig(s.path)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	s.cfg, s.modTime = cfg, info.ModTime()
+	s.mu.Unlock()
+	return true, nil
+}
+
+//定时检查配置文件, ctx 取消时退出
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if ok, err := s.Reload(); err != nil {
+				log.Printf("ranking: reload %s failed, keep the old profiles: %v", s.path, err)
+			} else if ok {
+				log.Printf("ranking: reloaded %s, profiles %v", s.path, s.Names())
+			}
+		}
+	}
+}
+
+//name 为空时返回默认方案, 没有默认方案时返回 nil
+func (s *Store) Get(name string) (*Profile, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name == "" {
+		name = s.cfg.Default
+		if name == "" {
+			return nil, nil
+		}
+	}
+	p, ok := s.cfg.Profiles[name]
+	if !ok {
+		return nil, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+func (s *Store) Default() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg.Default
+}
+
+func (s *Store) Names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.cfg.Profiles))
+	for name := range s.cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"edusoho_search/reindex"
+
+	"github.com/gin-gonic/gin"
+)
+
+var reindexer *reindex.Reindexer
+
+func setupReindexer() {
+	var load reindex.LoadFunc
+	if courseImporter != nil {
+		load = func(ctx context.Context, index string) (int64, int64, error) {
+			status, err := courseImporter.WithIndex(index).Run(ctx)
+			return status.Succeeded, status.Failed, err
+		}
+	}
+	reindexer = reindex.New(repo, registry, load)
+}
+
+//POST /api/v1/admin/reindex, 后台执行, 进度用 GET 查询
+func startReindex(c *gin.Context) {
+	var opts reindex.Options
+	if err := c.ShouldBindJSON(&opts); err != nil {
+		abortWithError(c, errBadRequest(err))
+		return
+	}
+	if err := validate.Struct(opts); err != nil {
+		abortWithError(c, err)
+		return
+	}
+	if err := reindexer.Start(opts); err != nil {
+		if errors.Is(err, reindex.ErrRunning) {
+			abortWithError(c, errConflict(err))
+			return
+		}
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, reindexer.Status())
+}
+
+func reindexStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, reindexer.Status())
+}
+
+//命令行: edusoho_search reindex -alias course -version 3 -source mysql -drop-old
+func runReindexCommand(args []string) int {
+	fs := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	var opts reindex.Options
+	fs.StringVar(&opts.Alias, "alias", appConfig().Indices.Course, "alias to rebuild")
+	fs.IntVar(&opts.Version, "version", 0, "mapping version, 0 for the latest")
+	fs.StringVar(&opts.Source, "source", reindex.SourceReindex, "where to load documents from: mysql or reindex")
+	fs.BoolVar(&opts.DropOld, "drop-old", false, "delete the previous index after the alias is swapped")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := validate.Struct(opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	res, err := reindexer.Run(context.Background(), opts)
+	if res != nil {
+		data, _ := json.MarshalIndent(res, "", "  ")
+		fmt.Println(string(data))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+//reindex 通过别名无停机重建索引: 建带版本号的新索引(course_v3), 导入数据, 核对文档数, 再原子地把别名切过去
+package reindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/mappings"
+
+	"github.com/olivere/elastic/v6"
+)
+
+const (
+	SourceMySQL   = "mysql"   //从mysql重新导入
+	SourceReindex = "reindex" //用es的 _reindex 从旧索引复制, 复制期间旧索引禁止写入
+)
+
+var ErrRunning = errors.New("reindex: a reindex is already running")
+
+type Options struct {
+	Alias   string `json:"alias" validate:"required"`
+	Version int    `json:"version"` //0 表示用最新版本的 mapping
+	Source  string `json:"source" validate:"omitempty,oneof=mysql reindex"`
+	DropOld bool   `json:"drop_old"` //切换后删除旧索引
+}
+
+type Result struct {
+	Alias    string   `json:"alias"`
+	Index    string   `json:"index"`
+	Previous []string `json:"previous"` //切换前别名指向的索引
+	Source   string   `json:"source"`
+	Expected int64    `json:"expected"`
+	Count    int64    `json:"count"`
+	Dropped  []string `json:"dropped,omitempty"`
+	//复制期间禁止写入的旧索引, 这段时间的写入会返回 403, 切换别名后解除
+	Blocked []string `json:"blocked,omitempty"`
+}
+
+//把数据从mysql导入到index, 返回成功和失败的条数
+type LoadFunc func(ctx context.Context, index string) (succeeded, failed int64, err error)
+
+type Status struct {
+	Running    bool       `json:"running"`
+	Options    *Options   `json:"options,omitempty"`
+	Result     *Result    `json:"result,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Note       string     `json:"note,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Reindexer struct {
+	repo     backend.SearchBackend
+	registry *mappings.Registry
+	load     LoadFunc
+
+	mu     sync.Mutex
+	status Status
+}
+
+//load 为nil时不支持从mysql导入
+func New(repo backend.SearchBackend, registry *mappings.Registry, load LoadFunc) *Reindexer {
+	return &Reindexer{repo: repo, registry: registry, load: load}
+}
+
+func (r *Reindexer) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+//后台执行, 同一时间只允许一个
+func (r *Reindexer) Start(opts Options) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.Running {
+		return ErrRunning
+	}
+	now := time.Now()
+	r.status = Status{Running: true, Options: &opts, StartedAt: &now}
+	if opts.Source == "" || opts.Source == SourceReindex {
+		r.status.Note = fmt.Sprintf("writes to %s are rejected until the alias is swapped, the river retries them, other clients must retry too", opts.Alias)
+	}
+	go func() {
+		res, err := r.Run(context.Background(), opts)
+		if err != nil {
+			log.Printf("reindex %s failed: %v", opts.Alias, err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		finished := time.Now()
+		r.status.Running = false
+		r.status.Result = res
+		r.status.FinishedAt = &finished
+		if err != nil {
+			r.status.Error = err.Error()
+		}
+	}()
+	return nil
+}
+
+//同步执行整个流程, 失败时删掉新建的索引, 别名保持不变
+func (r *Reindexer) Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Source == "" {
+		opts.Source = SourceReindex
+	}
+	m, err := r.registry.Get(opts.Alias, opts.Version)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Alias: opts.Alias, Index: m.IndexName(), Source: opts.Source}
+
+	//别名还不存在时, 可能是以前直接用别名这个名字建的索引
+	concrete := false
+	res.Previous, err = r.repo.AliasIndices(ctx, opts.Alias)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Previous) == 0 {
+		if concrete, err = r.repo.IndexExists(ctx, opts.Alias); err != nil {
+			return nil, err
+		}
+		if concrete {
+			res.Previous = []string{opts.Alias}
+		}
+	}
+	for _, index := range res.Previous {
+		if index == res.Index {
+			return nil, fmt.Errorf("reindex: alias %s already points to %s", opts.Alias, res.Index)
+		}
+	}
+	if exists, err := r.repo.IndexExists(ctx, res.Index); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, fmt.Errorf("reindex: index %s already exists", res.Index)
+	}
+
+	if _, err := r.repo.CreateIndex(ctx, res.Index, m.Body); err != nil {
+		return nil, err
+	}
+	defer func() {
+		//删掉的旧索引不用解除
+		if len(res.Blocked) > 0 && len(res.Dropped) == 0 {
+			if err := r.blockWrites(context.Background(), res.Blocked, false); err != nil {
+				log.Printf("reindex: unblock writes to %v: %v", res.Blocked, err)
+			}
+		}
+	}()
+	if err := r.fill(ctx, opts, res); err != nil {
+		if _, derr := r.repo.DeleteIndex(context.Background(), res.Index); derr != nil {
+			log.Printf("reindex: drop %s after failure: %v", res.Index, derr)
+		}
+		return res, err
+	}
+
+	//加新别名, 去掉旧别名, 在一个请求里完成
+	actions := []elastic.AliasAction{elastic.NewAliasAddAction(opts.Alias).Index(res.Index)}
+	for _, index := range res.Previous {
+		if concrete {
+			actions = append(actions, elastic.NewAliasRemoveIndexAction(index))
+		} else {
+			actions = append(actions, elastic.NewAliasRemoveAction(opts.Alias).Index(index))
+		}
+	}
+	if err := r.repo.UpdateAliases(ctx, actions...); err != nil {
+		return res, err
+	}
+	if concrete {
+		//remove_index 已经删掉了旧索引
+		res.Dropped = res.Previous
+	} else if opts.DropOld && len(res.Previous) > 0 {
+		if _, err := r.repo.DeleteIndex(ctx, res.Previous...); err != nil {
+			return res, err
+		}
+		res.Dropped = res.Previous
+	}
+	return res, nil
+}
+
+//导入数据并核对文档数
+func (r *Reindexer) fill(ctx context.Context, opts Options, res *Result) error {
+	switch opts.Source {
+	case SourceReindex:
+		if len(res.Previous) == 0 {
+			return fmt.Errorf("reindex: no index behind %s to copy from", opts.Alias)
+		}
+		//_reindex 只复制开始时的快照, 之后写到旧索引的文档切换别名后就丢了
+		res.Blocked = res.Previous
+		if err := r.blockWrites(ctx, res.Previous, true); err != nil {
+			return err
+		}
+		if err := r.repo.Refresh(ctx, opts.Alias); err != nil {
+			return err
+		}
+		count, err := r.repo.Count(ctx, opts.Alias)
+		if err != nil {
+			return err
+		}
+		res.Expected = count
+		if _, err := r.repo.Reindex(ctx, opts.Alias, res.Index); err != nil {
+			return err
+		}
+	case SourceMySQL:
+		if r.load == nil {
+			return errors.New("reindex: loading from mysql is not configured")
+		}
+		succeeded, failed, err := r.load(ctx, res.Index)
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("reindex: %d documents failed to load into %s", failed, res.Index)
+		}
+		res.Expected = succeeded
+	default:
+		return fmt.Errorf("reindex: unknown source %q", opts.Source)
+	}
+
+	if err := r.repo.Refresh(ctx, res.Index); err != nil {
+		return err
+	}
+	count, err := r.repo.Count(ctx, res.Index)
+	if err != nil {
+		return err
+	}
+	res.Count = count
+	if count != res.Expected {
+		return fmt.Errorf("reindex: %s has %d documents, expected %d", res.Index, count, res.Expected)
+	}
+	return nil
+}
+
+func (r *Reindexer) blockWrites(ctx context.Context, indices []string, blocked bool) error {
+	settings := map[string]interface{}{"index": map[string]interface{}{"blocks": map[string]interface{}{"write": blocked}}}
+	for _, index := range indices {
+		if err := r.repo.PutSettings(ctx, index, settings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package reindex
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+	"edusoho_search/mappings"
+
+	"github.com/olivere/elastic/v6"
+)
+
+const mapping = `{"mappings":{"doc":{"properties":{"id":{"type":"long"},"title":{"type":"text"}}}}}`
+
+func setup(t *testing.T) (backend.SearchBackend, *mappings.Registry, func()) {
+	server := estest.NewServer()
+	repo, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mappings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"course_v3.json", "course_v4.json", "other_v9.json"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(mapping), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	registry, err := mappings.Load(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, registry, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func seed(t *testing.T, repo backend.SearchBackend, index string, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		doc := map[string]interface{}{"id": i, "title": fmt.Sprintf("course %d", i)}
+		if _, err := repo.Index(context.Background(), index, fmt.Sprint(i), doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func aliasIndices(t *testing.T, repo backend.SearchBackend, alias string) []string {
+	t.Helper()
+	indices, err := repo.AliasIndices(context.Background(), alias)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indices
+}
+
+func TestRunReindex(t *testing.T) {
+	repo, registry, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+	//老的 course 是实际的索引, 第一次要用 remove_index 换成别名
+	seed(t, repo, "course", 3)
+	r := New(repo, registry, nil)
+
+	res, err := r.Run(ctx, Options{Alias: "course", Version: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Index != "course_v3" || res.Count != 3 || res.Expected != 3 || !reflect.DeepEqual(res.Dropped, []string{"course"}) {
+		t.Errorf("result = %+v", res)
+	}
+	if got := aliasIndices(t, repo, "course"); !reflect.DeepEqual(got, []string{"course_v3"}) {
+		t.Fatalf("course -> %v", got)
+	}
+	if n, err := repo.Count(ctx, "course"); err != nil || n != 3 {
+		t.Errorf("count through alias = %d, %v", n, err)
+	}
+
+	//不指定版本时用最新的 mapping
+	res, err = r.Run(ctx, Options{Alias: "course", DropOld: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Index != "course_v4" || !reflect.DeepEqual(res.Previous, []string{"course_v3"}) || !reflect.DeepEqual(res.Dropped, []string{"course_v3"}) {
+		t.Errorf("result = %+v", res)
+	}
+	if got := aliasIndices(t, repo, "course"); !reflect.DeepEqual(got, []string{"course_v4"}) {
+		t.Errorf("course -> %v", got)
+	}
+	if exists, _ := repo.IndexExists(ctx, "course_v3"); exists {
+		t.Error("course_v3 was not dropped")
+	}
+
+	if _, err := r.Run(ctx, Options{Alias: "course", Version: 4}); err == nil {
+		t.Error("rebuilding the current version should fail")
+	}
+}
+
+//复制时往别名写入, 检查旧索引已经禁止写入
+type writeDuringCopy struct {
+	backend.SearchBackend
+	alias string
+	err   error //写入的结果
+	fail  bool
+}
+
+func (b *writeDuringCopy) Reindex(ctx context.Context, source, dest string) (*elastic.BulkIndexByScrollResponse, error) {
+	_, b.err = b.Index(ctx, b.alias, "9", map[string]interface{}{"id": 9, "title": "course 9"})
+	if b.fail {
+		return nil, fmt.Errorf("reindex failed")
+	}
+	return b.SearchBackend.Reindex(ctx, source, dest)
+}
+
+func TestReindexBlocksWrites(t *testing.T) {
+	repo, registry, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+	seed(t, repo, "course_v3", 2)
+	if err := repo.UpdateAliases(ctx, elastic.NewAliasAddAction("course").Index("course_v3")); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := &writeDuringCopy{SearchBackend: repo, alias: "course", fail: true}
+	r := New(wrapped, registry, nil)
+
+	//失败时也要解除
+	if _, err := r.Run(ctx, Options{Alias: "course", Version: 4}); err == nil {
+		t.Fatal("expected reindex error")
+	}
+	if wrapped.err == nil {
+		t.Error("write during the copy was accepted")
+	}
+	if _, err := repo.Index(ctx, "course_v3", "9", map[string]interface{}{"id": 9}); err != nil {
+		t.Errorf("course_v3 is still blocked after a failed reindex: %v", err)
+	}
+
+	wrapped.fail = false
+	res, err := r.Run(ctx, Options{Alias: "course", Version: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.err == nil || !reflect.DeepEqual(res.Blocked, []string{"course_v3"}) || res.Count != 3 {
+		t.Errorf("result = %+v, write = %v", res, wrapped.err)
+	}
+	if _, err := repo.Index(ctx, "course_v3", "10", map[string]interface{}{"id": 10}); err != nil {
+		t.Errorf("course_v3 is still blocked after the swap: %v", err)
+	}
+	if _, err := repo.Index(ctx, "course", "10", map[string]interface{}{"id": 10}); err != nil {
+		t.Errorf("write through the alias after the swap: %v", err)
+	}
+}
+
+func TestRunMySQL(t *testing.T) {
+	repo, registry, cleanup := setup(t)
+	defer cleanup()
+	ctx := context.Background()
+	seed(t, repo, "course_v3", 1)
+	if err := repo.UpdateAliases(ctx, elastic.NewAliasAddAction("course").Index("course_v3")); err != nil {
+		t.Fatal(err)
+	}
+
+	//导入报告的条数和索引里的不一致, 不能切换别名
+	loaded := 2
+	r := New(repo, registry, func(ctx context.Context, index string) (int64, int64, error) {
+		seed(t, repo, index, loaded)
+		return 3, 0, nil
+	})
+	if _, err := r.Run(ctx, Options{Alias: "course", Version: 4, Source: SourceMySQL}); err == nil {
+		t.Fatal("count mismatch should fail")
+	}
+	if exists, _ := repo.IndexExists(ctx, "course_v4"); exists {
+		t.Error("course_v4 should be dropped after a failed reindex")
+	}
+	if got := aliasIndices(t, repo, "course"); !reflect.DeepEqual(got, []string{"course_v3"}) {
+		t.Errorf("course -> %v, want unchanged", got)
+	}
+
+	loaded = 3
+	res, err := r.Run(ctx, Options{Alias: "course", Version: 4, Source: SourceMySQL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 3 || res.Dropped != nil {
+		t.Errorf("result = %+v", res)
+	}
+	if got := aliasIndices(t, repo, "course"); !reflect.DeepEqual(got, []string{"course_v4"}) {
+		t.Errorf("course -> %v", got)
+	}
+}
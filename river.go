@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"edusoho_search/river"
+
+	"github.com/gin-gonic/gin"
+)
+
+//同步mysql到es
+//以前用单独的 go-mysql-elasticsearch, 现在由 river 包在进程里读binlog, 规则还是写在 river.toml
+//开启mysql binlog日志，且必须为ROW格式
+
+// <p>通常配置文件都是在mysql的my.cnf，不知道在哪的可以用<br><code>whereis my.cnf</code>
+// 找到，然后把<code>binlog_format</code>配置 <code> cat /etc/my.cnf|grep binlog_format</code>修改成ROW，重启！</p>
+var binlogRiver *river.River
+
+//出错后等一会再从保存的位置重新同步
+var riverRetryDelay = 5 * time.Second
+
+func setupRiver() {
+	if !appConfig().River.Enabled {
+		return
+	}
+	cfg, err := river.LoadConfig(appConfig().River.Config)
+	checkErr(err)
+	source, err := river.NewBinlogSource(cfg)
+	checkErr(err)
+	binlogRiver = river.New(cfg, repo, source)
+	fmt.Println("开始同步binlog")
+
+	go func() {
+		for {
+			err := binlogRiver.Run(context.Background())
+			log.Printf("river stopped: %v, restart in %s", err, riverRetryDelay)
+			time.Sleep(riverRetryDelay)
+		}
+	}()
+}
+
+func riverStatus(c *gin.Context) {
+	if binlogRiver == nil {
+		abortWithError(c, errNotFound("binlog sync is not enabled"))
+		return
+	}
+	c.JSON(http.StatusOK, binlogRiver.Status())
+}
@@ -0,0 +1,221 @@
+package river
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+//从mysql读取binlog, 需要开启binlog且 binlog_format=ROW, 账号要有 REPLICATION SLAVE 权限
+type BinlogSource struct {
+	cfg      *Config
+	db       *sql.DB
+	syncer   *replication.BinlogSyncer
+	streamer *replication.BinlogStreamer
+	name     string //当前binlog文件名
+	tables   map[string]*tableInfo
+}
+
+//binlog里没有列名, 需要查表结构
+type tableInfo struct {
+	columns []string
+	pk      []string
+}
+
+func NewBinlogSource(cfg *Config) (*BinlogSource, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s)/?charset=%s", cfg.MyUser, cfg.MyPassword, cfg.MyAddr, cfg.MyCharset)
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &BinlogSource{cfg: cfg, db: db, tables: make(map[string]*tableInfo)}, nil
+}
+
+func (s *BinlogSource) Start(pos Position) error {
+	if s.syncer != nil {
+		s.syncer.Close()
+	}
+	host, port, err := net.SplitHostPort(s.cfg.MyAddr)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	if pos.Name == "" {
+		if pos, err = s.masterPosition(); err != nil {
+			return err
+		}
+	}
+	s.syncer = replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID: s.cfg.ServerID,
+		Flavor:   s.cfg.Flavor,
+		Host:     host,
+		Port:     uint16(portNum),
+		User:     s.cfg.MyUser,
+		Password: s.cfg.MyPassword,
+		Charset:  s.cfg.MyCharset,
+	})
+	s.streamer, err = s.syncer.StartSync(mysql.Position{Name: pos.Name, Pos: pos.Pos})
+	if err != nil {
+		return err
+	}
+	s.name = pos.Name
+	return nil
+}
+
+//第一次启动时从当前位置开始, 之前的数据用 importer 全量导入
+func (s *BinlogSource) masterPosition() (Position, error) {
+	var pos Position
+	rows, err := s.db.Query("SHOW MASTER STATUS")
+	if err != nil {
+		return pos, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return pos, err
+	}
+	if !rows.Next() {
+		return pos, fmt.Errorf("river: binlog is not enabled on %s", s.cfg.MyAddr)
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return pos, err
+	}
+	n, err := strconv.ParseUint(string(values[1]), 10, 32)
+	if err != nil {
+		return pos, err
+	}
+	pos.Name, pos.Pos = string(values[0]), uint32(n)
+	return pos, nil
+}
+
+func (s *BinlogSource) table(schema, table string) (*tableInfo, error) {
+	key := schema + "." + table
+	if info, ok := s.tables[key]; ok {
+		return info, nil
+	}
+	rows, err := s.db.Query(fmt.Sprintf("SHOW COLUMNS FROM `%s`.`%s`", schema, table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	info := &tableInfo{}
+	for rows.Next() {
+		var field, typ, null, key, extra string
+		var def sql.NullString
+		if err := rows.Scan(&field, &typ, &null, &key, &def, &extra); err != nil {
+			return nil, err
+		}
+		info.columns = append(info.columns, field)
+		if key == "PRI" {
+			info.pk = append(info.pk, field)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.tables[key] = info
+	return info, nil
+}
+
+func (s *BinlogSource) Next(ctx context.Context) (*Event, error) {
+	for {
+		ev, err := s.streamer.GetEvent(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pos := Position{Name: s.name, Pos: ev.Header.LogPos}
+		switch e := ev.Event.(type) {
+		case *replication.RotateEvent:
+			s.name = string(e.NextLogName)
+			return &Event{Pos: Position{Name: s.name, Pos: uint32(e.Position)}}, nil
+		case *replication.XIDEvent:
+			return &Event{Pos: pos, Timestamp: int64(ev.Header.Timestamp)}, nil
+		case *replication.QueryEvent:
+			//表结构可能变了, 清掉缓存重新查
+			query := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+			if strings.HasPrefix(query, "ALTER") || strings.HasPrefix(query, "RENAME") || strings.HasPrefix(query, "DROP") {
+				s.tables = make(map[string]*tableInfo)
+			}
+			return &Event{Pos: pos, Timestamp: int64(ev.Header.Timestamp)}, nil
+		case *replication.RowsEvent:
+			action := rowsAction(ev.Header.EventType)
+			schema, table := string(e.Table.Schema), string(e.Table.Table)
+			if action == "" || s.cfg.ruleFor(schema, table) == nil {
+				continue
+			}
+			info, err := s.table(schema, table)
+			if err != nil {
+				return nil, err
+			}
+			if len(info.columns) != int(e.ColumnCount) {
+				return nil, fmt.Errorf("river: %s.%s has %d columns but binlog has %d", schema, table, len(info.columns), e.ColumnCount)
+			}
+			return &Event{
+				Action:    action,
+				Schema:    schema,
+				Table:     table,
+				Columns:   info.columns,
+				PK:        info.pk,
+				Rows:      copyRows(e.Rows),
+				Pos:       pos,
+				Timestamp: int64(ev.Header.Timestamp),
+			}, nil
+		}
+	}
+}
+
+func rowsAction(t replication.EventType) string {
+	switch t {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		return ActionInsert
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		return ActionUpdate
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		return ActionDelete
+	}
+	return ""
+}
+
+//binlog解析出来的字符串和读缓冲共用内存, 这里复制一份, text/blob转成字符串
+func copyRows(rows [][]interface{}) [][]interface{} {
+	copied := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		copied[i] = make([]interface{}, len(row))
+		for j, v := range row {
+			switch b := v.(type) {
+			case string:
+				copied[i][j] = string([]byte(b))
+			case []byte:
+				copied[i][j] = string(b)
+			default:
+				copied[i][j] = v
+			}
+		}
+	}
+	return copied
+}
+
+func (s *BinlogSource) Close() error {
+	if s.syncer != nil {
+		s.syncer.Close()
+		s.syncer = nil
+	}
+	return s.db.Close()
+}
+
+var _ EventSource = (*BinlogSource)(nil)
@@ -0,0 +1,137 @@
+//river 读取mysql的binlog, 按 river.toml 里的规则把行变更同步到es, 代替单独部署的 go-mysql-elasticsearch
+package river
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+//river.toml 的配置, 字段和 go-mysql-elasticsearch 兼容, es相关的配置(es_addr等)不再使用, 统一走 conf/app.ini
+type Config struct {
+	MyAddr     string `toml:"my_addr"`
+	MyUser     string `toml:"my_user"`
+	MyPassword string `toml:"my_pass"`
+	MyCharset  string `toml:"my_charset"`
+
+	ServerID uint32 `toml:"server_id"`
+	Flavor   string `toml:"flavor"`
+	DataDir  string `toml:"data_dir"`
+
+	BulkSize      int      `toml:"bulk_size"`
+	FlushBulkTime duration `toml:"flush_bulk_time"`
+	//bulk 里被 es 拒绝(429, 503)的条目退避后重试几次, 重试完还失败时不保存位置, 重启后重新同步
+	MaxRetries   int      `toml:"max_retries"`
+	RetryBackoff duration `toml:"retry_backoff"`
+
+	Sources []SourceConfig `toml:"source"`
+	Rules   []*Rule        `toml:"rule"`
+}
+
+type SourceConfig struct {
+	Schema string   `toml:"schema"`
+	Tables []string `toml:"tables"`
+}
+
+//toml里的时间写成 "200ms" 这样的字符串
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func LoadConfig(path string) (*Config, error) {
+	var cfg Config
+	md, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	//从 go-mysql-elasticsearch 复制过来的配置, 这几项不会生效
+	for _, key := range []string{"es_addr", "es_user", "es_pass", "es_https"} {
+		if md.IsDefined(key) {
+			log.Printf("river: %s in %s is ignored, configure elasticsearch in conf/app.ini", key, path)
+		}
+	}
+	if err := cfg.prepare(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) prepare() error {
+	if c.MyCharset == "" {
+		c.MyCharset = "utf8"
+	}
+	if c.Flavor == "" {
+		c.Flavor = "mysql"
+	}
+	if c.ServerID == 0 {
+		c.ServerID = 1001
+	}
+	if c.BulkSize <= 0 {
+		c.BulkSize = 128
+	}
+	if c.FlushBulkTime.Duration <= 0 {
+		c.FlushBulkTime.Duration = 200 * time.Millisecond
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = 5
+	}
+	if c.RetryBackoff.Duration <= 0 {
+		c.RetryBackoff.Duration = 100 * time.Millisecond
+	}
+
+	//source里的每个表都要有规则, 没写 [[rule]] 的按默认规则同步到同名索引
+	sourceTables := make(map[string]bool)
+	for _, s := range c.Sources {
+		for _, table := range s.Tables {
+			sourceTables[s.Schema+"."+table] = true
+		}
+	}
+	ruled := make(map[string]bool)
+	for _, rule := range c.Rules {
+		key := rule.Schema + "." + rule.Table
+		if !sourceTables[key] {
+			return fmt.Errorf("river: rule %s is not in any [[source]]", key)
+		}
+		ruled[key] = true
+	}
+	for _, s := range c.Sources {
+		for _, table := range s.Tables {
+			if !ruled[s.Schema+"."+table] {
+				c.Rules = append(c.Rules, &Rule{Schema: s.Schema, Table: table})
+			}
+		}
+	}
+	for _, rule := range c.Rules {
+		if err := rule.prepare(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//找到表对应的规则, 没有时返回nil
+func (c *Config) ruleFor(schema, table string) *Rule {
+	for _, rule := range c.Rules {
+		if rule.match(schema, table) {
+			return rule
+		}
+	}
+	return nil
+}
+
+//表名是正则的时候按整个表名匹配, 比如 t_[0-9]{4}
+func compileTable(table string) (*regexp.Regexp, error) {
+	if regexp.QuoteMeta(table) == table {
+		return nil, nil
+	}
+	return regexp.Compile("^" + strings.TrimSuffix(strings.TrimPrefix(table, "^"), "$") + "$")
+}
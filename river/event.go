@@ -0,0 +1,90 @@
+package river
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+)
+
+const (
+	ActionInsert = "insert"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+//binlog事件, Action 为空表示只推进位置(事务提交, 切换binlog文件等), 只有这种位置可以安全保存
+type Event struct {
+	Action  string          `json:"action,omitempty"`
+	Schema  string          `json:"schema,omitempty"`
+	Table   string          `json:"table,omitempty"`
+	Columns []string        `json:"columns,omitempty"`
+	PK      []string        `json:"pk,omitempty"`
+	Rows    [][]interface{} `json:"rows,omitempty"` //update 时前后两行为一组
+	Pos     Position        `json:"pos"`            //事件结束后的位置
+	//写入binlog的时间, unix秒, 用来计算同步延迟; 切换binlog文件这类事件没有时间
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+//binlog事件来源, 线上读mysql, 测试时读录制好的文件
+type EventSource interface {
+	//从pos之后开始读, pos为空时从当前位置开始; 重启时上一次的 Next 已经返回
+	Start(pos Position) error
+	//没有更多事件时返回 io.EOF
+	Next(ctx context.Context) (*Event, error)
+	Close() error
+}
+
+//从文件读取录制的事件, 每行一个json
+type FileSource struct {
+	path    string
+	file    *os.File
+	decoder *json.Decoder
+	start   Position
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Start(pos Position) error {
+	s.Close()
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	s.decoder = json.NewDecoder(bufio.NewReader(file))
+	//数字保持原样, id 不会变成 1e+06
+	s.decoder.UseNumber()
+	s.start = pos
+	return nil
+}
+
+func (s *FileSource) Next(ctx context.Context) (*Event, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var ev Event
+		if err := s.decoder.Decode(&ev); err != nil {
+			return nil, err
+		}
+		//跳过已经同步过的事件
+		if s.start.Name != "" && ev.Pos.Compare(s.start) <= 0 {
+			continue
+		}
+		return &ev, nil
+	}
+}
+
+func (s *FileSource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+var _ EventSource = (*FileSource)(nil)
@@ -0,0 +1,69 @@
+package river
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+//binlog 位置, 保存在 data_dir/master.info, 格式和 go-mysql-elasticsearch 一样
+type Position struct {
+	Name string `toml:"bin_name" json:"name"`
+	Pos  uint32 `toml:"bin_pos" json:"pos"`
+}
+
+func (p Position) Compare(o Position) int {
+	switch {
+	case p.Name > o.Name:
+		return 1
+	case p.Name < o.Name:
+		return -1
+	case p.Pos > o.Pos:
+		return 1
+	case p.Pos < o.Pos:
+		return -1
+	}
+	return 0
+}
+
+func positionFile(dataDir string) string {
+	return filepath.Join(dataDir, "master.info")
+}
+
+//没有 master.info 时返回空位置
+func loadPosition(dataDir string) (Position, error) {
+	var pos Position
+	if dataDir == "" {
+		return pos, nil
+	}
+	data, err := ioutil.ReadFile(positionFile(dataDir))
+	if os.IsNotExist(err) {
+		return pos, nil
+	} else if err != nil {
+		return pos, err
+	}
+	_, err = toml.Decode(string(data), &pos)
+	return pos, err
+}
+
+//先写临时文件再rename, 避免写一半进程退出
+func savePosition(dataDir string, pos Position) error {
+	if dataDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(pos); err != nil {
+		return err
+	}
+	tmp := positionFile(dataDir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, positionFile(dataDir))
+}
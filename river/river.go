@@ -0,0 +1,307 @@
+package river
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"edusoho_search/backend"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//同步状态
+type Status struct {
+	Position Position `json:"position"`
+	Inserted int64    `json:"inserted"`
+	Updated  int64    `json:"updated"`
+	Deleted  int64    `json:"deleted"`
+	Failed   int64    `json:"failed"`
+	//最近一次提交的事件从写入binlog到同步到es用了多少秒
+	Delay float64 `json:"delay"`
+	//最近一次同步出错的原因, 之后提交成功时清空
+	Error string `json:"error,omitempty"`
+}
+
+type River struct {
+	cfg    *Config
+	repo   backend.SearchBackend
+	source EventSource
+
+	//还没提交的bulk请求, 和最近一个可以安全保存的位置
+	pending []elastic.BulkableRequest
+	pos     Position
+	saved   Position
+	//还没提交的最新事件的binlog时间
+	eventTime int64
+
+	mu     sync.Mutex
+	status Status
+}
+
+func New(cfg *Config, repo backend.SearchBackend, source EventSource) *River {
+	return &River{cfg: cfg, repo: repo, source: source}
+}
+
+func (r *River) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+//从 data_dir 里保存的位置开始同步, 直到ctx取消或者出错; 事件源读完(io.EOF)时提交剩余数据后返回nil
+func (r *River) Run(ctx context.Context) error {
+	err := r.run(ctx)
+	if err != nil && err != context.Canceled {
+		r.mu.Lock()
+		r.status.Error = err.Error()
+		r.mu.Unlock()
+	}
+	return err
+}
+
+func (r *River) run(ctx context.Context) error {
+	pos, err := loadPosition(r.cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	if err := r.source.Start(pos); err != nil {
+		return err
+	}
+	r.pending = r.pending[:0]
+	r.pos, r.saved = pos, pos
+	r.setPosition(pos)
+
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan *Event)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	//返回前等读事件的协程退出, 重启时 Start 才不会和上一次的 Next 同时改 source
+	defer func() {
+		cancel()
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		for {
+			ev, err := r.source.Next(ctx)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(r.cfg.FlushBulkTime.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if err := r.handle(ev); err != nil {
+				return err
+			}
+			if len(r.pending) >= r.cfg.BulkSize {
+				if err := r.flush(ctx); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := r.flush(ctx); err != nil {
+				return err
+			}
+		case err := <-errc:
+			if err == io.EOF {
+				return r.flush(ctx)
+			}
+			return err
+		case <-ctx.Done():
+			//没提交的数据不保存位置, 重启后会重新同步
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *River) handle(ev *Event) error {
+	if ev.Timestamp > 0 {
+		r.eventTime = ev.Timestamp
+	}
+	if ev.Action == "" {
+		r.pos = ev.Pos
+		return nil
+	}
+	rule := r.cfg.ruleFor(ev.Schema, ev.Table)
+	if rule == nil {
+		return nil
+	}
+	switch ev.Action {
+	case ActionInsert:
+		for _, row := range ev.Rows {
+			if err := r.index(rule, ev, row); err != nil {
+				return err
+			}
+		}
+		r.count(&r.status.Inserted, len(ev.Rows))
+	case ActionDelete:
+		for _, row := range ev.Rows {
+			id, err := rule.docId(ev.Columns, ev.PK, row)
+			if err != nil {
+				return err
+			}
+			r.pending = append(r.pending, elastic.NewBulkDeleteRequest().Index(rule.Index).Type(rule.Type).Id(id))
+		}
+		r.count(&r.status.Deleted, len(ev.Rows))
+	case ActionUpdate:
+		if len(ev.Rows)%2 != 0 {
+			return fmt.Errorf("river: update event on %s.%s has %d rows", ev.Schema, ev.Table, len(ev.Rows))
+		}
+		for i := 0; i < len(ev.Rows); i += 2 {
+			before, after := ev.Rows[i], ev.Rows[i+1]
+			oldId, err := rule.docId(ev.Columns, ev.PK, before)
+			if err != nil {
+				return err
+			}
+			newId, err := rule.docId(ev.Columns, ev.PK, after)
+			if err != nil {
+				return err
+			}
+			//主键改了要删掉旧文档
+			if oldId != newId {
+				r.pending = append(r.pending, elastic.NewBulkDeleteRequest().Index(rule.Index).Type(rule.Type).Id(oldId))
+			}
+			if err := r.index(rule, ev, after); err != nil {
+				return err
+			}
+		}
+		r.count(&r.status.Updated, len(ev.Rows)/2)
+	default:
+		return fmt.Errorf("river: unknown action %q", ev.Action)
+	}
+	return nil
+}
+
+//整行覆盖写入, 重复同步同一个事件结果不变
+func (r *River) index(rule *Rule, ev *Event, row []interface{}) error {
+	id, err := rule.docId(ev.Columns, ev.PK, row)
+	if err != nil {
+		return err
+	}
+	r.pending = append(r.pending, elastic.NewBulkIndexRequest().
+		Index(rule.Index).Type(rule.Type).Id(id).Doc(rule.makeDoc(ev.Columns, row)))
+	return nil
+}
+
+//被拒绝的条目和它后面的条目一起按原来的顺序重新提交, 同一个文档不会被旧的数据覆盖;
+//整行覆盖和删除重复执行结果不变; 其他失败记数后跳过
+func (r *River) bulk(ctx context.Context) error {
+	requests := r.pending
+	backoff := r.cfg.RetryBackoff.Duration
+	for retry := 0; ; retry++ {
+		res, err := r.repo.Bulk(ctx, requests...)
+		if err != nil {
+			return err
+		}
+		if len(res.Items) != len(requests) {
+			return fmt.Errorf("river: es returned %d results for %d actions", len(res.Items), len(requests))
+		}
+		first, failed := len(requests), 0
+		var rejected *elastic.BulkResponseItem
+		for i, items := range res.Items {
+			for op, item := range items {
+				switch {
+				//删除不存在的文档不算失败
+				case item.Status >= 200 && item.Status <= 299 || op == "delete" && item.Status == 404:
+				//重建索引时旧索引会临时禁止写入, 重试直到别名切到新索引, 重试完还不行就从保存的位置重新同步
+				case item.Status == http.StatusTooManyRequests || item.Status == http.StatusServiceUnavailable || blocked(item):
+					if rejected == nil {
+						first, rejected = i, item
+					}
+				case rejected == nil:
+					log.Printf("river: %s %s/%s failed: %d %s", op, item.Index, item.Id, item.Status, reason(item))
+					failed++
+				}
+			}
+		}
+		r.count(&r.status.Failed, failed)
+		if rejected == nil {
+			return nil
+		}
+		if retry >= r.cfg.MaxRetries {
+			return fmt.Errorf("river: %s/%s still rejected after %d retries: %d %s",
+				rejected.Index, rejected.Id, retry, rejected.Status, reason(rejected))
+		}
+		log.Printf("river: %s/%s rejected: %d %s, retry %d actions in %s",
+			rejected.Index, rejected.Id, rejected.Status, reason(rejected), len(requests)-first, backoff)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		requests = requests[first:]
+	}
+}
+
+func blocked(item *elastic.BulkResponseItem) bool {
+	return item.Error != nil && item.Error.Type == "cluster_block_exception"
+}
+
+func reason(item *elastic.BulkResponseItem) string {
+	if item.Error != nil {
+		return item.Error.Reason
+	}
+	return ""
+}
+
+func (r *River) count(n *int64, delta int) {
+	r.mu.Lock()
+	*n += int64(delta)
+	r.mu.Unlock()
+}
+
+func (r *River) setPosition(pos Position) {
+	r.mu.Lock()
+	r.status.Position = pos
+	r.mu.Unlock()
+}
+
+//重试间隔翻倍, 最多等这么久
+const maxRetryBackoff = 10 * time.Second
+
+//提交bulk, 所有条目都有了最终结果才保存位置
+func (r *River) flush(ctx context.Context) error {
+	if len(r.pending) > 0 {
+		if err := r.bulk(ctx); err != nil {
+			return err
+		}
+		r.pending = r.pending[:0]
+	}
+	if r.pos == r.saved {
+		return nil
+	}
+	if err := savePosition(r.cfg.DataDir, r.pos); err != nil {
+		return err
+	}
+	r.saved = r.pos
+	r.setPosition(r.pos)
+	r.mu.Lock()
+	r.status.Error = ""
+	if r.eventTime > 0 {
+		r.status.Delay = time.Since(time.Unix(r.eventTime, 0)).Seconds()
+		r.eventTime = 0
+	}
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,250 @@
+package river
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"edusoho_search/backend"
+	"edusoho_search/estest"
+)
+
+func newRiver(t *testing.T) (*River, backend.SearchBackend, *estest.Server, func()) {
+	cfg, err := LoadConfig("testdata/river.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "river")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DataDir = dir
+	server := estest.NewServer()
+	repo, err := backend.New(backend.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := New(cfg, repo, NewFileSource("testdata/events.json"))
+	return r, repo, server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//取文档的_source, 不存在时返回nil
+func getDoc(t *testing.T, repo backend.SearchBackend, index, id string) map[string]interface{} {
+	t.Helper()
+	res, err := repo.Get(context.Background(), index, id)
+	if err != nil || !res.Found {
+		return nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(*res.Source, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := LoadConfig("testdata/river.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.BulkSize != 2 || cfg.FlushBulkTime.Milliseconds() != 10 {
+		t.Errorf("bulk size %d, flush time %v", cfg.BulkSize, cfg.FlushBulkTime)
+	}
+	cases := []struct {
+		schema, table, index string
+	}{
+		{"test", "t", "t"},
+		{"test", "t_0001", "test"},
+		{"test", "tid_0002", "tid"},
+	}
+	for _, tc := range cases {
+		rule := cfg.ruleFor(tc.schema, tc.table)
+		if rule == nil || rule.Index != tc.index || rule.Type != backend.DefaultType {
+			t.Errorf("%s.%s: rule = %+v, want index %s", tc.schema, tc.table, rule, tc.index)
+		}
+	}
+	for _, table := range []string{"t_01", "tx", "t_00012"} {
+		if rule := cfg.ruleFor("test", table); rule != nil {
+			t.Errorf("%s matched rule %s", table, rule.Table)
+		}
+	}
+	if cfg.ruleFor("other", "t") != nil {
+		t.Error("other.t matched a rule")
+	}
+
+	//仓库里的 river.toml 也要能加载
+	cfg, err = LoadConfig("../river.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule := cfg.ruleFor("edusoho", "course_set_v8"); rule == nil || rule.Index != "course" {
+		t.Errorf("course rule = %+v", rule)
+	}
+}
+
+func TestRun(t *testing.T) {
+	r, repo, _, cleanup := newRiver(t)
+	defer cleanup()
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		index, id string
+		want      map[string]interface{}
+	}{
+		{"t", "1", map[string]interface{}{"id": 1.0, "name": "a2"}},
+		{"t", "2", nil},
+		{"t", "5", map[string]interface{}{"id": 5.0, "name": "b"}},
+		{"test", "3", nil},
+		{"tfield", "1", map[string]interface{}{
+			"es_id":    1.0,
+			"es_tags":  []interface{}{"go", "es"},
+			"keywords": []interface{}{"mysql", "binlog"},
+		}},
+		{"tfilter", "1", map[string]interface{}{"id": 1.0, "name": "f", "suggest": map[string]interface{}{
+			"input":    []interface{}{"f"},
+			"weight":   10.0,
+			"contexts": map[string]interface{}{"cat": []interface{}{"20"}},
+		}}},
+		{"tid", "1:x", map[string]interface{}{"id": 1.0, "tag": "x", "desc": "first"}},
+	}
+	for _, tc := range cases {
+		if doc := getDoc(t, repo, tc.index, tc.id); !reflect.DeepEqual(doc, tc.want) {
+			t.Errorf("%s/%s = %v, want %v", tc.index, tc.id, doc, tc.want)
+		}
+	}
+	if ok, _ := repo.IndexExists(context.Background(), "other"); ok {
+		t.Error("row of a table without rule was synced")
+	}
+
+	status := r.Status()
+	if status.Inserted != 6 || status.Updated != 2 || status.Deleted != 2 || status.Failed != 0 {
+		t.Errorf("status = %+v", status)
+	}
+	//录制的事件时间是 2020-09-13
+	if status.Delay < time.Since(time.Unix(1600000000, 0)).Seconds()-60 {
+		t.Errorf("delay = %v", status.Delay)
+	}
+	want := Position{Name: "mysql-bin.000002", Pos: 220}
+	if pos, err := loadPosition(r.cfg.DataDir); err != nil || pos != want {
+		t.Errorf("saved position = %v, %v, want %v", pos, err, want)
+	}
+}
+
+//重启后从保存的位置继续, 之前的事件不再同步
+func TestResume(t *testing.T) {
+	r, repo, _, cleanup := newRiver(t)
+	defer cleanup()
+	if err := savePosition(r.cfg.DataDir, Position{Name: "mysql-bin.000001", Pos: 340}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if doc := getDoc(t, repo, "tfield", "1"); doc != nil {
+		t.Errorf("event before the saved position was replayed: %v", doc)
+	}
+	if doc := getDoc(t, repo, "t", "1"); doc == nil || doc["name"] != "a2" {
+		t.Errorf("t/1 = %v, want the update after the saved position", doc)
+	}
+	if status := r.Status(); status.Inserted != 0 || status.Updated != 2 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+//es 拒绝的条目重试成功后才保存位置
+func TestRetryRejected(t *testing.T) {
+	r, repo, server, cleanup := newRiver(t)
+	defer cleanup()
+	r.cfg.RetryBackoff.Duration = time.Millisecond
+	server.RejectBulkItems(3)
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if doc := getDoc(t, repo, "t", "1"); doc == nil || doc["name"] != "a2" {
+		t.Errorf("t/1 = %v after retries", doc)
+	}
+	if doc := getDoc(t, repo, "t", "2"); doc != nil {
+		t.Errorf("t/2 = %v, the retried insert overwrote the delete", doc)
+	}
+	if status := r.Status(); status.Failed != 0 {
+		t.Errorf("status = %+v", status)
+	}
+	want := Position{Name: "mysql-bin.000002", Pos: 220}
+	if pos, err := loadPosition(r.cfg.DataDir); err != nil || pos != want {
+		t.Errorf("saved position = %v, %v, want %v", pos, err, want)
+	}
+}
+
+//重试完还被拒绝时停止同步, 不保存位置
+func TestRejectedKeepsPosition(t *testing.T) {
+	r, _, server, cleanup := newRiver(t)
+	defer cleanup()
+	r.cfg.RetryBackoff.Duration = time.Millisecond
+	r.cfg.MaxRetries = 2
+	server.RejectBulkItems(1000)
+	if err := r.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "rejected after 2 retries") {
+		t.Fatalf("err = %v", err)
+	}
+	if pos, err := loadPosition(r.cfg.DataDir); err != nil || pos != (Position{}) {
+		t.Errorf("saved position = %v, %v, want none", pos, err)
+	}
+	if status := r.Status(); status.Failed != 0 || status.Error == "" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+//Next 在 ctx 取消后过一会儿才返回, 和 binlog 的读协程一样
+type slowSource struct {
+	name    string
+	reading int32
+	overlap bool
+}
+
+func (s *slowSource) Start(pos Position) error {
+	if atomic.LoadInt32(&s.reading) != 0 {
+		s.overlap = true
+	}
+	s.name = pos.Name
+	return nil
+}
+
+func (s *slowSource) Next(ctx context.Context) (*Event, error) {
+	atomic.AddInt32(&s.reading, 1)
+	defer atomic.AddInt32(&s.reading, -1)
+	<-ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+	_ = s.name
+	return nil, ctx.Err()
+}
+
+func (s *slowSource) Close() error { return nil }
+
+//重启时上一次的 Next 返回后才调用 Start, go test -race 下不能有数据竞争
+func TestRestart(t *testing.T) {
+	r, _, _, cleanup := newRiver(t)
+	defer cleanup()
+	source := &slowSource{}
+	r.source = source
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := r.Run(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("run %d: err = %v", i, err)
+		}
+	}
+	if source.overlap {
+		t.Error("Start was called while the previous Next was still running")
+	}
+}
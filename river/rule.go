@@ -0,0 +1,193 @@
+package river
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"edusoho_search/backend"
+)
+
+//一张表(或一组分表)到es索引的映射
+type Rule struct {
+	Schema string `toml:"schema"`
+	Table  string `toml:"table"`
+	Index  string `toml:"index"` //默认是表名
+	Type   string `toml:"type"`  //默认 doc
+
+	//文档id由这些列用 : 拼起来, 默认用主键
+	ID []string `toml:"id"`
+
+	//列名到es字段的映射, "es_tags,list" 表示按逗号拆成数组, 只写 ",list" 时字段名不变
+	FieldMapping map[string]string `toml:"field"`
+
+	//只同步这些列, 为空时同步所有列
+	Filter []string `toml:"filter"`
+
+	//生成补全字段, 格式和导入任务写的 suggest 字段一致
+	Completion *Completion `toml:"completion"`
+
+	tableRegexp *regexp.Regexp
+	filter      map[string]bool
+}
+
+func (r *Rule) prepare() error {
+	if r.Index == "" {
+		r.Index = strings.ToLower(r.Table)
+	}
+	if r.Type == "" {
+		r.Type = backend.DefaultType
+	}
+	re, err := compileTable(r.Table)
+	if err != nil {
+		return fmt.Errorf("river: rule %s.%s: %v", r.Schema, r.Table, err)
+	}
+	r.tableRegexp = re
+	if r.Completion != nil && r.Completion.Field == "" {
+		r.Completion.Field = "suggest"
+	}
+	if len(r.Filter) > 0 {
+		r.filter = make(map[string]bool, len(r.Filter))
+		for _, column := range r.Filter {
+			r.filter[column] = true
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(schema, table string) bool {
+	if r.Schema != schema {
+		return false
+	}
+	if r.tableRegexp != nil {
+		return r.tableRegexp.MatchString(table)
+	}
+	return r.Table == table
+}
+
+//行数据生成文档id, 多列时用 : 拼接
+func (r *Rule) docId(columns, pk []string, row []interface{}) (string, error) {
+	idColumns := r.ID
+	if len(idColumns) == 0 {
+		idColumns = pk
+	}
+	if len(idColumns) == 0 {
+		return "", fmt.Errorf("river: table %s.%s has no primary key and the rule has no id", r.Schema, r.Table)
+	}
+	parts := make([]string, 0, len(idColumns))
+	for _, name := range idColumns {
+		i := indexOf(columns, name)
+		if i < 0 || i >= len(row) {
+			return "", fmt.Errorf("river: id column %s not found in %s.%s", name, r.Schema, r.Table)
+		}
+		if row[i] == nil {
+			return "", fmt.Errorf("river: id column %s is null in %s.%s", name, r.Schema, r.Table)
+		}
+		parts = append(parts, fmt.Sprint(row[i]))
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+//行数据生成es文档, 处理字段过滤, 改名和 list 拆分
+func (r *Rule) makeDoc(columns []string, row []interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if i >= len(row) {
+			break
+		}
+		if r.filter != nil && !r.filter[column] {
+			continue
+		}
+		field, value := column, row[i]
+		if mapping, ok := r.FieldMapping[column]; ok {
+			name, kind := mapping, ""
+			if j := strings.Index(mapping, ","); j >= 0 {
+				name, kind = mapping[:j], mapping[j+1:]
+			}
+			if name != "" {
+				field = name
+			}
+			if kind == "list" {
+				value = splitList(value)
+			}
+		}
+		doc[field] = value
+	}
+	if r.Completion != nil {
+		if suggest := r.Completion.value(columns, row); suggest != nil {
+			doc[r.Completion.Field] = suggest
+		}
+	}
+	return doc
+}
+
+//completion 字段的生成规则
+type Completion struct {
+	Field    string            `toml:"field"`    //默认 suggest
+	Input    []string          `toml:"input"`    //输入的列, 空值跳过
+	Weight   string            `toml:"weight"`   //权重列, 比如 studentNum
+	Contexts map[string]string `toml:"contexts"` //上下文名 => 列
+}
+
+func (c *Completion) value(columns []string, row []interface{}) map[string]interface{} {
+	get := func(column string) interface{} {
+		if i := indexOf(columns, column); i >= 0 && i < len(row) {
+			return row[i]
+		}
+		return nil
+	}
+	input := make([]string, 0, len(c.Input))
+	for _, column := range c.Input {
+		if v := get(column); v != nil {
+			if s := strings.TrimSpace(fmt.Sprint(v)); s != "" {
+				input = append(input, s)
+			}
+		}
+	}
+	if len(input) == 0 {
+		return nil
+	}
+	suggest := map[string]interface{}{"input": input}
+	if c.Weight != "" {
+		//es的权重是非负的int32
+		weight, _ := strconv.ParseInt(fmt.Sprint(get(c.Weight)), 10, 64)
+		if weight < 0 {
+			weight = 0
+		} else if weight > math.MaxInt32 {
+			weight = math.MaxInt32
+		}
+		suggest["weight"] = weight
+	}
+	if len(c.Contexts) > 0 {
+		contexts := make(map[string][]string, len(c.Contexts))
+		for name, column := range c.Contexts {
+			if v := get(column); v != nil {
+				contexts[name] = []string{fmt.Sprint(v)}
+			}
+		}
+		suggest["contexts"] = contexts
+	}
+	return suggest
+}
+
+func splitList(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/olivere/elastic/v6"
+)
+
+//排序条件, CommonSearch.Sort 里按顺序比较
+type SortField struct {
+	Field   string      // 字段名, _score 表示按相关度
+	Order   string      `validate:"omitempty,oneof=asc desc"` // 默认 asc, _score 默认 desc
+	Missing interface{} // 没有值的文档排在 _first 或 _last(默认), 也可以是一个代替的值
+	Mode    string      `validate:"omitempty,oneof=min max sum avg median"` // 数组字段取哪个值参与排序
+	//脚本排序, 和 Field 二选一, 是 conf/app.ini 的 [script_sort] 里配置的名字, 不能直接传脚本;
+	//Params 是脚本的参数, 比如 price_rate= doc['price'].value * params.rate 的 rate
+	Script     string
+	ScriptType string `validate:"omitempty,oneof=number string"` // 脚本返回值的类型, 默认 number
+	Params     map[string]interface{}
+}
+
+//请求里没有指定排序时每个索引的默认排序, 来自 conf/app.ini 的 [sort], 重新加载配置时整个替换
+var defaultSorts atomic.Value // map[string][]*SortField
+
+//"_score,createdTime:desc" 这样的排序配置
+func parseSortSpec(spec string) ([]*SortField, error) {
+	sorts := make([]*SortField, 0)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		s := &SortField{Field: item}
+		if i := strings.LastIndex(item, ":"); i > 0 {
+			s.Field, s.Order = item[:i], strings.ToLower(item[i+1:])
+		}
+		if err := s.check(); err != nil {
+			return nil, fmt.Errorf("sort %q: %v", spec, err)
+		}
+		sorts = append(sorts, s)
+	}
+	return sorts, nil
+}
+
+func loadDefaultSorts() error {
+	sorts, err := parseDefaultSorts(appConfig().Sort)
+	if err != nil {
+		return err
+	}
+	defaultSorts.Store(sorts)
+	return nil
+}
+
+//[sort] 段, 索引名 => 排序配置
+func parseDefaultSorts(specs map[string]string) (map[string][]*SortField, error) {
+	sorts := make(map[string][]*SortField)
+	for index, spec := range specs {
+		s, err := parseSortSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		sorts[index] = s
+	}
+	return sorts, nil
+}
+
+func (s *SortField) check() error {
+	if s == nil {
+		return errBadRequest(fmt.Errorf("sort is null"))
+	}
+	if (s.Field == "") == (s.Script == "") {
+		return errBadRequest(fmt.Errorf("sort needs exactly one of Field and Script"))
+	}
+	if s.Order != "" && s.Order != "asc" && s.Order != "desc" {
+		return errBadRequest(fmt.Errorf("sort %s: Order must be asc or desc", s.Field))
+	}
+	if _, ok := appConfig().ScriptSort[s.Script]; s.Script != "" && !ok {
+		return errBadRequest(fmt.Errorf("unknown script sort %q", s.Script))
+	}
+	return nil
+}
+
+func (s *SortField) sorter() elastic.Sorter {
+	asc := s.Order == "asc"
+	if s.Script != "" {
+		typ := s.ScriptType
+		if typ == "" {
+			typ = "number"
+		}
+		script := elastic.NewScript(appConfig().ScriptSort[s.Script]).Lang("painless")
+		if len(s.Params) > 0 {
+			script.Params(s.Params)
+		}
+		return elastic.NewScriptSort(script, typ).Order(s.Order != "desc")
+	}
+	if s.Field == "_score" {
+		return elastic.NewScoreSort().Order(asc)
+	}
+	fs := elastic.NewFieldSort(s.Field).Order(s.Order != "desc")
+	if s.Missing != nil {
+		fs.Missing(s.Missing)
+	}
+	if s.Mode != "" {
+		fs.SortMode(s.Mode)
+	}
+	return fs
+}
+
+//老的 SortFields 参数, map 没有顺序, 按字段名排好保证每次结果一样
+func sortFieldsOf(sortFields map[string]string) []*SortField {
+	if len(sortFields) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(sortFields))
+	for f := range sortFields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	sorts := make([]*SortField, 0, len(names))
+	for _, f := range names {
+		order := "asc"
+		if strings.ToLower(sortFields[f]) == "desc" {
+			order = "desc"
+		}
+		sorts = append(sorts, &SortField{Field: f, Order: order})
+	}
+	return sorts
+}
+
+// 排序设置, 优先用 Sort, 然后是老的 SortFields, 最后是索引的默认排序, 都没有时按相关度
+func (r *CommonSearch) getSorters() ([]elastic.Sorter, error) {
+	sorts := r.Sort
+	if len(sorts) == 0 {
+		sorts = sortFieldsOf(r.SortFields)
+	}
+	if len(sorts) == 0 {
+		sorts = defaultSorts.Load().(map[string][]*SortField)[r.Index]
+	}
+	if len(sorts) == 0 {
+		return []elastic.Sorter{elastic.NewScoreSort()}, nil
+	}
+	sorters := make([]elastic.Sorter, 0, len(sorts))
+	for _, s := range sorts {
+		if err := s.check(); err != nil {
+			return nil, err
+		}
+		sorters = append(sorters, s.sorter())
+	}
+	return sorters, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/olivere/elastic/v6"
+)
+
+//补全的一条结果
+type Suggestion struct {
+	Id         string  `json:"id"`
+	Title      string  `json:"title"`
+	CategoryId int64   `json:"categoryId"`
+	Score      float64 `json:"score"` //学员数加权后的得分
+}
+
+type SuggestResponse struct {
+	Prefix      string        `json:"prefix"`
+	Suggestions []*Suggestion `json:"suggestions"`
+}
+
+//补全查的索引和导入任务写入的一致
+func suggestIndex() string {
+	return appConfig().Import.Index
+}
+
+//GET /api/v1/suggest?prefix=公务&category=1,2&size=10, 按标题前缀补全, 开启拼音时也按拼音(全拼或首字母)前缀补全
+func suggestCourses(c *gin.Context) {
+	prefix := strings.TrimSpace(c.Query("prefix"))
+	if prefix == "" {
+		abortWithError(c, errBadRequest(errors.New("prefix is required")))
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "10"))
+	if err != nil || size <= 0 || size > 50 {
+		abortWithError(c, errBadRequest(errors.New("size must be between 1 and 50")))
+		return
+	}
+	var categories []string
+	if category := c.Query("category"); category != "" {
+		for _, id := range strings.Split(category, ",") {
+			if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+				abortWithError(c, errBadRequest(fmt.Errorf("invalid category %q", id)))
+				return
+			}
+			categories = append(categories, id)
+		}
+	}
+
+	search := elastic.NewSearchSource().Size(0).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("title", "categoryId"))
+	fields := map[string]string{"title": "suggest"}
+	if analysisConfig().Pinyin {
+		fields["pinyin"] = "suggest.pinyin"
+	}
+	for name, field := range fields {
+		suggester := elastic.NewCompletionSuggester(name).Field(field).Prefix(strings.ToLower(prefix)).
+			Size(size).SkipDuplicates(true)
+		if len(categories) > 0 {
+			suggester.ContextQuery(elastic.NewSuggesterCategoryQuery("categoryId", categories...))
+		}
+		search.Suggester(suggester)
+	}
+
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	res, err := repo.Search(ctx, suggestIndex(), search)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, &SuggestResponse{Prefix: prefix, Suggestions: mergeSuggestions(res.Suggest, size)})
+}
+
+//合并标题和拼音的结果, 同一门课只保留一次, 按得分排序
+func mergeSuggestions(suggest elastic.SearchSuggest, size int) []*Suggestion {
+	byId := make(map[string]*Suggestion)
+	for _, name := range []string{"title", "pinyin"} {
+		for _, s := range suggest[name] {
+			for _, option := range s.Options {
+				//completion 的得分在 _score 里
+				score := math.Max(option.Score, option.ScoreUnderscore)
+				if old, ok := byId[option.Id]; ok {
+					old.Score = math.Max(old.Score, score)
+					continue
+				}
+				item := &Suggestion{Id: option.Id, Title: option.Text, Score: score}
+				if option.Source != nil {
+					var source struct {
+						Title      string `json:"title"`
+						CategoryId int64  `json:"categoryId"`
+					}
+					if err := json.Unmarshal(*option.Source, &source); err == nil {
+						item.Title, item.CategoryId = source.Title, source.CategoryId
+					}
+				}
+				byId[option.Id] = item
+			}
+		}
+	}
+	list := make([]*Suggestion, 0, len(byId))
+	for _, item := range byId {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Id < list[j].Id
+	})
+	if len(list) > size {
+		list = list[:size]
+	}
+	return list
+}